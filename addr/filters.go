@@ -0,0 +1,38 @@
+package addr
+
+import (
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+	mafmt "github.com/whyrusleeping/mafmt"
+)
+
+// RejectPrivate is an address filter that rejects IP addresses that aren't
+// publicly routable, i.e. loopback, private, link-local and unspecified
+// addresses. Addresses that don't start with an IP component, e.g. DNS
+// addresses, are accepted.
+func RejectPrivate(a ma.Multiaddr) bool {
+	first, _ := ma.SplitFirst(a)
+	if first == nil {
+		return false
+	}
+	switch first.Protocol().Code {
+	case ma.P_IP4, ma.P_IP6, ma.P_IP6ZONE:
+		return manet.IsPublicAddr(a)
+	default:
+		return true
+	}
+}
+
+// RejectUnknownTransports returns an address filter that only accepts the
+// addresses matching any of the given patterns, e.g. mafmt.TCP or
+// mafmt.QUIC.
+func RejectUnknownTransports(known ...mafmt.Pattern) func(ma.Multiaddr) bool {
+	return func(a ma.Multiaddr) bool {
+		for _, p := range known {
+			if p.Matches(a) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,40 @@
+package addr
+
+import (
+	"testing"
+
+	mafmt "github.com/whyrusleeping/mafmt"
+)
+
+func TestRejectPrivate(t *testing.T) {
+	cases := map[string]bool{
+		"/ip4/1.2.3.4/tcp/4001":       true,
+		"/ip4/127.0.0.1/tcp/4001":     false,
+		"/ip4/192.168.1.1/tcp/4001":   false,
+		"/ip6/::1/tcp/4001":           false,
+		"/ip6/2001:db9::1/tcp/4001":   true,
+		"/dns4/example.com/tcp/4001":  true,
+		"/ip4/0.0.0.0/udp/4001/quic":  false,
+		"/ip4/10.0.0.1/udp/4001/quic": false,
+	}
+	for s, want := range cases {
+		if got := RejectPrivate(newAddrOrFatal(t, s)); got != want {
+			t.Errorf("expected %s to be accepted: %t, got: %t", s, want, got)
+		}
+	}
+}
+
+func TestRejectUnknownTransports(t *testing.T) {
+	filter := RejectUnknownTransports(mafmt.TCP, mafmt.QUIC)
+	cases := map[string]bool{
+		"/ip4/1.2.3.4/tcp/4001":      true,
+		"/ip4/1.2.3.4/udp/4001/quic": true,
+		"/ip4/1.2.3.4/udp/4001":      false,
+		"/ip4/1.2.3.4/udp/4001/utp":  false,
+	}
+	for s, want := range cases {
+		if got := filter(newAddrOrFatal(t, s)); got != want {
+			t.Errorf("expected %s to be accepted: %t, got: %t", s, want, got)
+		}
+	}
+}
@@ -55,6 +55,7 @@ type Peerstore interface {
 	AddrBook
 	KeyBook
 	PeerMetadata
+	ProtoBook
 	Metrics
 
 	// PeerInfo returns a peer.PeerInfo struct for given peer.ID.
@@ -62,11 +63,6 @@ type Peerstore interface {
 	// that peer, useful to other services.
 	PeerInfo(peer.ID) PeerInfo
 
-	GetProtocols(peer.ID) ([]string, error)
-	AddProtocols(peer.ID, ...string) error
-	SetProtocols(peer.ID, ...string) error
-	SupportsProtocols(peer.ID, ...string) ([]string, error)
-
 	// Peers returns all of the peer IDs stored across all inner stores.
 	Peers() peer.IDSlice
 }
@@ -123,6 +119,22 @@ type AddrBook interface {
 	PeersWithAddrs() peer.IDSlice
 }
 
+// ProtoBook tracks the protocols supported by peers.
+type ProtoBook interface {
+	// GetProtocols returns the protocols known to be supported by a peer.
+	GetProtocols(peer.ID) ([]string, error)
+
+	// AddProtocols adds protocols to those supported by a peer.
+	AddProtocols(peer.ID, ...string) error
+
+	// SetProtocols replaces the protocols supported by a peer.
+	SetProtocols(peer.ID, ...string) error
+
+	// SupportsProtocols returns those of the given protocols that are
+	// supported by a peer.
+	SupportsProtocols(peer.ID, ...string) ([]string, error)
+}
+
 // KeyBook tracks the keys of Peers.
 type KeyBook interface {
 
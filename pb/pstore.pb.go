@@ -77,6 +77,14 @@ type AddrBookRecord_AddrEntry struct {
 	Expiry int64 `protobuf:"varint,2,opt,name=expiry,proto3" json:"expiry,omitempty"`
 	// The original TTL of this address.
 	Ttl int64 `protobuf:"varint,3,opt,name=ttl,proto3" json:"ttl,omitempty"`
+	// The dial priority of this address. Addresses with higher priorities should be dialed first.
+	Priority int64 `protobuf:"varint,4,opt,name=priority,proto3" json:"priority,omitempty"`
+	// The point in time when this address was first added.
+	Added int64 `protobuf:"varint,5,opt,name=added,proto3" json:"added,omitempty"`
+	// The point in time when a dial to this address last succeeded, or 0 if none ever did.
+	LastDialSuccess int64 `protobuf:"varint,6,opt,name=last_dial_success,json=lastDialSuccess,proto3" json:"last_dial_success,omitempty"`
+	// The number of dials to this address that failed since the last successful one.
+	DialFailures int64 `protobuf:"varint,7,opt,name=dial_failures,json=dialFailures,proto3" json:"dial_failures,omitempty"`
 }
 
 func (m *AddrBookRecord_AddrEntry) Reset()         { *m = AddrBookRecord_AddrEntry{} }
@@ -126,31 +134,132 @@ func (m *AddrBookRecord_AddrEntry) GetTtl() int64 {
 	return 0
 }
 
+func (m *AddrBookRecord_AddrEntry) GetPriority() int64 {
+	if m != nil {
+		return m.Priority
+	}
+	return 0
+}
+
+func (m *AddrBookRecord_AddrEntry) GetAdded() int64 {
+	if m != nil {
+		return m.Added
+	}
+	return 0
+}
+
+func (m *AddrBookRecord_AddrEntry) GetLastDialSuccess() int64 {
+	if m != nil {
+		return m.LastDialSuccess
+	}
+	return 0
+}
+
+func (m *AddrBookRecord_AddrEntry) GetDialFailures() int64 {
+	if m != nil {
+		return m.DialFailures
+	}
+	return 0
+}
+
+// CertifiedRecord represents the latest signed peer record accepted for a peer.
+type CertifiedRecord struct {
+	// The sequence number of the record.
+	Seq uint64 `protobuf:"varint,1,opt,name=seq,proto3" json:"seq,omitempty"`
+	// The point in time when this record expires.
+	Expiry int64 `protobuf:"varint,2,opt,name=expiry,proto3" json:"expiry,omitempty"`
+	// The signed envelope holding the record.
+	Envelope []byte `protobuf:"bytes,3,opt,name=envelope,proto3" json:"envelope,omitempty"`
+}
+
+func (m *CertifiedRecord) Reset()         { *m = CertifiedRecord{} }
+func (m *CertifiedRecord) String() string { return proto.CompactTextString(m) }
+func (*CertifiedRecord) ProtoMessage()    {}
+func (*CertifiedRecord) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f96873690e08a98f, []int{1}
+}
+func (m *CertifiedRecord) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *CertifiedRecord) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_CertifiedRecord.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalTo(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *CertifiedRecord) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CertifiedRecord.Merge(m, src)
+}
+func (m *CertifiedRecord) XXX_Size() int {
+	return m.Size()
+}
+func (m *CertifiedRecord) XXX_DiscardUnknown() {
+	xxx_messageInfo_CertifiedRecord.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CertifiedRecord proto.InternalMessageInfo
+
+func (m *CertifiedRecord) GetSeq() uint64 {
+	if m != nil {
+		return m.Seq
+	}
+	return 0
+}
+
+func (m *CertifiedRecord) GetExpiry() int64 {
+	if m != nil {
+		return m.Expiry
+	}
+	return 0
+}
+
+func (m *CertifiedRecord) GetEnvelope() []byte {
+	if m != nil {
+		return m.Envelope
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*AddrBookRecord)(nil), "pstore.pb.AddrBookRecord")
 	proto.RegisterType((*AddrBookRecord_AddrEntry)(nil), "pstore.pb.AddrBookRecord.AddrEntry")
+	proto.RegisterType((*CertifiedRecord)(nil), "pstore.pb.CertifiedRecord")
 }
 
 func init() { proto.RegisterFile("pstore.proto", fileDescriptor_f96873690e08a98f) }
 
 var fileDescriptor_f96873690e08a98f = []byte{
-	// 255 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x29, 0x28, 0x2e, 0xc9,
-	0x2f, 0x4a, 0xd5, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0xe2, 0x84, 0xf1, 0x92, 0xa4, 0x74, 0xd3,
-	0x33, 0x4b, 0x32, 0x4a, 0x93, 0xf4, 0x92, 0xf3, 0x73, 0xf5, 0xd3, 0xf3, 0xd3, 0xf3, 0xf5, 0xc1,
-	0x2a, 0x92, 0x4a, 0xd3, 0xc0, 0x3c, 0x30, 0x07, 0xcc, 0x82, 0xe8, 0x54, 0x3a, 0xc6, 0xc8, 0xc5,
-	0xe7, 0x98, 0x92, 0x52, 0xe4, 0x94, 0x9f, 0x9f, 0x1d, 0x94, 0x9a, 0x9c, 0x5f, 0x94, 0x22, 0x24,
-	0xcf, 0xc5, 0x94, 0x99, 0x22, 0xc1, 0xa8, 0xc0, 0xa8, 0xc1, 0xe3, 0xc4, 0x7f, 0xeb, 0x9e, 0x3c,
-	0x77, 0x00, 0x48, 0x65, 0x40, 0x6a, 0x6a, 0x91, 0xa7, 0x4b, 0x10, 0x53, 0x66, 0x8a, 0x90, 0x25,
-	0x17, 0x6b, 0x62, 0x4a, 0x4a, 0x51, 0xb1, 0x04, 0x93, 0x02, 0xb3, 0x06, 0xb7, 0x91, 0xb2, 0x1e,
-	0xdc, 0x76, 0x3d, 0x54, 0xa3, 0xc0, 0x5c, 0xd7, 0xbc, 0x92, 0xa2, 0xca, 0x20, 0x88, 0x0e, 0xa9,
-	0x08, 0x2e, 0x4e, 0xb8, 0x98, 0x90, 0x22, 0x17, 0x0b, 0x48, 0x14, 0x6a, 0x15, 0xef, 0xad, 0x7b,
-	0xf2, 0x9c, 0x60, 0xab, 0x40, 0x2a, 0x82, 0xc0, 0x52, 0x42, 0x62, 0x5c, 0x6c, 0xa9, 0x15, 0x05,
-	0x99, 0x45, 0x95, 0x12, 0x4c, 0x0a, 0x8c, 0x1a, 0xcc, 0x41, 0x50, 0x9e, 0x90, 0x00, 0x17, 0x73,
-	0x49, 0x49, 0x8e, 0x04, 0x33, 0x58, 0x10, 0xc4, 0x74, 0x52, 0xf8, 0xf1, 0x50, 0x8e, 0xf1, 0xc0,
-	0x23, 0x39, 0xc6, 0x13, 0x8f, 0xe4, 0x18, 0x2f, 0x3c, 0x92, 0x63, 0x7c, 0xf0, 0x48, 0x8e, 0x71,
-	0xc2, 0x63, 0x39, 0x86, 0x0b, 0x8f, 0xe5, 0x18, 0x6e, 0x3c, 0x96, 0x63, 0x48, 0x62, 0x03, 0xfb,
-	0xd8, 0x18, 0x10, 0x00, 0x00, 0xff, 0xff, 0xb1, 0x1a, 0x16, 0x43, 0x3b, 0x01, 0x00, 0x00,
+	// 372 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x91, 0xc1, 0xce, 0xd2, 0x40,
+	0x10, 0xc7, 0xd9, 0x96, 0x0f, 0x61, 0x29, 0x82, 0x1b, 0x63, 0x36, 0x3d, 0x2c, 0x15, 0x2e, 0xc4,
+	0xc4, 0x92, 0xe8, 0xc9, 0xa3, 0x88, 0x26, 0xde, 0x48, 0x3d, 0x78, 0x24, 0x6d, 0x77, 0xc1, 0x8d,
+	0x95, 0xad, 0xbb, 0x5b, 0x23, 0x6f, 0xe1, 0x23, 0x79, 0x34, 0x9e, 0x38, 0x1a, 0x4c, 0x88, 0x96,
+	0x97, 0xf0, 0x68, 0x3a, 0xad, 0x4d, 0x3c, 0x7c, 0xb7, 0xf9, 0xfd, 0xe6, 0x3f, 0x9d, 0x4e, 0x8b,
+	0xbd, 0xdc, 0x58, 0xa5, 0x45, 0x98, 0x6b, 0x65, 0x15, 0x19, 0xfc, 0xa3, 0xc4, 0x7f, 0xbc, 0x97,
+	0xf6, 0x5d, 0x91, 0x84, 0xa9, 0xfa, 0xb0, 0xdc, 0xab, 0xbd, 0x5a, 0x42, 0x22, 0x29, 0x76, 0x40,
+	0x00, 0x50, 0xd5, 0x93, 0xb3, 0xef, 0x0e, 0xbe, 0xfb, 0x9c, 0x73, 0xbd, 0x52, 0xea, 0x7d, 0x24,
+	0x52, 0xa5, 0x39, 0x99, 0x62, 0x47, 0x72, 0x8a, 0x02, 0xb4, 0xf0, 0x56, 0xe3, 0xf3, 0x65, 0x3a,
+	0xdc, 0x54, 0xc9, 0x8d, 0x10, 0xfa, 0xf5, 0x3a, 0x72, 0x24, 0x27, 0xcf, 0xf0, 0x4d, 0xcc, 0xb9,
+	0x36, 0xd4, 0x09, 0xdc, 0xc5, 0xf0, 0xc9, 0x3c, 0x6c, 0xb7, 0x87, 0xff, 0x3f, 0x0a, 0xf0, 0xe5,
+	0xc1, 0xea, 0x63, 0x54, 0x4f, 0xf8, 0x3f, 0x11, 0x1e, 0xb4, 0x92, 0x3c, 0xc4, 0xdd, 0x4a, 0x37,
+	0xbb, 0x46, 0xe7, 0xcb, 0x74, 0x00, 0xbb, 0xaa, 0x44, 0x04, 0x2d, 0xf2, 0x00, 0xf7, 0xc4, 0xe7,
+	0x5c, 0xea, 0x23, 0x75, 0x02, 0xb4, 0x70, 0xa3, 0x86, 0xc8, 0x04, 0xbb, 0xd6, 0x66, 0xd4, 0x05,
+	0x59, 0x95, 0xc4, 0xc7, 0xfd, 0x5c, 0x4b, 0xa5, 0xa5, 0x3d, 0xd2, 0x2e, 0xe8, 0x96, 0xc9, 0x7d,
+	0x78, 0x63, 0xc1, 0xe9, 0x0d, 0x34, 0x6a, 0x20, 0x8f, 0xf0, 0xbd, 0x2c, 0x36, 0x76, 0xcb, 0x65,
+	0x9c, 0x6d, 0x4d, 0x91, 0xa6, 0xc2, 0x18, 0xda, 0x83, 0xc4, 0xb8, 0x6a, 0xac, 0x65, 0x9c, 0xbd,
+	0xa9, 0x35, 0x99, 0xe3, 0x11, 0xc4, 0x76, 0xb1, 0xcc, 0x0a, 0x2d, 0x0c, 0xbd, 0x03, 0x39, 0xaf,
+	0x92, 0xaf, 0x1a, 0x37, 0x7b, 0x8b, 0xc7, 0x2f, 0x84, 0xb6, 0x72, 0x27, 0x05, 0x6f, 0x3e, 0xe6,
+	0x04, 0xbb, 0x46, 0x7c, 0x84, 0x0b, 0xbb, 0x51, 0x55, 0xde, 0x7a, 0x91, 0x8f, 0xfb, 0xe2, 0xf0,
+	0x49, 0x64, 0x2a, 0x17, 0x70, 0x96, 0x17, 0xb5, 0xbc, 0x0a, 0xfe, 0xfc, 0x66, 0xe8, 0x6b, 0xc9,
+	0xd0, 0xb7, 0x92, 0xa1, 0x53, 0xc9, 0xd0, 0xaf, 0x92, 0xa1, 0x2f, 0x57, 0xd6, 0x39, 0x5d, 0x59,
+	0xe7, 0xc7, 0x95, 0x75, 0x92, 0x1e, 0xfc, 0xce, 0xa7, 0x7f, 0x07, 0x00, 0x76, 0x4a, 0xa2, 0x94,
+	0x18, 0x02, 0x00, 0x00,
 }
 
 func (m *AddrBookRecord) Marshal() (dAtA []byte, err error) {
@@ -228,6 +337,60 @@ func (m *AddrBookRecord_AddrEntry) MarshalTo(dAtA []byte) (int, error) {
 		i++
 		i = encodeVarintPstore(dAtA, i, uint64(m.Ttl))
 	}
+	if m.Priority != 0 {
+		dAtA[i] = 0x20
+		i++
+		i = encodeVarintPstore(dAtA, i, uint64(m.Priority))
+	}
+	if m.Added != 0 {
+		dAtA[i] = 0x28
+		i++
+		i = encodeVarintPstore(dAtA, i, uint64(m.Added))
+	}
+	if m.LastDialSuccess != 0 {
+		dAtA[i] = 0x30
+		i++
+		i = encodeVarintPstore(dAtA, i, uint64(m.LastDialSuccess))
+	}
+	if m.DialFailures != 0 {
+		dAtA[i] = 0x38
+		i++
+		i = encodeVarintPstore(dAtA, i, uint64(m.DialFailures))
+	}
+	return i, nil
+}
+
+func (m *CertifiedRecord) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *CertifiedRecord) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if m.Seq != 0 {
+		dAtA[i] = 0x8
+		i++
+		i = encodeVarintPstore(dAtA, i, uint64(m.Seq))
+	}
+	if m.Expiry != 0 {
+		dAtA[i] = 0x10
+		i++
+		i = encodeVarintPstore(dAtA, i, uint64(m.Expiry))
+	}
+	if len(m.Envelope) > 0 {
+		dAtA[i] = 0x1a
+		i++
+		i = encodeVarintPstore(dAtA, i, uint64(len(m.Envelope)))
+		i += copy(dAtA[i:], m.Envelope)
+	}
 	return i, nil
 }
 
@@ -266,6 +429,39 @@ func NewPopulatedAddrBookRecord_AddrEntry(r randyPstore, easy bool) *AddrBookRec
 	if r.Intn(2) == 0 {
 		this.Ttl *= -1
 	}
+	this.Priority = int64(r.Int63())
+	if r.Intn(2) == 0 {
+		this.Priority *= -1
+	}
+	this.Added = int64(r.Int63())
+	if r.Intn(2) == 0 {
+		this.Added *= -1
+	}
+	this.LastDialSuccess = int64(r.Int63())
+	if r.Intn(2) == 0 {
+		this.LastDialSuccess *= -1
+	}
+	this.DialFailures = int64(r.Int63())
+	if r.Intn(2) == 0 {
+		this.DialFailures *= -1
+	}
+	if !easy && r.Intn(10) != 0 {
+	}
+	return this
+}
+
+func NewPopulatedCertifiedRecord(r randyPstore, easy bool) *CertifiedRecord {
+	this := &CertifiedRecord{}
+	this.Seq = uint64(uint64(r.Uint32()))
+	this.Expiry = int64(r.Int63())
+	if r.Intn(2) == 0 {
+		this.Expiry *= -1
+	}
+	v2 := r.Intn(100)
+	this.Envelope = make([]byte, v2)
+	for i := 0; i < v2; i++ {
+		this.Envelope[i] = byte(r.Intn(256))
+	}
 	if !easy && r.Intn(10) != 0 {
 	}
 	return this
@@ -290,9 +486,9 @@ func randUTF8RunePstore(r randyPstore) rune {
 	return rune(ru + 61)
 }
 func randStringPstore(r randyPstore) string {
-	v2 := r.Intn(100)
-	tmps := make([]rune, v2)
-	for i := 0; i < v2; i++ {
+	v3 := r.Intn(100)
+	tmps := make([]rune, v3)
+	for i := 0; i < v3; i++ {
 		tmps[i] = randUTF8RunePstore(r)
 	}
 	return string(tmps)
@@ -314,11 +510,11 @@ func randFieldPstore(dAtA []byte, r randyPstore, fieldNumber int, wire int) []by
 	switch wire {
 	case 0:
 		dAtA = encodeVarintPopulatePstore(dAtA, uint64(key))
-		v3 := r.Int63()
+		v4 := r.Int63()
 		if r.Intn(2) == 0 {
-			v3 *= -1
+			v4 *= -1
 		}
-		dAtA = encodeVarintPopulatePstore(dAtA, uint64(v3))
+		dAtA = encodeVarintPopulatePstore(dAtA, uint64(v4))
 	case 1:
 		dAtA = encodeVarintPopulatePstore(dAtA, uint64(key))
 		dAtA = append(dAtA, byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)))
@@ -378,6 +574,37 @@ func (m *AddrBookRecord_AddrEntry) Size() (n int) {
 	if m.Ttl != 0 {
 		n += 1 + sovPstore(uint64(m.Ttl))
 	}
+	if m.Priority != 0 {
+		n += 1 + sovPstore(uint64(m.Priority))
+	}
+	if m.Added != 0 {
+		n += 1 + sovPstore(uint64(m.Added))
+	}
+	if m.LastDialSuccess != 0 {
+		n += 1 + sovPstore(uint64(m.LastDialSuccess))
+	}
+	if m.DialFailures != 0 {
+		n += 1 + sovPstore(uint64(m.DialFailures))
+	}
+	return n
+}
+
+func (m *CertifiedRecord) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.Seq != 0 {
+		n += 1 + sovPstore(uint64(m.Seq))
+	}
+	if m.Expiry != 0 {
+		n += 1 + sovPstore(uint64(m.Expiry))
+	}
+	l = len(m.Envelope)
+	if l > 0 {
+		n += 1 + l + sovPstore(uint64(l))
+	}
 	return n
 }
 
@@ -618,6 +845,207 @@ func (m *AddrBookRecord_AddrEntry) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Priority", wireType)
+			}
+			m.Priority = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPstore
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Priority |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Added", wireType)
+			}
+			m.Added = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPstore
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Added |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field LastDialSuccess", wireType)
+			}
+			m.LastDialSuccess = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPstore
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.LastDialSuccess |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 7:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field DialFailures", wireType)
+			}
+			m.DialFailures = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPstore
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.DialFailures |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipPstore(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthPstore
+			}
+			if (iNdEx + skippy) < 0 {
+				return ErrInvalidLengthPstore
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *CertifiedRecord) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowPstore
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: CertifiedRecord: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: CertifiedRecord: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Seq", wireType)
+			}
+			m.Seq = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPstore
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Seq |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Expiry", wireType)
+			}
+			m.Expiry = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPstore
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Expiry |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Envelope", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPstore
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthPstore
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthPstore
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Envelope = append(m.Envelope[:0], dAtA[iNdEx:postIndex]...)
+			if m.Envelope == nil {
+				m.Envelope = []byte{}
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipPstore(dAtA[iNdEx:])
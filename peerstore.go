@@ -16,19 +16,33 @@ type peerstore struct {
 	KeyBook
 	AddrBook
 	PeerMetadata
-
-	// lock for protocol information, separate from datastore lock
-	protolock sync.Mutex
+	ProtoBook
 }
 
 // NewPeerstore creates a data structure that stores peer data, backed by the
-// supplied implementations of KeyBook, AddrBook and PeerMetadata.
+// supplied implementations of KeyBook, AddrBook and PeerMetadata. Supported
+// protocols are stored in PeerMetadata.
 func NewPeerstore(kb KeyBook, ab AddrBook, md PeerMetadata) Peerstore {
+	return NewPeerstoreWithProtoBook(kb, ab, md, &metadataProtoBook{md: md})
+}
+
+// NewPeerstoreWithProtoBook creates a data structure that stores peer data,
+// backed by the supplied implementations of KeyBook, AddrBook, PeerMetadata
+// and ProtoBook.
+func NewPeerstoreWithProtoBook(kb KeyBook, ab AddrBook, md PeerMetadata, pb ProtoBook) Peerstore {
+	return NewPeerstoreWithMetrics(kb, ab, md, pb, NewMetrics())
+}
+
+// NewPeerstoreWithMetrics creates a data structure that stores peer data,
+// backed by the supplied implementations of KeyBook, AddrBook, PeerMetadata,
+// ProtoBook and Metrics.
+func NewPeerstoreWithMetrics(kb KeyBook, ab AddrBook, md PeerMetadata, pb ProtoBook, m Metrics) Peerstore {
 	return &peerstore{
 		KeyBook:      kb,
 		AddrBook:     ab,
 		PeerMetadata: md,
-		Metrics:      NewMetrics(),
+		ProtoBook:    pb,
+		Metrics:      m,
 	}
 }
 
@@ -45,6 +59,7 @@ func (ps *peerstore) Close() (err error) {
 	weakClose("keybook", ps.KeyBook)
 	weakClose("addressbook", ps.AddrBook)
 	weakClose("peermetadata", ps.PeerMetadata)
+	weakClose("protobook", ps.ProtoBook)
 
 	if len(errs) > 0 {
 		return fmt.Errorf("failed while closing peerstore; err(s): %q", errs)
@@ -75,22 +90,31 @@ func (ps *peerstore) PeerInfo(p peer.ID) PeerInfo {
 	}
 }
 
-func (ps *peerstore) SetProtocols(p peer.ID, protos ...string) error {
-	ps.protolock.Lock()
-	defer ps.protolock.Unlock()
+// metadataProtoBook is the default ProtoBook, which stores the set of
+// protocols supported by a peer under a key in PeerMetadata.
+type metadataProtoBook struct {
+	md PeerMetadata
+
+	// lock for protocol information, separate from datastore lock
+	lk sync.Mutex
+}
+
+func (pb *metadataProtoBook) SetProtocols(p peer.ID, protos ...string) error {
+	pb.lk.Lock()
+	defer pb.lk.Unlock()
 
 	protomap := make(map[string]struct{})
 	for _, proto := range protos {
 		protomap[proto] = struct{}{}
 	}
 
-	return ps.Put(p, "protocols", protomap)
+	return pb.md.Put(p, "protocols", protomap)
 }
 
-func (ps *peerstore) AddProtocols(p peer.ID, protos ...string) error {
-	ps.protolock.Lock()
-	defer ps.protolock.Unlock()
-	protomap, err := ps.getProtocolMap(p)
+func (pb *metadataProtoBook) AddProtocols(p peer.ID, protos ...string) error {
+	pb.lk.Lock()
+	defer pb.lk.Unlock()
+	protomap, err := pb.getProtocolMap(p)
 	if err != nil {
 		return err
 	}
@@ -99,11 +123,11 @@ func (ps *peerstore) AddProtocols(p peer.ID, protos ...string) error {
 		protomap[proto] = struct{}{}
 	}
 
-	return ps.Put(p, "protocols", protomap)
+	return pb.md.Put(p, "protocols", protomap)
 }
 
-func (ps *peerstore) getProtocolMap(p peer.ID) (map[string]struct{}, error) {
-	iprotomap, err := ps.Get(p, "protocols")
+func (pb *metadataProtoBook) getProtocolMap(p peer.ID) (map[string]struct{}, error) {
+	iprotomap, err := pb.md.Get(p, "protocols")
 	switch err {
 	default:
 		return nil, err
@@ -119,10 +143,10 @@ func (ps *peerstore) getProtocolMap(p peer.ID) (map[string]struct{}, error) {
 	}
 }
 
-func (ps *peerstore) GetProtocols(p peer.ID) ([]string, error) {
-	ps.protolock.Lock()
-	defer ps.protolock.Unlock()
-	pmap, err := ps.getProtocolMap(p)
+func (pb *metadataProtoBook) GetProtocols(p peer.ID) ([]string, error) {
+	pb.lk.Lock()
+	defer pb.lk.Unlock()
+	pmap, err := pb.getProtocolMap(p)
 	if err != nil {
 		return nil, err
 	}
@@ -135,10 +159,10 @@ func (ps *peerstore) GetProtocols(p peer.ID) ([]string, error) {
 	return out, nil
 }
 
-func (ps *peerstore) SupportsProtocols(p peer.ID, protos ...string) ([]string, error) {
-	ps.protolock.Lock()
-	defer ps.protolock.Unlock()
-	pmap, err := ps.getProtocolMap(p)
+func (pb *metadataProtoBook) SupportsProtocols(p peer.ID, protos ...string) ([]string, error) {
+	pb.lk.Lock()
+	defer pb.lk.Unlock()
+	pmap, err := pb.getProtocolMap(p)
 	if err != nil {
 		return nil, err
 	}
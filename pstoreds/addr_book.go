@@ -1,10 +1,14 @@
 package pstoreds
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"math/rand"
 	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	ds "github.com/ipfs/go-datastore"
@@ -17,7 +21,6 @@ import (
 	pstoremem "github.com/libp2p/go-libp2p-peerstore/pstoremem"
 
 	lru "github.com/hashicorp/golang-lru"
-	b32 "github.com/multiformats/go-base32"
 	ma "github.com/multiformats/go-multiaddr"
 )
 
@@ -26,14 +29,33 @@ type ttlWriteMode int
 const (
 	ttlOverride ttlWriteMode = iota
 	ttlExtend
+	// like ttlOverride, but also removes the addresses held that were not provided.
+	ttlReplace
 )
 
+// reads of the addresses a stream starts with are attempted this many times, with a backoff doubling from
+// initialReadBackoff between attempts.
+const initialReadAttempts = 3
+
 var (
 	log = logging.Logger("peerstore/ds")
 
+	initialReadBackoff = 50 * time.Millisecond
+
 	// Peer addresses are stored db key pattern:
 	// /peers/addrs/<b32 peer id no padding>
 	addrBookBase = ds.NewKey("/peers/addrs")
+
+	numPeersQuery = query.Query{
+		Prefix:   addrBookBase.String(),
+		KeysOnly: true,
+	}
+
+	forEachQuery = query.Query{
+		Prefix:   addrBookBase.String(),
+		Orders:   []query.Order{query.OrderByKey{}},
+		KeysOnly: false,
+	}
 )
 
 // addrsRecord decorates the AddrBookRecord with locks and metadata.
@@ -41,36 +63,54 @@ type addrsRecord struct {
 	sync.RWMutex
 	*pb.AddrBookRecord
 	dirty bool
+
+	// the addresses of the record as returned by Addrs, shared by all callers when Options.SharedReads is set. It's
+	// reset whenever the record changes.
+	shared atomic.Value // *sharedAddrs
+
+	// when the record was read from the datastore; see Options.CacheTTL.
+	loadedAt time.Time
+
+	// the number of addresses of the record as of when it was last read or written, which weighs it in a cache
+	// bounded by addresses (see CacheByAddr). It's accessed atomically.
+	size int32
 }
 
-// flush writes the record to the datastore by calling ds.Put, unless the record is
-// marked for deletion, in which case we call ds.Delete. To be called within a lock.
-func (r *addrsRecord) flush(write ds.Write) (err error) {
-	key := addrBookBase.ChildString(b32.RawStdEncoding.EncodeToString([]byte(r.Id.ID)))
-	if len(r.Addrs) == 0 {
-		if err = write.Delete(key); err == nil {
-			r.dirty = false
+// storeTTL returns the time remaining until the last address of the record expires, relative to now (in unix
+// seconds). The second return value is false if the record holds permanent addresses, and never expires as a whole.
+func (r *addrsRecord) storeTTL(now int64) (time.Duration, bool) {
+	var last int64
+	for _, entry := range r.Addrs {
+		if time.Duration(entry.Ttl) == pstore.PermanentAddrTTL {
+			return 0, false
+		}
+		if entry.Expiry > last {
+			last = entry.Expiry
 		}
-		return err
 	}
+	return time.Duration(last-now) * time.Second, true
+}
 
-	data, err := r.Marshal()
-	if err != nil {
-		return err
-	}
-	if err = write.Put(key, data); err != nil {
-		return err
-	}
-	// write succeeded; record is no longer dirty.
-	r.dirty = false
-	return nil
+// live returns the entries of the record that haven't expired by now (in unix seconds). Expired entries are held in
+// the record during their grace period (see Options.ExpiryGracePeriod), and come first, as records are kept sorted
+// by expiration.
+func (r *addrsRecord) live(now int64) []*pb.AddrBookRecord_AddrEntry {
+	i := sort.Search(len(r.Addrs), func(i int) bool { return r.Addrs[i].Expiry > now })
+	return r.Addrs[i:]
+}
+
+// sharedAddrs are the addresses of a record shared by callers of Addrs, which remain valid until the soonest expiring
+// of them expires (in unix seconds).
+type sharedAddrs struct {
+	addrs []ma.Multiaddr
+	until int64
 }
 
-// clean is called on records to perform housekeeping. The return value indicates if the record was changed
-// as a result of this call.
+// clean is called on records to perform housekeeping. The first return value indicates if the record was changed
+// as a result of this call; the second one holds the entries that were dropped because they expired.
 //
 // clean does the following:
-// * sorts addresses by expiration (soonest expiring first).
+// * sorts addresses by expiration (soonest expiring first), and addresses expiring at the same time by their bytes.
 // * removes expired addresses.
 //
 // It short-circuits optimistically when there's nothing to do.
@@ -81,24 +121,30 @@ func (r *addrsRecord) flush(write ds.Write) (err error) {
 // * after an entry has been modified (e.g. addresses have been added or removed, TTLs updated, etc.)
 //
 // If the return value is true, the caller should perform a flush immediately to sync the record with the store.
-func (r *addrsRecord) clean() (chgd bool) {
-	now := time.Now().Unix()
+func (r *addrsRecord) clean(t time.Time) (chgd bool, expired []*pb.AddrBookRecord_AddrEntry) {
+	now := t.Unix()
 	if !r.dirty && len(r.Addrs) > 0 && r.Addrs[0].Expiry > now {
 		// record is not dirty, and we have no expired entries to purge.
-		return false
+		return false, nil
 	}
 
+	r.shared.Store((*sharedAddrs)(nil))
+
 	if len(r.Addrs) == 0 {
 		// this is a ghost record; let's signal it has to be written.
-		// flush() will take care of doing the deletion.
-		return true
+		// flushRecord() will take care of doing the deletion.
+		return true, nil
 	}
 
 	if r.dirty && len(r.Addrs) > 1 {
 		// the record has been modified, so it may need resorting.
-		// we keep addresses sorted by expiration, where 0 is the soonest expiring.
+		// we keep addresses sorted by expiration, where 0 is the soonest expiring. ties are broken by comparing
+		// the addresses, so that the order is deterministic.
 		sort.Slice(r.Addrs, func(i, j int) bool {
-			return r.Addrs[i].Expiry < r.Addrs[j].Expiry
+			if ei, ej := r.Addrs[i].Expiry, r.Addrs[j].Expiry; ei != ej {
+				return ei < ej
+			}
+			return bytes.Compare(r.Addrs[i].Addr.Bytes(), r.Addrs[j].Addr.Bytes()) < 0
 		})
 	}
 
@@ -112,8 +158,9 @@ func (r *addrsRecord) clean() (chgd bool) {
 		pivot = i
 	}
 
+	expired = r.Addrs[:pivot+1]
 	r.Addrs = r.Addrs[pivot+1:]
-	return r.dirty || pivot >= 0
+	return r.dirty || pivot >= 0, expired
 }
 
 // dsAddrBook is an address book backed by a Datastore with a GC procedure to purge expired entries. It uses an
@@ -122,48 +169,113 @@ type dsAddrBook struct {
 	ctx  context.Context
 	opts Options
 
-	cache       cache
+	cache       Cache
 	ds          ds.Batching
 	gc          *dsAddrBookGc
 	subsManager *pstoremem.AddrSubManager
+	metrics     MetricsCollector
+	clock       Clock
+	codec       Codec
+	keys        peerKeys
+	log         Logger
+
+	history  *addrHistory
+	onExpire *expiryNotifier
+
+	// whether records are stored with native TTLs; see flushRecord.
+	nativeTTL bool
+
+	// serializes accesses to signed peer records.
+	certifiedLk sync.Mutex
+
+	// serializes insertions in the cache, so that concurrent loads of the same record settle on a single instance.
+	cacheLk sync.Mutex
+
+	// datastore loads in flight, so that concurrent cache misses for the same peer share a single read.
+	loadsLk sync.Mutex
+	loads   map[peer.ID]*recordLoad
+
+	// tracks the writes in flight, so that Close can wait for them to complete.
+	inflightLk sync.Mutex
+	inflight   int
+	drained    chan struct{}
 
 	// controls children goroutine lifetime.
 	childrenDone sync.WaitGroup
 	cancelFn     func()
+
+	// guards Close, along with its result.
+	closeOnce sync.Once
+	closeErr  error
 }
 
 var _ pstore.AddrBook = (*dsAddrBook)(nil)
 
 // NewAddrBook initializes a new datastore-backed address book. It serves as a drop-in replacement for pstoremem
-// (memory-backed peerstore), and works with any datastore implementing the ds.Batching interface.
+// (memory-backed peerstore), and works with any datastore. Datastores implementing the ds.Batching interface are
+// used as-is; for all others, batches are emulated by applying the buffered operations one by one upon commit, which
+// is not atomic.
 //
 // Addresses and peer records are serialized into protobuf, storing one datastore entry per peer, along with metadata
 // to control address expiration. To alleviate disk access and serde overhead, we internally use a read/write-through
-// ARC cache, the size of which is adjustable via Options.CacheSize.
+// ARC cache, the size of which is adjustable via Options.CacheSize. A custom cache can be supplied via Options.Cache.
 //
 // The user has a choice of two GC algorithms:
 //
-//  - lookahead GC: minimises the amount of full store traversals by maintaining a time-indexed list of entries that
-//    need to be visited within the period specified in Options.GCLookaheadInterval. This is useful in scenarios with
-//    considerable TTL variance, coupled with datastores whose native iterators return entries in lexicographical key
-//    order. Enable this mode by passing a value Options.GCLookaheadInterval > 0. Lookahead windows are jumpy, not
-//    sliding. Purges operate exclusively over the lookahead window with periodicity Options.GCPurgeInterval.
+//   - lookahead GC: minimises the amount of full store traversals by maintaining a time-indexed list of entries that
+//     need to be visited within the period specified in Options.GCLookaheadInterval. This is useful in scenarios with
+//     considerable TTL variance, coupled with datastores whose native iterators return entries in lexicographical key
+//     order. Enable this mode by passing a value Options.GCLookaheadInterval > 0. Lookahead windows are jumpy, not
+//     sliding. Purges operate exclusively over the lookahead window with periodicity Options.GCPurgeInterval, or are
+//     timed to the next expiry in the window if Options.GCMinPurgeInterval is set.
 //
-//  - full-purge GC (default): performs a full visit of the store with periodicity Options.GCPurgeInterval. Useful when
-//    the range of possible TTL values is small and the values themselves are also extreme, e.g. 10 minutes or
-//    permanent, popular values used in other libp2p modules. In this cited case, optimizing with lookahead windows
-//    makes little sense.
-func NewAddrBook(ctx context.Context, store ds.Batching, opts Options) (ab *dsAddrBook, err error) {
+//   - full-purge GC (default): performs a full visit of the store with periodicity Options.GCPurgeInterval. Useful when
+//     the range of possible TTL values is small and the values themselves are also extreme, e.g. 10 minutes or
+//     permanent, popular values used in other libp2p modules. In this cited case, optimizing with lookahead windows
+//     makes little sense.
+//
+// If the datastore supports native TTLs (ds.TTLDatastore), records are stored with a TTL matching the expiry of their
+// last address, so the datastore expires them even if GC is disabled. Note that records expired by the datastore
+// are not announced on address expiry streams; GC must run for that to happen.
+func NewAddrBook(ctx context.Context, store ds.Datastore, opts Options) (ab *dsAddrBook, err error) {
+	if err = opts.validate(); err != nil {
+		return nil, err
+	}
+
 	ctx, cancelFn := context.WithCancel(ctx)
+	defer func() {
+		if err != nil {
+			cancelFn()
+		}
+	}()
+
+	logger := newLogger(opts)
 	ab = &dsAddrBook{
 		ctx:         ctx,
-		ds:          store,
+		ds:          namespaced(store, opts.Namespace, logger),
+		log:         logger,
 		opts:        opts,
 		cancelFn:    cancelFn,
-		subsManager: pstoremem.NewAddrSubManager(),
+		subsManager: opts.SubManager,
+		loads:       make(map[peer.ID]*recordLoad),
+	}
+	if opts.IndexAddrs {
+		if ab.ds, err = newIndexedStore(ab.ds); err != nil {
+			return nil, err
+		}
+	}
+	// the index doesn't support native TTLs, as it'd keep the entries of the records expired by the datastore.
+	_, ab.nativeTTL = ab.ds.(ds.TTL)
+
+	if ab.subsManager == nil {
+		ab.subsManager = pstoremem.NewAddrSubManagerWithBuffer(opts.AddrStreamBufferSize, opts.AddrStreamOverflow)
 	}
 
-	if opts.CacheSize > 0 {
+	if opts.Cache != nil {
+		ab.cache = opts.Cache
+	} else if opts.CacheSize > 0 && opts.CacheSizeMode == CacheByAddr {
+		ab.cache = newAddrCache(int(opts.CacheSize))
+	} else if opts.CacheSize > 0 {
 		if ab.cache, err = lru.NewARC(int(opts.CacheSize)); err != nil {
 			return nil, err
 		}
@@ -171,6 +283,30 @@ func NewAddrBook(ctx context.Context, store ds.Batching, opts Options) (ab *dsAd
 		ab.cache = new(noopCache)
 	}
 
+	if ab.metrics = opts.Metrics; ab.metrics == nil {
+		ab.metrics = new(noopMetrics)
+	}
+
+	if ab.clock = opts.Clock; ab.clock == nil {
+		ab.clock = realClock{}
+	}
+
+	if ab.codec = opts.Codec; ab.codec == nil {
+		ab.codec = ProtobufCodec
+	}
+
+	ab.keys = newPeerKeys(opts)
+
+	if opts.AddrHistorySize > 0 {
+		if ab.history, err = newAddrHistory(opts.AddrHistorySize, opts.AddrHistoryPeers, ab.clock); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.OnExpire != nil {
+		ab.onExpire = newExpiryNotifier(ab, opts.OnExpire, opts.OnExpireQueueSize)
+	}
+
 	if ab.gc, err = newAddressBookGc(ctx, ab); err != nil {
 		return nil, err
 	}
@@ -178,53 +314,238 @@ func NewAddrBook(ctx context.Context, store ds.Batching, opts Options) (ab *dsAd
 	return ab, nil
 }
 
+// Close stops GC and waits for the writes in flight to complete, for at most Options.CloseTimeout. It returns an error
+// if the timeout elapses first. Writes issued after Close is called are not waited for.
+//
+// Close is idempotent and safe for concurrent use: the address book is only closed once, and all calls wait for that
+// to complete, returning its result.
 func (ab *dsAddrBook) Close() error {
+	ab.closeOnce.Do(func() { ab.closeErr = ab.close() })
+	return ab.closeErr
+}
+
+// close implements Close.
+func (ab *dsAddrBook) close() error {
 	ab.cancelFn()
 	ab.childrenDone.Wait()
+
+	if err := ab.waitWrites(); err != nil {
+		return err
+	}
+
+	if ab.opts.FlushOnClose {
+		return ab.Flush()
+	}
 	return nil
 }
 
+// batchSize returns the number of operations after which cyclic batches are committed.
+func (ab *dsAddrBook) batchSize() int {
+	if ab.opts.MaxBatchSize > 0 {
+		return ab.opts.MaxBatchSize
+	}
+	return defaultOpsPerCyclicBatch
+}
+
+// beginWrite registers a write in flight. Every call must be paired with a call to endWrite.
+func (ab *dsAddrBook) beginWrite() {
+	ab.inflightLk.Lock()
+	ab.inflight++
+	ab.inflightLk.Unlock()
+}
+
+// endWrite unregisters a write in flight, releasing Close if it's waiting for the last one.
+func (ab *dsAddrBook) endWrite() {
+	ab.inflightLk.Lock()
+	defer ab.inflightLk.Unlock()
+
+	if ab.inflight--; ab.inflight == 0 && ab.drained != nil {
+		close(ab.drained)
+		ab.drained = nil
+	}
+}
+
+// waitWrites blocks until no writes are in flight, or Options.CloseTimeout elapses.
+func (ab *dsAddrBook) waitWrites() error {
+	ab.inflightLk.Lock()
+	if ab.inflight == 0 {
+		ab.inflightLk.Unlock()
+		return nil
+	}
+	if ab.drained == nil {
+		ab.drained = make(chan struct{})
+	}
+	drained := ab.drained
+	ab.inflightLk.Unlock()
+
+	var timeout <-chan time.Time
+	if ab.opts.CloseTimeout > 0 {
+		timeout = ab.clock.After(ab.opts.CloseTimeout)
+	}
+
+	select {
+	case <-drained:
+		return nil
+	case <-timeout:
+		return fmt.Errorf("timed out after %s waiting for in-flight writes to complete", ab.opts.CloseTimeout)
+	}
+}
+
+// Flush runs a full GC purge synchronously, deleting all expired addresses from the datastore right away rather than
+// waiting for the next scheduled cycle. If a GC cycle is in progress, Flush waits for it to finish first. It returns
+// an error if the datastore could not be traversed or the deletions could not be committed.
+func (ab *dsAddrBook) Flush() error {
+	return ab.gc.flush()
+}
+
+// GC reclaims space from leaked entries that regular GC cycles never visit or never delete: address records that
+// can't be decoded (e.g. written by an incompatible version) or that hold no addresses, GC lookahead entries that are
+// unparseable, older than a lookahead window, or left behind after lookahead was disabled, and index entries of
+// records that are gone (see Options.IndexAddrs). It also forgets the known peers that haven't held addresses for
+// Options.KnownPeersRetention, if set (see AddrsInfo). It returns the number of entries deleted. If a GC cycle is in
+// progress, GC waits for it to finish first.
+//
+// GC traverses the entire store, so it's meant to be run occasionally. It stops with the context's error if the
+// context is done before it completes.
+func (ab *dsAddrBook) GC(ctx context.Context) (removed int, err error) {
+	keys, err := ab.gc.compact(ctx, false)
+	return len(keys), err
+}
+
+// GCPreview returns the keys of the entries GC would delete, without deleting them; e.g. to review them before
+// running GC on a production store. Keys are relative to Options.Namespace. Like GC, it traverses the entire store.
+func (ab *dsAddrBook) GCPreview(ctx context.Context) ([]ds.Key, error) {
+	return ab.gc.compact(ctx, true)
+}
+
 // loadRecord is a read-through fetch. It fetches a record from cache, falling back to the
 // datastore upon a miss, and returning a newly initialized record if the peer doesn't exist.
 //
 // loadRecord calls clean() on an existing record before returning it. If the record changes
 // as a result and the update argument is true, the resulting state is saved in the datastore.
 //
-// If the cache argument is true, the record is inserted in the cache when loaded from the datastore.
+// Concurrent cache misses for the same peer share a single datastore read; see fetchRecord.
+//
+// If the cache argument is true, the record is inserted in the cache when loaded from the datastore. If another call
+// cached the same record in the meantime, that instance is returned instead, so that reads and writes racing on a
+// cache miss never end up operating on, or caching, diverging copies of the record.
 func (ab *dsAddrBook) loadRecord(id peer.ID, cache bool, update bool) (pr *addrsRecord, err error) {
 	if e, ok := ab.cache.Get(id); ok {
-		pr = e.(*addrsRecord)
-		pr.Lock()
-		defer pr.Unlock()
-
-		if pr.clean() && update {
-			err = pr.flush(ab.ds)
+		if pr = e.(*addrsRecord); !ab.stale(pr) {
+			ab.metrics.CacheHit()
+			return ab.cleanCached(pr, update)
 		}
+		// the record has outlived Options.CacheTTL; evict it, unless a concurrent load has replaced it already.
+		ab.cacheLk.Lock()
+		if e, ok := ab.cache.Peek(id); ok && e.(*addrsRecord) == pr {
+			ab.cache.Remove(id)
+		}
+		ab.cacheLk.Unlock()
+	}
+	ab.metrics.CacheMiss()
+
+	pr, loaded, err := ab.fetchRecord(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ab.cacheLk.Lock()
+	if e, ok := ab.cache.Peek(id); ok {
+		// the record was cached while we loaded it; ours may be stale.
+		ab.cacheLk.Unlock()
+		return ab.cleanCached(e.(*addrsRecord), update)
+	}
+	if cache {
+		ab.cache.Add(id, pr)
+	}
+	ab.cacheLk.Unlock()
+
+	if !loaded {
 		return pr, err
 	}
+	// the record was loaded from the datastore, and may hold expired addresses.
+	return ab.cleanCached(pr, update)
+}
+
+// recordLoad is a datastore load of a record in progress, shared by all callers that miss the cache concurrently for
+// the same peer.
+type recordLoad struct {
+	done   chan struct{}
+	pr     *addrsRecord
+	loaded bool
+	err    error
+}
+
+// fetchRecord reads and decodes the record of a peer from the datastore. Concurrent calls for the same peer share a
+// single datastore read, and all receive the same record instance. The loaded return value is false if the record
+// was not found in the datastore, or was corrupt and got deleted.
+func (ab *dsAddrBook) fetchRecord(id peer.ID) (*addrsRecord, bool, error) {
+	ab.loadsLk.Lock()
+	if l, ok := ab.loads[id]; ok {
+		ab.loadsLk.Unlock()
+		<-l.done
+		return l.pr, l.loaded, l.err
+	}
+	l := &recordLoad{done: make(chan struct{})}
+	ab.loads[id] = l
+	ab.loadsLk.Unlock()
+
+	l.pr, l.loaded, l.err = ab.readRecord(id)
+
+	ab.loadsLk.Lock()
+	delete(ab.loads, id)
+	ab.loadsLk.Unlock()
+	close(l.done)
+
+	return l.pr, l.loaded, l.err
+}
 
-	pr = &addrsRecord{AddrBookRecord: &pb.AddrBookRecord{}}
-	key := addrBookBase.ChildString(b32.RawStdEncoding.EncodeToString([]byte(id)))
+// readRecord reads and decodes the record of a peer from the datastore; see fetchRecord.
+func (ab *dsAddrBook) readRecord(id peer.ID) (*addrsRecord, bool, error) {
+	pr := &addrsRecord{AddrBookRecord: &pb.AddrBookRecord{}, loadedAt: ab.clock.Now()}
+	key := ab.keys.child(addrBookBase, id)
 	data, err := ab.ds.Get(key)
 
 	switch err {
 	case ds.ErrNotFound:
-		err = nil
 		pr.Id = &pb.ProtoPeerID{ID: id}
+		return pr, false, nil
 	case nil:
-		if err = pr.Unmarshal(data); err != nil {
-			return nil, err
+	default:
+		return nil, false, err
+	}
+
+	if err = ab.codec.Unmarshal(data, pr.AddrBookRecord); err != nil {
+		ab.metrics.CorruptRecord()
+		if !ab.opts.DeleteCorruptRecords {
+			return nil, false, fmt.Errorf("failed to decode stored record, err: %v", err)
 		}
-		// this record is new and local for now (not in cache), so we don't need to lock.
-		if pr.clean() && update {
-			err = pr.flush(ab.ds)
+		ab.log.Warningf("deleting undecodable record for peer %v, err: %v", id, err)
+		if err = ab.ds.Delete(key); err != nil {
+			return nil, false, err
 		}
-	default:
-		return nil, err
+		// carry on as if the record was never there.
+		pr.AddrBookRecord = &pb.AddrBookRecord{Id: &pb.ProtoPeerID{ID: id}}
+		return pr, false, nil
 	}
+	pr.size = int32(len(pr.Addrs))
+	return pr, true, nil
+}
 
-	if cache {
-		ab.cache.Add(id, pr)
+// stale returns whether a cached record has outlived Options.CacheTTL, and must be read again.
+func (ab *dsAddrBook) stale(pr *addrsRecord) bool {
+	return ab.opts.CacheTTL > 0 && ab.clock.Now().Sub(pr.loadedAt) >= ab.opts.CacheTTL
+}
+
+// cleanCached calls clean() on a cached record, and saves the resulting state in the datastore if it changed and the
+// update argument is true.
+func (ab *dsAddrBook) cleanCached(pr *addrsRecord, update bool) (*addrsRecord, error) {
+	pr.Lock()
+	defer pr.Unlock()
+
+	var err error
+	if ab.clean(pr) && update {
+		err = ab.flushRecord(ab.ds, pr)
 	}
 	return pr, err
 }
@@ -236,191 +557,1509 @@ func (ab *dsAddrBook) AddAddr(p peer.ID, addr ma.Multiaddr, ttl time.Duration) {
 
 // AddAddrs will add many new addresses if they're not already in the AddrBook.
 func (ab *dsAddrBook) AddAddrs(p peer.ID, addrs []ma.Multiaddr, ttl time.Duration) {
+	ab.beginWrite()
+	defer ab.endWrite()
+
 	if ttl <= 0 {
 		return
 	}
-	addrs = cleanAddrs(addrs)
-	ab.setAddrs(p, addrs, ttl, ttlExtend)
+	addrs = ab.cleanAddrs(addrs)
+	if err := ab.setAddrs(ab.ds, p, addrs, ttl, ttlExtend, nil); err != nil {
+		ab.log.Errorf("failed to add addrs for peer %s: %v", p.Pretty(), err)
+		ab.writeFailed(p, "AddAddrs", err)
+	}
 }
 
-// SetAddr will add or update the TTL of an address in the AddrBook.
-func (ab *dsAddrBook) SetAddr(p peer.ID, addr ma.Multiaddr, ttl time.Duration) {
-	ab.SetAddrs(p, []ma.Multiaddr{addr}, ttl)
+// AddAddrsMany adds addresses for many peers at once, with the same semantics as AddAddrs. All records are written
+// through a single datastore batch, which is committed once at the end; this considerably reduces commit overhead
+// when onboarding addresses for many peers (e.g. from a single DHT response). If Options.MaxBatchSize is set, the
+// batch is instead committed every time it fills up, so a failure may leave the addresses of some peers written.
+//
+// New-address events are broadcast only for addresses that weren't already known. If a commit fails, the records
+// touched by this call are evicted from the cache, so that subsequent reads reflect the state of the datastore.
+func (ab *dsAddrBook) AddAddrsMany(addrs map[peer.ID][]ma.Multiaddr, ttl time.Duration) error {
+	ab.beginWrite()
+	defer ab.endWrite()
+
+	if ttl <= 0 || len(addrs) == 0 {
+		return nil
+	}
+
+	var (
+		batch ds.Batch
+		err   error
+	)
+	if ab.opts.MaxBatchSize > 0 {
+		batch, err = newCyclicBatch(ab.ds, ab.opts.MaxBatchSize)
+	} else {
+		batch, err = ab.ds.Batch()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create batch while adding addrs for many peers, err: %v", err)
+	}
+
+	evict := func() {
+		for p := range addrs {
+			ab.cache.Remove(p)
+		}
+	}
+
+	for p, as := range addrs {
+		if err = ab.setAddrs(batch, p, ab.cleanAddrs(as), ttl, ttlExtend, nil); err != nil {
+			evict()
+			return err
+		}
+	}
+
+	if err = batch.Commit(); err != nil {
+		evict()
+		return fmt.Errorf("failed to commit batch while adding addrs for many peers, err: %v", err)
+	}
+	return nil
 }
 
-// SetAddrs will add or update the TTLs of addresses in the AddrBook.
-func (ab *dsAddrBook) SetAddrs(p peer.ID, addrs []ma.Multiaddr, ttl time.Duration) {
-	addrs = cleanAddrs(addrs)
+// PopulateFrom seeds the address book with the addresses held by another address book, e.g. to warm a fresh
+// datastore-backed peerstore from an in-memory one. Addresses are added with the provided TTL, with the same semantics
+// as AddAddrs, and records are written through batches of bounded size.
+//
+// Batches are committed as they fill up, so a failure may leave the addresses of some peers written. The records
+// touched by this call are then evicted from the cache, so that subsequent reads reflect the state of the datastore.
+func (ab *dsAddrBook) PopulateFrom(other pstore.AddrBook, ttl time.Duration) error {
+	ab.beginWrite()
+	defer ab.endWrite()
+
 	if ttl <= 0 {
-		ab.deleteAddrs(p, addrs)
-		return
+		return nil
 	}
-	ab.setAddrs(p, addrs, ttl, ttlOverride)
-}
 
-// UpdateAddrs will update any addresses for a given peer and TTL combination to
-// have a new TTL.
-func (ab *dsAddrBook) UpdateAddrs(p peer.ID, oldTTL time.Duration, newTTL time.Duration) {
-	pr, err := ab.loadRecord(p, true, false)
+	batch, err := newCyclicBatch(ab.ds, ab.batchSize())
 	if err != nil {
-		log.Errorf("failed to update ttls for peer %s: %s\n", p.Pretty(), err)
+		return fmt.Errorf("failed to create batch while populating addrs, err: %v", err)
 	}
 
-	pr.Lock()
-	defer pr.Unlock()
+	peers := other.PeersWithAddrs()
+	evict := func() {
+		for _, p := range peers {
+			ab.cache.Remove(p)
+		}
+	}
 
-	newExp := time.Now().Add(newTTL).Unix()
-	for _, entry := range pr.Addrs {
-		if entry.Ttl != int64(oldTTL) {
+	for _, p := range peers {
+		if err = p.Validate(); err != nil {
+			ab.log.Warningf("skipping peer while populating addrs, err: %v", err)
 			continue
 		}
-		entry.Ttl, entry.Expiry = int64(newTTL), newExp
-		pr.dirty = true
+		addrs := ab.cleanAddrs(other.Addrs(p))
+		if len(addrs) == 0 {
+			continue
+		}
+		if err = ab.setAddrs(batch, p, addrs, ttl, ttlExtend, nil); err != nil {
+			evict()
+			return err
+		}
 	}
 
-	if pr.clean() {
-		pr.flush(ab.ds)
+	if err = batch.Commit(); err != nil {
+		evict()
+		return fmt.Errorf("failed to commit batch while populating addrs, err: %v", err)
 	}
+	return nil
 }
 
-// Addrs returns all of the non-expired addresses for a given peer.
-func (ab *dsAddrBook) Addrs(p peer.ID) []ma.Multiaddr {
-	pr, err := ab.loadRecord(p, true, true)
-	if err != nil {
-		log.Warning("failed to load peerstore entry for peer %v while querying addrs, err: %v", p, err)
-		return nil
+// AddAddrsWithPriority adds addresses like AddAddrs, and sets their dial priority. Addresses with higher priorities
+// are returned first by Addrs and AddrsWithPriority. Addresses added through the other methods have priority 0,
+// unless they were already held with a different one.
+func (ab *dsAddrBook) AddAddrsWithPriority(p peer.ID, addrs []ma.Multiaddr, ttl time.Duration, priority int) {
+	ab.beginWrite()
+	defer ab.endWrite()
+
+	if ttl <= 0 {
+		return
+	}
+	prio := int64(priority)
+	addrs = ab.cleanAddrs(addrs)
+	if err := ab.setAddrs(ab.ds, p, addrs, ttl, ttlExtend, &prio); err != nil {
+		ab.log.Errorf("failed to add addrs for peer %s: %v", p.Pretty(), err)
+		ab.writeFailed(p, "AddAddrsWithPriority", err)
 	}
+}
 
-	pr.RLock()
-	defer pr.RUnlock()
+// AddAddrsWithTTLs adds addresses like AddAddrs, each one with its own TTL; e.g. to propagate the remaining lifetime
+// of addresses learned from another peer. Addresses with a TTL of zero or less are skipped. All addresses are merged
+// into the record of the peer at once, which is then written once, and the added addresses broadcast in a single
+// event. An error is returned if the slices differ in length, or the write fails.
+func (ab *dsAddrBook) AddAddrsWithTTLs(p peer.ID, addrs []ma.Multiaddr, ttls []time.Duration) error {
+	ab.beginWrite()
+	defer ab.endWrite()
 
-	addrs := make([]ma.Multiaddr, 0, len(pr.Addrs))
-	for _, a := range pr.Addrs {
-		addrs = append(addrs, a.Addr)
+	if len(addrs) != len(ttls) {
+		return fmt.Errorf("mismatched number of addrs and ttls provided: %d, %d", len(addrs), len(ttls))
 	}
-	return addrs
-}
 
-// Peers returns all of the peer IDs for which the AddrBook has addresses.
-func (ab *dsAddrBook) PeersWithAddrs() peer.IDSlice {
-	ids, err := uniquePeerIds(ab.ds, addrBookBase, func(result query.Result) string {
-		return ds.RawKey(result.Key).Name()
-	})
+	// group the addresses by TTL, as records are merged one TTL at a time.
+	var groups []ttlGroup
+	index := make(map[time.Duration]int)
+	for i, ttl := range ttls {
+		if ttl <= 0 {
+			continue
+		}
+		g, ok := index[ttl]
+		if !ok {
+			g = len(groups)
+			index[ttl] = g
+			groups = append(groups, ttlGroup{ttl: ttl})
+		}
+		groups[g].addrs = append(groups[g].addrs, addrs[i])
+	}
+	if len(groups) == 0 {
+		return nil
+	}
+	for i := range groups {
+		groups[i].addrs = ab.cleanAddrs(groups[i].addrs)
+	}
+
+	if err := p.Validate(); err != nil {
+		return fmt.Errorf("refusing to add addrs, err: %v", err)
+	}
+	pr, err := ab.loadRecord(p, true, false)
 	if err != nil {
-		log.Errorf("error while retrieving peers with addresses: %v", err)
+		return fmt.Errorf("failed to load peerstore entry for peer %v while adding addrs, err: %v", p, err)
 	}
-	return ids
+	if err = ab.mergeAddrGroups(ab.ds, pr, groups, ttlExtend, nil); err != nil {
+		ab.cache.Remove(p)
+		return fmt.Errorf("failed to add addrs for peer %v, err: %v", p, err)
+	}
+	return nil
 }
 
-// AddrStream returns a channel on which all new addresses discovered for a
-// given peer ID will be published.
-func (ab *dsAddrBook) AddrStream(ctx context.Context, p peer.ID) <-chan ma.Multiaddr {
-	initial := ab.Addrs(p)
-	return ab.subsManager.AddrStream(ctx, p, initial)
+// SetAddr will add or update the TTL of an address in the AddrBook.
+func (ab *dsAddrBook) SetAddr(p peer.ID, addr ma.Multiaddr, ttl time.Duration) {
+	ab.SetAddrs(p, []ma.Multiaddr{addr}, ttl)
 }
 
-// ClearAddrs will delete all known addresses for a peer ID.
-func (ab *dsAddrBook) ClearAddrs(p peer.ID) {
-	ab.cache.Remove(p)
+// SetAddrs will add or update the TTLs of addresses in the AddrBook.
+func (ab *dsAddrBook) SetAddrs(p peer.ID, addrs []ma.Multiaddr, ttl time.Duration) {
+	ab.beginWrite()
+	defer ab.endWrite()
 
-	key := addrBookBase.ChildString(b32.RawStdEncoding.EncodeToString([]byte(p)))
-	if err := ab.ds.Delete(key); err != nil {
-		log.Errorf("failed to clear addresses for peer %s: %v", p.Pretty(), err)
+	addrs = ab.cleanAddrs(addrs)
+	if ttl <= 0 {
+		if err := ab.deleteAddrs(p, addrs); err != nil {
+			ab.log.Errorf("failed to delete addrs for peer %s: %v", p.Pretty(), err)
+			ab.writeFailed(p, "SetAddrs", err)
+		}
+		return
 	}
+	if err := ab.setAddrs(ab.ds, p, addrs, ttl, ttlOverride, nil); err != nil {
+		ab.log.Errorf("failed to set addrs for peer %s: %v", p.Pretty(), err)
+		ab.writeFailed(p, "SetAddrs", err)
+	}
+}
+
+// ReplaceAddrs makes the provided addresses the only ones held for a peer, all with the given TTL: addresses not held
+// are added, TTLs of those held are overridden, and those held but not provided are removed. The changes are applied
+// in a single write, so readers never observe the peer with a partial set of addresses. New addresses are broadcast to
+// address streams, and removed ones to expiry streams. A TTL of 0 or lower removes all addresses.
+func (ab *dsAddrBook) ReplaceAddrs(p peer.ID, addrs []ma.Multiaddr, ttl time.Duration) error {
+	ab.beginWrite()
+	defer ab.endWrite()
+
+	if ttl <= 0 {
+		addrs = nil
+	}
+	return ab.setAddrs(ab.ds, p, ab.cleanAddrs(addrs), ttl, ttlReplace, nil)
 }
 
-func (ab *dsAddrBook) setAddrs(p peer.ID, addrs []ma.Multiaddr, ttl time.Duration, mode ttlWriteMode) (err error) {
+// UpdateAddrs will update any addresses for a given peer and TTL combination to
+// have a new TTL. The peer's record is read through from the datastore if it's not
+// cached, so addresses persisted by a previous run are updated too.
+func (ab *dsAddrBook) UpdateAddrs(p peer.ID, oldTTL time.Duration, newTTL time.Duration) {
+	ab.beginWrite()
+	defer ab.endWrite()
+
 	pr, err := ab.loadRecord(p, true, false)
 	if err != nil {
-		return fmt.Errorf("failed to load peerstore entry for peer %v while setting addrs, err: %v", p, err)
+		ab.log.Errorf("failed to update ttls for peer %s: %s\n", p.Pretty(), err)
+		ab.writeFailed(p, "UpdateAddrs", err)
+		return
 	}
 
-	pr.Lock()
-	defer pr.Unlock()
-
-	newExp := time.Now().Add(ttl).Unix()
-	existed := make([]bool, len(addrs)) // keeps track of which addrs we found.
+	// addresses were stored with clamped TTLs, so we match against the clamped value.
+	oldTTL, newTTL = ab.clampTTL(oldTTL), ab.clampTTL(newTTL)
 
-Outer:
-	for i, incoming := range addrs {
-		for _, have := range pr.Addrs {
-			if incoming.Equal(have.Addr) {
-				existed[i] = true
-				if mode == ttlExtend && have.Expiry > newExp {
-					// if we're only extending TTLs but the addr already has a longer one, we skip it.
-					continue Outer
-				}
-				have.Expiry = newExp
-				// we found the address, and addresses cannot be duplicate,
-				// so let's move on to the next.
-				continue Outer
-			}
-		}
-	}
+	pr.Lock()
 
-	// add addresses we didn't hold.
-	var added []*pb.AddrBookRecord_AddrEntry
-	for i, e := range existed {
-		if e {
+	newExp := ab.expiry(newTTL)
+	for _, entry := range pr.live(ab.clock.Now().Unix()) {
+		if entry.Ttl != int64(oldTTL) {
 			continue
 		}
-		addr := addrs[i]
-		entry := &pb.AddrBookRecord_AddrEntry{
-			Addr:   &pb.ProtoAddr{Multiaddr: addr},
-			Ttl:    int64(ttl),
-			Expiry: newExp,
+		if ab.opts.TTLJitter > 0 {
+			newExp = ab.expiry(newTTL)
 		}
-		added = append(added, entry)
-		// note: there's a minor chance that writing the record will fail, in which case we would've broadcast
-		// the addresses without persisting them. This is very unlikely and not much of an issue.
-		ab.subsManager.BroadcastAddr(p, addr)
+		entry.Ttl, entry.Expiry = int64(newTTL), newExp
+		pr.dirty = true
 	}
 
-	pr.Addrs = append(pr.Addrs, added...)
-	pr.dirty = true
-	pr.clean()
-	return pr.flush(ab.ds)
-}
+	if ab.clean(pr) {
+		err = ab.flushRecord(ab.ds, pr)
+	}
+	pr.Unlock()
 
-func (ab *dsAddrBook) deleteAddrs(p peer.ID, addrs []ma.Multiaddr) (err error) {
-	pr, err := ab.loadRecord(p, false, false)
 	if err != nil {
-		return fmt.Errorf("failed to load peerstore entry for peer %v while deleting addrs, err: %v", p, err)
+		ab.log.Errorf("failed to save updated ttls for peer %s: %s\n", p.Pretty(), err)
+		ab.writeFailed(p, "UpdateAddrs", err)
 	}
+}
 
-	if pr.Addrs == nil {
-		return nil
+// SetAddrTTL updates the TTL of a single address of a peer, leaving the peer's other addresses untouched. Unlike
+// SetAddr, it does nothing if the address is not held for the peer. A TTL of zero or less expires the address.
+func (ab *dsAddrBook) SetAddrTTL(p peer.ID, addr ma.Multiaddr, newTTL time.Duration) {
+	ab.beginWrite()
+	defer ab.endWrite()
+
+	pr, err := ab.loadRecord(p, true, false)
+	if err != nil {
+		ab.log.Errorf("failed to update ttl for peer %s: %s\n", p.Pretty(), err)
+		ab.writeFailed(p, "SetAddrTTL", err)
+		return
 	}
 
+	newTTL = ab.clampTTL(ab.resolveTTL(p, newTTL))
+
 	pr.Lock()
-	defer pr.Unlock()
+
+	now := ab.clock.Now().Unix()
+	exp := now
+	if newTTL > 0 {
+		exp = ab.expiry(newTTL)
+	}
+	// addresses in their grace period are as good as gone, and aren't revived.
+	for _, entry := range pr.live(now) {
+		if entry.Addr.Equal(addr) {
+			entry.Ttl, entry.Expiry = int64(newTTL), exp
+			pr.dirty = true
+			break
+		}
+	}
+
+	if ab.clean(pr) {
+		err = ab.flushRecord(ab.ds, pr)
+	}
+	pr.Unlock()
+
+	if err != nil {
+		ab.log.Errorf("failed to save updated ttl for peer %s: %s\n", p.Pretty(), err)
+		ab.writeFailed(p, "SetAddrTTL", err)
+	}
+}
+
+// Touch extends the lifetime of all addresses held for a peer to the given TTL, e.g. after a successful connection
+// proves them useful, without the caller having to know them. Addresses set to expire later are left untouched, so
+// lifetimes are only ever extended.
+func (ab *dsAddrBook) Touch(p peer.ID, ttl time.Duration) {
+	ab.beginWrite()
+	defer ab.endWrite()
+
+	if ttl <= 0 {
+		return
+	}
+
+	pr, err := ab.loadRecord(p, true, false)
+	if err != nil {
+		ab.log.Errorf("failed to touch addrs for peer %s: %s\n", p.Pretty(), err)
+		ab.writeFailed(p, "Touch", err)
+		return
+	}
+
+	ttl = ab.clampTTL(ab.resolveTTL(p, ttl))
+
+	pr.Lock()
+
+	for _, entry := range pr.live(ab.clock.Now().Unix()) {
+		if exp := ab.expiry(ttl); entry.Expiry < exp {
+			entry.Ttl, entry.Expiry = int64(ttl), exp
+			pr.dirty = true
+		}
+	}
+
+	if ab.clean(pr) {
+		err = ab.flushRecord(ab.ds, pr)
+	}
+	pr.Unlock()
+
+	if err != nil {
+		ab.log.Errorf("failed to save touched addrs for peer %s: %s\n", p.Pretty(), err)
+		ab.writeFailed(p, "Touch", err)
+	}
+}
+
+// PrioritizedAddr is an address along with its dial priority.
+type PrioritizedAddr struct {
+	Addr     ma.Multiaddr
+	Priority int
+}
+
+// Addrs returns all of the non-expired addresses for a given peer, sorted by descending priority. Addresses with the
+// same priority are sorted by expiration, soonest first, and then by their bytes, so the same set of addresses is
+// always returned in the same order, regardless of the backing datastore.
+//
+// If Options.SharedReads is set, the same slice is returned to all callers until the addresses of the peer change, so
+// it must not be modified.
+func (ab *dsAddrBook) Addrs(p peer.ID) []ma.Multiaddr {
+	if !ab.opts.SharedReads {
+		return ab.AddrsFiltered(p, nil)
+	}
+
+	pr, err := ab.loadRecord(p, true, true)
+	if err != nil {
+		ab.log.Warningf("failed to load peerstore entry for peer %v while querying addrs, err: %v", p, err)
+		return nil
+	}
+	now := ab.clock.Now().Unix()
+	if s, _ := pr.shared.Load().(*sharedAddrs); s != nil && now < s.until {
+		return s.addrs
+	}
+
+	// the slice is computed and stored under the lock, so that it can't miss a concurrent change. Concurrent callers
+	// may compute it at the same time; they all compute the same one.
+	pr.RLock()
+	defer pr.RUnlock()
+
+	live := pr.live(now)
+	prioritized := prioritizedLocked(live, nil)
+	addrs := make([]ma.Multiaddr, len(prioritized))
+	for i, a := range prioritized {
+		addrs[i] = a.Addr
+	}
+	if len(live) > 0 {
+		pr.shared.Store(&sharedAddrs{addrs: addrs, until: live[0].Expiry})
+	}
+	return addrs
+}
+
+// AddrsFiltered returns the non-expired addresses for a given peer that satisfy the filter, e.g. those dialable by a
+// particular transport. The filter is applied while iterating the peer's record, whether it's served from the cache
+// or the datastore, so no slice holding the full set is allocated. A nil filter matches all addresses.
+func (ab *dsAddrBook) AddrsFiltered(p peer.ID, filter func(ma.Multiaddr) bool) []ma.Multiaddr {
+	var keep func(*pb.AddrBookRecord_AddrEntry) bool
+	if filter != nil {
+		keep = func(e *pb.AddrBookRecord_AddrEntry) bool { return filter(e.Addr) }
+	}
+	addrs, err := ab.addrs(context.Background(), p, keep)
+	if err != nil {
+		ab.log.Warningf("failed to load peerstore entry for peer %v while querying addrs, err: %v", p, err)
+	}
+	return addrs
+}
+
+// AddrsSortedByExpiry returns the non-expired addresses for a given peer sorted by expiration, soonest expiring first
+// if ascending is true, and latest expiring first otherwise. Addresses expiring at the same time are ordered by their
+// bytes. Priorities are disregarded.
+func (ab *dsAddrBook) AddrsSortedByExpiry(p peer.ID, ascending bool) []ma.Multiaddr {
+	pr, err := ab.loadRecord(p, true, true)
+	if err != nil {
+		ab.log.Warningf("failed to load peerstore entry for peer %v while querying addrs, err: %v", p, err)
+		return nil
+	}
+
+	pr.RLock()
+	defer pr.RUnlock()
+
+	// records are kept sorted by ascending expiration.
+	live := pr.live(ab.clock.Now().Unix())
+	addrs := make([]ma.Multiaddr, len(live))
+	for i, entry := range live {
+		if ascending {
+			addrs[i] = entry.Addr
+		} else {
+			addrs[len(addrs)-1-i] = entry.Addr
+		}
+	}
+	return addrs
+}
+
+// CacheStats returns the number of records in the cache, and the peers they belong to. It's meant for debugging, and
+// doesn't affect the recency of cached records.
+func (ab *dsAddrBook) CacheStats() (size int, keys []peer.ID) {
+	for _, k := range ab.cache.Keys() {
+		if p, ok := k.(peer.ID); ok {
+			keys = append(keys, p)
+		}
+	}
+	return len(keys), keys
+}
+
+// CachedAddrs returns a copy of the addresses held in the cached record of a peer, as they are, i.e. including
+// addresses that have expired but haven't been cleaned up yet. The second return value is false if the peer's record
+// isn't cached. Unlike Addrs, it never falls through to the datastore, nor affects the recency of the record. It's
+// meant for debugging.
+func (ab *dsAddrBook) CachedAddrs(p peer.ID) ([]ma.Multiaddr, bool) {
+	e, ok := ab.cache.Peek(p)
+	if !ok {
+		return nil, false
+	}
+
+	pr := e.(*addrsRecord)
+	pr.RLock()
+	defer pr.RUnlock()
+
+	addrs := make([]ma.Multiaddr, 0, len(pr.Addrs))
+	for _, entry := range pr.Addrs {
+		addrs = append(addrs, entry.Addr)
+	}
+	return addrs, true
+}
+
+// WarmCache loads the records of the provided peers into the cache, e.g. at startup for a set of peers that must be
+// served promptly, with at most concurrency datastore reads in flight (at least one). Records already cached are left
+// as they are. Peers with no record are cached as such, so looking them up doesn't hit the datastore either.
+//
+// Failures to load individual records are collected and returned once all peers have been visited. It stops with the
+// context's error if the context is done first.
+func (ab *dsAddrBook) WarmCache(ctx context.Context, peers []peer.ID, concurrency int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		wg    sync.WaitGroup
+		errLk sync.Mutex
+		errs  []error
+		work  = make(chan peer.ID)
+	)
+	for i := 0; i < concurrency && i < len(peers); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range work {
+				if _, err := ab.loadRecord(p, true, true); err != nil {
+					errLk.Lock()
+					errs = append(errs, fmt.Errorf("peer %v: %v", p, err))
+					errLk.Unlock()
+				}
+			}
+		}()
+	}
+
+	var err error
+Outer:
+	for _, p := range peers {
+		select {
+		case work <- p:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break Outer
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed while warming the cache; err(s): %q", errs)
+	}
+	return nil
+}
+
+// AddrsCtx is like Addrs, but gives up with the context's error if the context is done before the addresses are
+// loaded; a load in flight by then carries on in the background, and still caches the record. Unlike Addrs, it returns
+// an error if the peer's record could not be loaded.
+func (ab *dsAddrBook) AddrsCtx(ctx context.Context, p peer.ID) ([]ma.Multiaddr, error) {
+	return ab.addrs(ctx, p, nil)
+}
+
+// AddrsAddedSince returns the non-expired addresses for a given peer that were first added at or after the provided
+// point in time, sorted by descending priority. Re-adding an address, or changing its TTL, doesn't change the point in
+// time when it was first added.
+func (ab *dsAddrBook) AddrsAddedSince(p peer.ID, since time.Time) []ma.Multiaddr {
+	sinceUnix := since.Unix()
+	addrs, err := ab.addrs(context.Background(), p, func(e *pb.AddrBookRecord_AddrEntry) bool {
+		return e.Added >= sinceUnix
+	})
+	if err != nil {
+		ab.log.Warningf("failed to load peerstore entry for peer %v while querying addrs, err: %v", p, err)
+	}
+	return addrs
+}
+
+// addrs returns the non-expired addresses for a given peer whose entries satisfy the filter, if any.
+func (ab *dsAddrBook) addrs(ctx context.Context, p peer.ID,
+	filter func(*pb.AddrBookRecord_AddrEntry) bool) ([]ma.Multiaddr, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	pr, err := ab.loadRecordCtx(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	prioritized := ab.prioritized(pr, filter)
+	addrs := make([]ma.Multiaddr, 0, len(prioritized))
+	for _, a := range prioritized {
+		addrs = append(addrs, a.Addr)
+	}
+	return addrs, nil
+}
+
+// loadRecordCtx loads and caches the record of a peer, racing the load against the context, as described in AddrsCtx.
+func (ab *dsAddrBook) loadRecordCtx(ctx context.Context, p peer.ID) (*addrsRecord, error) {
+	if ctx.Done() == nil {
+		// the context can't be cancelled; there's nothing to race against.
+		return ab.loadRecord(p, true, true)
+	}
+
+	type loaded struct {
+		pr  *addrsRecord
+		err error
+	}
+	ch := make(chan loaded, 1)
+	go func() {
+		pr, err := ab.loadRecord(p, true, true)
+		ch <- loaded{pr, err}
+	}()
+
+	select {
+	case l := <-ch:
+		return l.pr, l.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// AddrsWithPriority returns all of the non-expired addresses for a given peer along with their priorities, sorted by
+// descending priority.
+func (ab *dsAddrBook) AddrsWithPriority(p peer.ID) []PrioritizedAddr {
+	pr, err := ab.loadRecord(p, true, true)
+	if err != nil {
+		ab.log.Warningf("failed to load peerstore entry for peer %v while querying addrs, err: %v", p, err)
+		return nil
+	}
+
+	return ab.prioritized(pr, nil)
+}
+
+// prioritized returns the addresses of a record whose entries satisfy the filter, if any, sorted by descending
+// priority. Addresses with the same priority keep their relative order, i.e. soonest expiring first, so the order is
+// deterministic.
+func (ab *dsAddrBook) prioritized(pr *addrsRecord, filter func(*pb.AddrBookRecord_AddrEntry) bool) []PrioritizedAddr {
+	pr.RLock()
+	defer pr.RUnlock()
+
+	return prioritizedLocked(pr.live(ab.clock.Now().Unix()), filter)
+}
+
+// prioritizedLocked is like prioritized, for callers holding the lock of the record the entries belong to.
+func prioritizedLocked(entries []*pb.AddrBookRecord_AddrEntry,
+	filter func(*pb.AddrBookRecord_AddrEntry) bool) []PrioritizedAddr {
+	addrs := make([]PrioritizedAddr, 0, len(entries))
+	sorted := true
+	for _, e := range entries {
+		if filter != nil && !filter(e) {
+			continue
+		}
+		if len(addrs) > 0 && int64(addrs[len(addrs)-1].Priority) < e.Priority {
+			sorted = false
+		}
+		addrs = append(addrs, PrioritizedAddr{Addr: e.Addr, Priority: int(e.Priority)})
+	}
+	if !sorted {
+		sort.SliceStable(addrs, func(i, j int) bool {
+			return addrs[i].Priority > addrs[j].Priority
+		})
+	}
+	return addrs
+}
+
+// GetTTL returns the TTL an address of a peer was last set with, along with the point in time when it expires. If the
+// address is not held for the peer (or it has expired), found is false.
+func (ab *dsAddrBook) GetTTL(p peer.ID, addr ma.Multiaddr) (ttl time.Duration, expiresAt time.Time, found bool) {
+	pr, err := ab.loadRecord(p, true, true)
+	if err != nil {
+		ab.log.Warningf("failed to load peerstore entry for peer %v while querying ttl, err: %v", p, err)
+		return 0, time.Time{}, false
+	}
+
+	pr.RLock()
+	defer pr.RUnlock()
+
+	for _, entry := range pr.live(ab.clock.Now().Unix()) {
+		if entry.Addr.Equal(addr) {
+			return time.Duration(entry.Ttl), time.Unix(entry.Expiry, 0), true
+		}
+	}
+	return 0, time.Time{}, false
+}
+
+// Has returns whether a non-expired address is held for a peer. It is cheaper than Addrs, as it doesn't allocate the
+// full set of addresses.
+func (ab *dsAddrBook) Has(p peer.ID, addr ma.Multiaddr) bool {
+	_, _, found := ab.GetTTL(p, addr)
+	return found
+}
+
+// NumAddrs returns the number of non-expired addresses held for a peer, without allocating them.
+func (ab *dsAddrBook) NumAddrs(p peer.ID) int {
+	pr, err := ab.loadRecord(p, true, true)
+	if err != nil {
+		ab.log.Warningf("failed to load peerstore entry for peer %v while counting addrs, err: %v", p, err)
+		return 0
+	}
+
+	pr.RLock()
+	defer pr.RUnlock()
+
+	return len(pr.live(ab.clock.Now().Unix()))
+}
+
+// NumPeers returns the number of peers for which the AddrBook has addresses. It runs a keys-only query, so no records
+// are deserialized. Unlike PeersWithAddrs, it may count peers whose addresses have all expired but haven't been
+// garbage collected yet.
+func (ab *dsAddrBook) NumPeers() int {
+	results, err := ab.ds.Query(numPeersQuery)
+	if err != nil {
+		ab.log.Errorf("error while counting peers with addresses: %v", err)
+		return 0
+	}
+	defer results.Close()
+
+	n := 0
+	for result := range results.Next() {
+		if result.Error != nil {
+			ab.log.Errorf("error while counting peers with addresses: %v", result.Error)
+			return n
+		}
+		n++
+	}
+	return n
+}
+
+// Peers returns all of the peer IDs for which the AddrBook has non-expired addresses.
+func (ab *dsAddrBook) PeersWithAddrs() peer.IDSlice {
+	ids, err := ab.PeersWithAddrsCtx(context.Background())
+	if err != nil {
+		ab.log.Errorf("error while retrieving peers with addresses: %v", err)
+	}
+	return ids
+}
+
+// PeersWithAddrsCtx is like PeersWithAddrs, but aborts iterating the datastore with the context's error if the
+// context is done before all peers are retrieved.
+func (ab *dsAddrBook) PeersWithAddrsCtx(ctx context.Context) (peer.IDSlice, error) {
+	ids, _, err := ab.peersWithAddrsPage(ctx, "", 0)
+	return ids, err
+}
+
+// PeersWithAddrsPage returns a page of at most limit peer IDs for which the AddrBook has addresses, starting at the
+// position denoted by the cursor, along with the cursor for the next page. Pass an empty cursor to fetch the first
+// page; an empty next cursor signals that there are no more pages. A limit of 0 or lower returns all remaining peers.
+//
+// Pages are served from a key-ordered datastore query using its Offset and Limit, so peers are never all held in
+// memory at once. Cursors are opaque; they are only stable as long as no peers are inserted or removed in between
+// calls, in which case a peer may be skipped or returned twice. Peers whose addresses have all expired, but haven't
+// been garbage collected yet, are skipped, so a page may hold fewer than limit peers even if more pages follow.
+func (ab *dsAddrBook) PeersWithAddrsPage(cursor string, limit int) (ids peer.IDSlice, next string, err error) {
+	return ab.peersWithAddrsPage(context.Background(), cursor, limit)
+}
+
+func (ab *dsAddrBook) peersWithAddrsPage(ctx context.Context, cursor string,
+	limit int) (ids peer.IDSlice, next string, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var offset int
+	if cursor != "" {
+		if offset, err = strconv.Atoi(cursor); err != nil || offset < 0 {
+			return nil, "", fmt.Errorf("invalid cursor: %q", cursor)
+		}
+	}
+	if limit < 0 {
+		limit = 0
+	}
+
+	// records are fetched along with the keys, so we can skip the ones that only hold expired addresses.
+	q := query.Query{
+		Prefix: addrBookBase.String(),
+		Orders: []query.Order{query.OrderByKey{}},
+		Offset: offset,
+		Limit:  limit,
+	}
+	results, err := ab.ds.Query(q)
+	if err != nil {
+		return nil, "", err
+	}
+	defer results.Close()
+
+	var (
+		record = &pb.AddrBookRecord{}
+		now    = ab.clock.Now().Unix()
+	)
+	ids = make(peer.IDSlice, 0, limit)
+	seen := 0
+	ch := results.Next()
+	for {
+		var (
+			result query.Result
+			ok     bool
+		)
+		select {
+		case result, ok = <-ch:
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		}
+		if !ok {
+			break
+		}
+		if result.Error != nil {
+			return nil, "", result.Error
+		}
+		seen++
+
+		record.Reset()
+		if err = ab.codec.Unmarshal(result.Value, record); err != nil {
+			ab.metrics.CorruptRecord()
+			ab.log.Warningf("failed while unmarshalling record with key: %v, err: %v", result.Key, err)
+			continue
+		}
+		if !hasLiveAddrs(record, now) {
+			continue
+		}
+
+		id, err := ab.keys.decode(ds.RawKey(result.Key).Name())
+		if err != nil {
+			ab.log.Warningf("failed while decoding peer ID from key: %v, err: %v", result.Key, err)
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	if limit > 0 && seen == limit {
+		next = strconv.Itoa(offset + seen)
+	}
+	return ids, next, nil
+}
+
+// hasLiveAddrs returns whether a record holds any address that hasn't expired by now (in unix seconds).
+func hasLiveAddrs(record *pb.AddrBookRecord, now int64) bool {
+	for _, entry := range record.Addrs {
+		if entry.Expiry > now {
+			return true
+		}
+	}
+	return false
+}
+
+// ForEach calls fn with the non-expired addresses of every peer held in the AddrBook, sorted by descending priority,
+// until all peers have been visited, fn returns an error, or the context is done; in the latter cases, that error is
+// returned. Peers are visited in key order through a single datastore query (or one per chunk, see
+// Options.ScanChunkSize), so the store is never held in memory at once. Peers with no unexpired addresses are skipped.
+//
+// Records are read straight from the datastore, bypassing the cache. fn must not retain the slice it's passed.
+func (ab *dsAddrBook) ForEach(ctx context.Context, fn func(peer.ID, []ma.Multiaddr) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	results, err := ab.scan(forEachQuery)
+	if err != nil {
+		return fmt.Errorf("failed while opening iterator to visit addrs, err: %v", err)
+	}
+	defer results.Close()
+
+	record := &addrsRecord{AddrBookRecord: &pb.AddrBookRecord{}} // empty record to reuse and avoid allocs.
+	var addrs []ma.Multiaddr
+	ch := results.Next()
+	for {
+		var (
+			result query.Result
+			ok     bool
+		)
+		select {
+		case result, ok = <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if !ok {
+			return nil
+		}
+		if result.Error != nil {
+			return fmt.Errorf("failed while iterating entries to visit addrs, err: %v", result.Error)
+		}
+
+		record.Reset()
+		if err = ab.codec.Unmarshal(result.Value, record.AddrBookRecord); err != nil || record.Id == nil {
+			ab.metrics.CorruptRecord()
+			ab.log.Warningf("failed while unmarshalling record with key: %v, err: %v", result.Key, err)
+			continue
+		}
+
+		addrs = addrs[:0]
+		for _, a := range ab.prioritized(record, nil) {
+			addrs = append(addrs, a.Addr)
+		}
+		if len(addrs) == 0 {
+			continue
+		}
+		if err = fn(record.Id.ID, addrs); err != nil {
+			return err
+		}
+	}
+}
+
+// AddrStream returns a channel on which all new addresses discovered for a
+// given peer ID will be published.
+func (ab *dsAddrBook) AddrStream(ctx context.Context, p peer.ID) <-chan ma.Multiaddr {
+	// subscribe before reading the addresses on file, so that we don't miss those added in the meantime.
+	return ab.subsManager.AddrStreamFunc(ctx, p, func() []ma.Multiaddr {
+		addrs, err := ab.initialAddrs(ctx, p)
+		if err != nil {
+			ab.log.Warningf("failed to read addrs of peer %v while opening stream, starting without them, err: %v", p, err)
+		}
+		return addrs
+	})
+}
+
+// AddrStreamErr is like AddrStream, but returns an error if the addresses on file can't be read, rather than starting
+// the stream without them. In both cases, failed reads are retried a few times, with backoff, before giving up.
+func (ab *dsAddrBook) AddrStreamErr(ctx context.Context, p peer.ID) (<-chan ma.Multiaddr, error) {
+	return ab.subsManager.AddrStreamFuncErr(ctx, p, func() ([]ma.Multiaddr, error) {
+		return ab.initialAddrs(ctx, p)
+	})
+}
+
+// initialAddrs reads the addresses of a peer to start a stream with, retrying in case the failure is transient.
+func (ab *dsAddrBook) initialAddrs(ctx context.Context, p peer.ID) (addrs []ma.Multiaddr, err error) {
+	backoff := initialReadBackoff
+	for i := 0; i < initialReadAttempts; i++ {
+		if i > 0 {
+			select {
+			case <-ab.clock.After(backoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			backoff *= 2
+		}
+		if addrs, err = ab.AddrsCtx(ctx, p); err == nil || err == ctx.Err() {
+			return addrs, err
+		}
+	}
+	return nil, err
+}
+
+// AddrWithTTL is an address along with its remaining lifetime.
+type AddrWithTTL struct {
+	Addr ma.Multiaddr
+	TTL  time.Duration
+}
+
+// AddrInfoStream is like AddrStream, but publishes every address along with its remaining lifetime at the time it's
+// published, starting with the addresses already held for the peer. Addresses that expire or are removed before
+// they're published are skipped. The channel is closed when the context is cancelled.
+func (ab *dsAddrBook) AddrInfoStream(ctx context.Context, p peer.ID) <-chan AddrWithTTL {
+	in := ab.AddrStream(ctx, p)
+	out := make(chan AddrWithTTL)
+
+	go func() {
+		defer close(out)
+
+		for a := range in {
+			_, exp, found := ab.GetTTL(p, a)
+			if !found {
+				continue
+			}
+			select {
+			case out <- AddrWithTTL{Addr: a, TTL: exp.Sub(ab.clock.Now())}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// AddrStreamMany returns a single subscription to the new addresses of a set of peers, which can be changed while it's
+// active. It's cheaper than calling AddrStream for each peer when watching many of them.
+func (ab *dsAddrBook) AddrStreamMany(ctx context.Context, peers []peer.ID) *pstoremem.MultiAddrStream {
+	return ab.subsManager.AddrStreamMany(ctx, peers)
+}
+
+// AddrBatchStream returns a channel on which the addresses added to a peer are published as one slice per mutation,
+// rather than one address at a time as on AddrStream. It suits consumers that only react to the peer's address set
+// changing, e.g. to re-dial it, and would otherwise be woken up once per address of a bulk insert.
+func (ab *dsAddrBook) AddrBatchStream(ctx context.Context, p peer.ID) <-chan []ma.Multiaddr {
+	return ab.subsManager.AddrBatchStream(ctx, p)
+}
+
+// AddrExpiryStream returns a channel on which addresses of a given peer ID will be published as they expire, or are
+// removed via SetAddrs with a non-positive TTL or ClearAddrs.
+func (ab *dsAddrBook) AddrExpiryStream(ctx context.Context, p peer.ID) <-chan ma.Multiaddr {
+	return ab.subsManager.AddrExpiryStream(ctx, p)
+}
+
+// PeerRemovedStream returns a channel on which peers are published as they lose their last address, because it
+// expired or was removed. Records expired natively by the datastore are only published if GC visits them first.
+func (ab *dsAddrBook) PeerRemovedStream(ctx context.Context) <-chan peer.ID {
+	return ab.subsManager.PeerRemovedStream(ctx)
+}
+
+// ClearAddrs will delete all known addresses for a peer ID. If Options.ClearRelayedAddrs is set, the addresses of
+// other peers routed through it as a relay are deleted too.
+func (ab *dsAddrBook) ClearAddrs(p peer.ID) {
+	ab.beginWrite()
+	defer ab.endWrite()
+
+	key := ab.keys.child(addrBookBase, p)
+
+	// load the record to learn which addresses are going away, so we can notify expiry subscribers.
+	held := false
+	if pr, err := ab.loadRecord(p, false, false); err == nil {
+		pr.RLock()
+		for _, entry := range pr.Addrs {
+			ab.subsManager.BroadcastExpiry(p, entry.Addr.Multiaddr)
+			ab.history.record(p, AddrRemoved, entry.Addr.Multiaddr)
+		}
+		if held = len(pr.Addrs) > 0; held {
+			ab.subsManager.BroadcastPeerRemoved(p)
+		}
+		pr.RUnlock()
+	} else {
+		ab.log.Warningf("failed to load peerstore entry for peer %v while clearing addrs, err: %v", p, err)
+	}
+
+	ab.cache.Remove(p)
+
+	if err := ab.deleteCertified(p); err != nil {
+		ab.log.Errorf("failed to clear peer record for peer %s: %v", p.Pretty(), err)
+	}
+
+	if !held {
+		// the record may only hold expired addresses.
+		held, _ = ab.ds.Has(key)
+	}
+	if held {
+		if err := ab.markKnown(ab.ds, p, ab.clock.Now().Unix()); err != nil {
+			ab.log.Errorf("failed to mark peer %s as known: %v", p.Pretty(), err)
+			ab.writeFailed(p, "ClearAddrs", err)
+		}
+	}
+	if err := ab.ds.Delete(key); err != nil {
+		ab.log.Errorf("failed to clear addresses for peer %s: %v", p.Pretty(), err)
+		ab.writeFailed(p, "ClearAddrs", err)
+	}
+	// evict again, in case a concurrent read cached the record before it was deleted.
+	ab.cache.Remove(p)
+
+	if ab.opts.ClearRelayedAddrs {
+		if err := ab.clearRelayed(map[peer.ID]struct{}{p: {}}); err != nil {
+			ab.log.Errorf("failed to clear addresses relayed by peer %s: %v", p.Pretty(), err)
+		}
+	}
+}
+
+// ClearAddrsMany removes all addresses of the given peers, like calling ClearAddrs for each of them, but deletes their
+// records through batches of bounded size rather than one by one. Errors are collected, and returned combined once all
+// peers have been visited.
+func (ab *dsAddrBook) ClearAddrsMany(peers []peer.ID) error {
+	ab.beginWrite()
+	defer ab.endWrite()
+
+	if len(peers) == 0 {
+		return nil
+	}
+
+	batch, err := newCyclicBatch(ab.ds, ab.batchSize())
+	if err != nil {
+		return fmt.Errorf("failed to create batch while clearing addrs for many peers, err: %v", err)
+	}
+
+	// records are evicted once the deletions are committed, so that concurrent reads don't cache them again.
+	defer func() {
+		for _, p := range peers {
+			ab.cache.Remove(p)
+		}
+	}()
+
+	ab.certifiedLk.Lock()
+	defer ab.certifiedLk.Unlock()
+
+	var errs []error
+	for _, p := range peers {
+		key := ab.keys.child(addrBookBase, p)
+
+		// load the record to learn which addresses are going away, so we can notify expiry subscribers. batches may
+		// not tolerate deleting missing keys, so we only delete records that are held.
+		held := false
+		if pr, err := ab.loadRecord(p, false, false); err == nil {
+			pr.RLock()
+			for _, entry := range pr.Addrs {
+				ab.subsManager.BroadcastExpiry(p, entry.Addr.Multiaddr)
+				ab.history.record(p, AddrRemoved, entry.Addr.Multiaddr)
+			}
+			if held = len(pr.Addrs) > 0; held {
+				ab.subsManager.BroadcastPeerRemoved(p)
+			}
+			pr.RUnlock()
+		} else {
+			ab.log.Warningf("failed to load peerstore entry for peer %v while clearing addrs, err: %v", p, err)
+			held, _ = ab.ds.Has(key)
+		}
+
+		if held {
+			if err = ab.markKnown(batch, p, ab.clock.Now().Unix()); err != nil {
+				errs = append(errs, fmt.Errorf("failed to mark peer %s as known: %v", p.Pretty(), err))
+			}
+			if err = batch.Delete(key); err != nil {
+				errs = append(errs, fmt.Errorf("failed to clear addresses for peer %s: %v", p.Pretty(), err))
+			}
+		}
+		if has, _ := ab.ds.Has(ab.certifiedKey(p)); has {
+			if err = batch.Delete(ab.certifiedKey(p)); err != nil {
+				errs = append(errs, fmt.Errorf("failed to clear peer record for peer %s: %v", p.Pretty(), err))
+			}
+		}
+	}
+
+	if err = batch.Commit(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to commit batch while clearing addrs for many peers, err: %v", err))
+	}
+
+	if ab.opts.ClearRelayedAddrs {
+		relays := make(map[peer.ID]struct{}, len(peers))
+		for _, p := range peers {
+			relays[p] = struct{}{}
+		}
+		if err = ab.clearRelayed(relays); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed while clearing addrs for many peers; err(s): %q", errs)
+	}
+	return nil
+}
+
+// ClearAddrsPreview returns the keys ClearAddrs and ClearAddrsMany would delete for the peers, i.e. those of their
+// address records and signed peer records, without deleting them. Keys are relative to Options.Namespace. With
+// Options.ClearRelayedAddrs, the addresses relayed by the peers would also be removed from the records of other
+// peers; those records are updated rather than deleted, so they're not listed.
+func (ab *dsAddrBook) ClearAddrsPreview(peers []peer.ID) ([]ds.Key, error) {
+	var keys []ds.Key
+	for _, p := range peers {
+		key := ab.keys.child(addrBookBase, p)
+		for _, k := range []ds.Key{key, ab.certifiedKey(p)} {
+			has, err := ab.ds.Has(k)
+			if err != nil {
+				return nil, fmt.Errorf("failed to look up key %v while previewing clear of addrs, err: %v", k, err)
+			}
+			if has {
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// setAddrs merges the addresses into the peer's record, and flushes the result through the provided write, which can
+// be the datastore itself or a batch. If priority is not nil, it's set on all addresses; otherwise existing addresses
+// keep their priority, and new ones get the default priority of 0.
+func (ab *dsAddrBook) setAddrs(write ds.Write, p peer.ID, addrs []ma.Multiaddr, ttl time.Duration, mode ttlWriteMode,
+	priority *int64) (err error) {
+	if err = p.Validate(); err != nil {
+		return fmt.Errorf("refusing to set addrs, err: %v", err)
+	}
+	pr, err := ab.loadRecord(p, true, false)
+	if err != nil {
+		return fmt.Errorf("failed to load peerstore entry for peer %v while setting addrs, err: %v", p, err)
+	}
+	return ab.mergeAddrs(write, pr, addrs, ttl, mode, priority)
+}
+
+// mergeAddrs merges the addresses into a record, as described in setAddrs.
+func (ab *dsAddrBook) mergeAddrs(write ds.Write, pr *addrsRecord, addrs []ma.Multiaddr, ttl time.Duration,
+	mode ttlWriteMode, priority *int64) (err error) {
+	return ab.mergeAddrGroups(write, pr, []ttlGroup{{addrs: addrs, ttl: ttl}}, mode, priority)
+}
+
+// ttlGroup holds addresses merged into a record with the same TTL.
+type ttlGroup struct {
+	addrs []ma.Multiaddr
+	ttl   time.Duration
+}
+
+// mergeAddrGroups merges groups of addresses, each with its own TTL, into a record within a single lock, as described
+// in setAddrs. Later groups see the addresses merged by earlier ones. The result is flushed, and the added addresses
+// broadcast, once.
+func (ab *dsAddrBook) mergeAddrGroups(write ds.Write, pr *addrsRecord, groups []ttlGroup, mode ttlWriteMode,
+	priority *int64) (err error) {
+	p := pr.Id.ID
+	for i, g := range groups {
+		groups[i] = ttlGroup{addrs: ab.filterAddrs(g.addrs), ttl: ab.clampTTL(ab.resolveTTL(p, g.ttl))}
+	}
+
+	pr.Lock()
+	defer pr.Unlock()
+
+	now := ab.clock.Now().Unix()
+	held := len(pr.Addrs) // addresses added by a group are appended past those held, for later groups to see them.
+	updated := false      // whether we changed the ttl of any existing addr.
+
+	var provided []bool // keeps track of which addrs held were provided, when replacing.
+	if mode == ttlReplace {
+		provided = make([]bool, held)
+	}
+
+	for _, g := range groups {
+		ttl := g.ttl
+		exps := make([]int64, len(g.addrs))   // expirations are computed per address, as they may be jittered.
+		existed := make([]bool, len(g.addrs)) // keeps track of which addrs we found.
+
+		for i := range exps {
+			if i == 0 || ab.opts.TTLJitter > 0 {
+				exps[i] = ab.expiry(ttl)
+			} else {
+				exps[i] = exps[0]
+			}
+		}
+
+	Outer:
+		for i, incoming := range g.addrs {
+			newExp := exps[i]
+			for j, have := range pr.Addrs {
+				if incoming.Equal(have.Addr) {
+					existed[i] = true
+					if j < held && provided != nil {
+						provided[j] = true
+					}
+					if priority != nil && have.Priority != *priority {
+						have.Priority = *priority
+						updated = true
+					}
+					if mode == ttlExtend && have.Expiry >= newExp {
+						// if we're only extending TTLs but the addr already has a longer one, we skip it.
+						continue Outer
+					}
+					if have.Ttl != int64(ttl) || have.Expiry != newExp {
+						have.Ttl, have.Expiry = int64(ttl), newExp
+						updated = true
+					}
+					// we found the address, and addresses cannot be duplicate,
+					// so let's move on to the next.
+					continue Outer
+				}
+			}
+		}
+
+		// add addresses we didn't hold.
+		for i, e := range existed {
+			if e {
+				continue
+			}
+			entry := &pb.AddrBookRecord_AddrEntry{
+				Addr:   &pb.ProtoAddr{Multiaddr: g.addrs[i]},
+				Ttl:    int64(ttl),
+				Expiry: exps[i],
+				Added:  now,
+			}
+			if priority != nil {
+				entry.Priority = *priority
+			}
+			pr.Addrs = append(pr.Addrs, entry)
+		}
+	}
+
+	// set the added addresses aside while those held are replaced.
+	added := append([]*pb.AddrBookRecord_AddrEntry(nil), pr.Addrs[held:]...)
+	pr.Addrs = pr.Addrs[:held]
+
+	emptied := false
+	if provided != nil {
+		// remove the addresses held that were not provided, in place.
+		survived := 0
+		for i, entry := range pr.Addrs {
+			if !provided[i] {
+				ab.subsManager.BroadcastExpiry(p, entry.Addr.Multiaddr)
+				ab.history.record(p, AddrRemoved, entry.Addr.Multiaddr)
+				updated = true
+				continue
+			}
+			pr.Addrs[survived] = entry
+			survived++
+		}
+		emptied = survived == 0 && len(pr.Addrs) > 0
+		pr.Addrs = pr.Addrs[:survived]
+	}
+
+	if len(added) == 0 && !updated && !pr.dirty {
+		// we already held all addresses with at least the requested lifetime; there's nothing to write.
+		return nil
+	}
+
+	pr.Addrs = append(pr.Addrs, added...)
+	pr.dirty = true
+	ab.clean(pr)
+	if emptied && len(pr.Addrs) == 0 {
+		ab.subsManager.BroadcastPeerRemoved(p)
+	}
+
+	evicted := ab.enforceAddrLimit(pr)
+
+	broadcast := make([]ma.Multiaddr, 0, len(added))
+Broadcast:
+	for _, entry := range added {
+		for _, e := range evicted {
+			if e == entry {
+				// this address didn't make it past the limit.
+				continue Broadcast
+			}
+		}
+		broadcast = append(broadcast, entry.Addr.Multiaddr)
+	}
+	// note: there's a minor chance that writing the record will fail, in which case we would've broadcast
+	// the addresses without persisting them. This is very unlikely and not much of an issue.
+	ab.subsManager.BroadcastAddrs(p, broadcast)
+	ab.history.record(p, AddrAdded, broadcast...)
+
+	return ab.flushRecord(write, pr)
+}
+
+// enforceAddrLimit evicts the soonest expiring addresses of a record holding more than Options.MaxAddrsPerPeer
+// addresses, and notifies expiry subscribers. It returns the evicted entries. To be called within a lock, after
+// clean() has sorted the record.
+func (ab *dsAddrBook) enforceAddrLimit(pr *addrsRecord) (evicted []*pb.AddrBookRecord_AddrEntry) {
+	max := ab.opts.MaxAddrsPerPeer
+	if max <= 0 || len(pr.Addrs) <= max {
+		return nil
+	}
+
+	// addresses are sorted by expiration, so the ones expiring the soonest are at the head.
+	evicted = pr.Addrs[:len(pr.Addrs)-max]
+	pr.Addrs = pr.Addrs[len(pr.Addrs)-max:]
+	for _, entry := range evicted {
+		ab.subsManager.BroadcastExpiry(pr.Id.ID, entry.Addr.Multiaddr)
+		ab.history.record(pr.Id.ID, AddrRemoved, entry.Addr.Multiaddr)
+	}
+	return evicted
+}
+
+func (ab *dsAddrBook) deleteAddrs(p peer.ID, addrs []ma.Multiaddr) (err error) {
+	pr, err := ab.loadRecord(p, true, false)
+	if err != nil {
+		return fmt.Errorf("failed to load peerstore entry for peer %v while deleting addrs, err: %v", p, err)
+	}
+	return ab.removeAddrs(ab.ds, pr, addrs)
+}
+
+// removeAddrs removes the addresses from a record, and flushes the result through the provided write.
+func (ab *dsAddrBook) removeAddrs(write ds.Write, pr *addrsRecord, addrs []ma.Multiaddr) (err error) {
+	p := pr.Id.ID
+	if pr.Addrs == nil {
+		return nil
+	}
+
+	pr.Lock()
+	defer pr.Unlock()
 
 	// deletes addresses in place, and avoiding copies until we encounter the first deletion.
 	survived := 0
+Outer:
 	for i, addr := range pr.Addrs {
 		for _, del := range addrs {
 			if addr.Addr.Equal(del) {
-				continue
-			}
-			if i != survived {
-				pr.Addrs[survived] = pr.Addrs[i]
+				ab.subsManager.BroadcastExpiry(p, addr.Addr.Multiaddr)
+				ab.history.record(p, AddrRemoved, addr.Addr.Multiaddr)
+				continue Outer
 			}
-			survived++
 		}
+		if i != survived {
+			pr.Addrs[survived] = pr.Addrs[i]
+		}
+		survived++
 	}
+	emptied := survived == 0 && len(pr.Addrs) > 0
 	pr.Addrs = pr.Addrs[:survived]
+	if emptied {
+		ab.subsManager.BroadcastPeerRemoved(p)
+	}
 
 	pr.dirty = true
-	pr.clean()
-	return pr.flush(ab.ds)
+	ab.clean(pr)
+	return ab.flushRecord(write, pr)
 }
 
-func cleanAddrs(addrs []ma.Multiaddr) []ma.Multiaddr {
+// clean calls clean() on the record, and notifies expiry subscribers of any addresses that were dropped as a
+// result, and peer subscribers if that left the record empty. The return value indicates if the record was changed.
+// To be called within a lock.
+//
+// Expired addresses are only dropped once their grace period is over; see Options.ExpiryGracePeriod.
+func (ab *dsAddrBook) clean(pr *addrsRecord) (chgd bool) {
+	chgd, expired := pr.clean(ab.clock.Now().Add(-ab.opts.ExpiryGracePeriod))
+	if len(expired) > 0 {
+		ab.metrics.ExpiredCount(len(expired))
+	}
+	for _, entry := range expired {
+		ab.subsManager.BroadcastExpiry(pr.Id.ID, entry.Addr.Multiaddr)
+		ab.history.record(pr.Id.ID, AddrExpired, entry.Addr.Multiaddr)
+	}
+	if ab.onExpire != nil && len(expired) > 0 {
+		addrs := make([]ma.Multiaddr, len(expired))
+		for i, entry := range expired {
+			addrs[i] = entry.Addr.Multiaddr
+		}
+		ab.onExpire.notify(pr.Id.ID, addrs)
+	}
+	if len(expired) > 0 && len(pr.Addrs) == 0 {
+		ab.subsManager.BroadcastPeerRemoved(pr.Id.ID)
+	}
+	return chgd
+}
+
+// writeFailed reports a failed write of a method that doesn't return errors to Options.OnWriteFailure, if set. It must
+// be called without holding the lock of any record.
+func (ab *dsAddrBook) writeFailed(p peer.ID, op string, err error) {
+	if ab.opts.OnWriteFailure != nil {
+		ab.opts.OnWriteFailure(p, op, err)
+	}
+}
+
+// flushRecord writes a record through the provided write, which can be the datastore itself or a batch, by calling
+// Put, unless the record is marked for deletion, in which case we call Delete. To be called within the record's lock.
+//
+// If the datastore supports native TTLs (ds.TTL) and the record holds no permanent addresses, the record is written
+// with PutWithTTL so that the datastore expires it on its own once its last address expires, and the grace period has
+// elapsed (see Options.ExpiryGracePeriod). Batches of the datastore carry TTLs too; see namespacedTTL.
+func (ab *dsAddrBook) flushRecord(write ds.Write, pr *addrsRecord) (err error) {
+	pr.shared.Store((*sharedAddrs)(nil))
+
+	key := ab.keys.child(addrBookBase, pr.Id.ID)
+	if len(pr.Addrs) == 0 {
+		// the peer outlives its record, if one is stored; see AddrsInfo. Records of peers never seen are empty too.
+		held, err := ab.ds.Has(key)
+		if err != nil {
+			return err
+		}
+		if held {
+			if err = ab.markKnown(write, pr.Id.ID, ab.clock.Now().Unix()); err != nil {
+				return err
+			}
+		}
+		if err = write.Delete(key); err == nil {
+			pr.dirty = false
+			ab.resized(pr)
+		}
+		return err
+	}
+
+	data, err := ab.codec.Marshal(pr.AddrBookRecord)
+	if err != nil {
+		return err
+	}
+	now, grace := ab.clock.Now(), ab.opts.ExpiryGracePeriod
+	if ttl, ok := pr.storeTTL(now.Unix()); ok && ab.nativeTTL && ttl+grace > 0 {
+		// the datastore may expire the record without it being flushed again, so the peer is marked upfront.
+		if err = ab.markKnown(write, pr.Id.ID, now.Add(ttl+grace).Unix()); err != nil {
+			return err
+		}
+		err = putWithTTL(write, key, data, ttl+grace)
+	} else {
+		err = write.Put(key, data)
+	}
+	if err != nil {
+		return err
+	}
+	// write succeeded; record is no longer dirty.
+	pr.dirty = false
+	ab.resized(pr)
+	return nil
+}
+
+// resized takes note of the number of addresses of a record after it changed, so that a cache bounded by addresses
+// can account for it. To be called within the record's lock.
+func (ab *dsAddrBook) resized(pr *addrsRecord) {
+	atomic.StoreInt32(&pr.size, int32(len(pr.Addrs)))
+	if c, ok := ab.cache.(*addrCache); ok {
+		c.resize(pr.Id.ID, pr)
+	}
+}
+
+// purgeAt returns when an entry is due to be dropped from its record (in unix seconds), i.e. once it has expired and
+// its grace period is over.
+func (ab *dsAddrBook) purgeAt(entry *pb.AddrBookRecord_AddrEntry) int64 {
+	return entry.Expiry + int64(ab.opts.ExpiryGracePeriod/time.Second)
+}
+
+// clampTTL applies the ceiling set by Options.MaxTTL to a TTL.
+func (ab *dsAddrBook) clampTTL(ttl time.Duration) time.Duration {
+	max := ab.opts.MaxTTL
+	if max <= 0 || ttl <= max {
+		return ttl
+	}
+	if ttl == pstore.PermanentAddrTTL && !ab.opts.ClampPermanentTTL {
+		return ttl
+	}
+	return max
+}
+
+// expiry returns the unix timestamp at which an address inserted now with the given TTL expires, spread by
+// Options.TTLJitter and rounded up to the next multiple of Options.TTLGranularity, if set.
+func (ab *dsAddrBook) expiry(ttl time.Duration) int64 {
+	if j := ab.opts.TTLJitter; j > 0 && ttl > 0 && ttl != pstore.PermanentAddrTTL {
+		if spread := int64(float64(ttl) * j); spread > 0 {
+			ttl += time.Duration(rand.Int63n(2*spread+1) - spread)
+		}
+	}
+	exp := ab.clock.Now().Add(ttl).Unix()
+	if g := int64(ab.opts.TTLGranularity / time.Second); g > 1 {
+		if rem := exp % g; rem != 0 {
+			exp += g - rem
+		}
+	}
+	return exp
+}
+
+// filterAddrs drops the addresses that don't satisfy Options.AddrFilter, if set.
+func (ab *dsAddrBook) filterAddrs(addrs []ma.Multiaddr) []ma.Multiaddr {
+	if ab.opts.AddrFilter == nil {
+		return addrs
+	}
+	kept := make([]ma.Multiaddr, 0, len(addrs))
+	for _, addr := range addrs {
+		if ab.opts.AddrFilter(addr) {
+			kept = append(kept, addr)
+		}
+	}
+	return kept
+}
+
+// cleanAddrs normalizes addresses with Options.NormalizeAddr, if set, and drops nil and duplicate addresses. The
+// returned slice may be the provided one, so it must not be modified.
+func (ab *dsAddrBook) cleanAddrs(addrs []ma.Multiaddr) []ma.Multiaddr {
+	if len(addrs) == 1 && addrs[0] != nil && ab.opts.NormalizeAddr == nil {
+		// a single address can't be duplicate, so there's nothing to clean. this saves the allocations below on the
+		// hot path of AddAddr and SetAddr.
+		return addrs
+	}
+
 	clean := make([]ma.Multiaddr, 0, len(addrs))
+	seen := make(map[string]struct{}, len(addrs))
 	for _, addr := range addrs {
+		if addr != nil && ab.opts.NormalizeAddr != nil {
+			addr = ab.opts.NormalizeAddr(addr)
+		}
 		if addr == nil {
 			continue
 		}
+		if _, ok := seen[string(addr.Bytes())]; ok {
+			continue
+		}
+		seen[string(addr.Bytes())] = struct{}{}
 		clean = append(clean, addr)
 	}
 	return clean
@@ -11,8 +11,6 @@ import (
 
 	peer "github.com/libp2p/go-libp2p-peer"
 	pb "github.com/libp2p/go-libp2p-peerstore/pb"
-
-	b32 "github.com/multiformats/go-base32"
 )
 
 var (
@@ -22,6 +20,10 @@ var (
 	// only the timeslice we are interested in.
 	gcLookaheadBase = ds.NewKey("/peers/gc/addrs")
 
+	// Signed peer records due to expire within the lookahead window are scheduled likewise, under:
+	// /peers/gc/certified/<unix timestamp of expiry>/<peer ID b32> => nil
+	gcCertifiedBase = ds.NewKey("/peers/gc/certified")
+
 	// queries
 	purgeLookaheadQuery = query.Query{
 		Prefix:   gcLookaheadBase.String(),
@@ -29,6 +31,12 @@ var (
 		KeysOnly: true,
 	}
 
+	purgeCertifiedLookaheadQuery = query.Query{
+		Prefix:   gcCertifiedBase.String(),
+		Orders:   []query.Order{query.OrderByKey{}},
+		KeysOnly: true,
+	}
+
 	purgeStoreQuery = query.Query{
 		Prefix:   addrBookBase.String(),
 		Orders:   []query.Order{query.OrderByKey{}},
@@ -52,21 +60,8 @@ type dsAddrBookGc struct {
 	currWindowEnd    int64
 }
 
+// newAddressBookGc sets up GC for an address book whose options have been validated.
 func newAddressBookGc(ctx context.Context, ab *dsAddrBook) (*dsAddrBookGc, error) {
-	if ab.opts.GCPurgeInterval < 0 {
-		return nil, fmt.Errorf("negative GC purge interval provided: %s", ab.opts.GCPurgeInterval)
-	}
-	if ab.opts.GCLookaheadInterval < 0 {
-		return nil, fmt.Errorf("negative GC lookahead interval provided: %s", ab.opts.GCLookaheadInterval)
-	}
-	if ab.opts.GCInitialDelay < 0 {
-		return nil, fmt.Errorf("negative GC initial delay provided: %s", ab.opts.GCInitialDelay)
-	}
-	if ab.opts.GCLookaheadInterval > 0 && ab.opts.GCLookaheadInterval < ab.opts.GCPurgeInterval {
-		return nil, fmt.Errorf("lookahead interval must be larger than purge interval, respectively: %s, %s",
-			ab.opts.GCLookaheadInterval, ab.opts.GCPurgeInterval)
-	}
-
 	lookaheadEnabled := ab.opts.GCLookaheadInterval > 0
 	gc := &dsAddrBookGc{
 		ctx:              ctx,
@@ -95,31 +90,49 @@ func (gc *dsAddrBookGc) background() {
 	defer gc.ab.childrenDone.Done()
 
 	select {
-	case <-time.After(gc.ab.opts.GCInitialDelay):
+	case <-gc.ab.clock.After(gc.ab.opts.GCInitialDelay):
 	case <-gc.ab.ctx.Done():
 		// yield if we have been cancelled/closed before the delay elapses.
 		return
 	}
 
-	purgeTimer := time.NewTicker(gc.ab.opts.GCPurgeInterval)
-	defer purgeTimer.Stop()
+	adaptive := gc.lookaheadEnabled && gc.ab.opts.GCMinPurgeInterval > 0
+
+	var purgeCh <-chan time.Time
+	if !adaptive {
+		purgeTimer := gc.ab.clock.NewTicker(gc.ab.opts.GCPurgeInterval)
+		purgeCh = purgeTimer.Chan()
+		defer purgeTimer.Stop()
+	}
 
 	var lookaheadCh <-chan time.Time
 	if gc.lookaheadEnabled {
-		lookaheadTimer := time.NewTicker(gc.ab.opts.GCLookaheadInterval)
-		lookaheadCh = lookaheadTimer.C
+		lookaheadTimer := gc.ab.clock.NewTicker(gc.ab.opts.GCLookaheadInterval)
+		lookaheadCh = lookaheadTimer.Chan()
 		gc.populateLookahead() // do a lookahead now
 		defer lookaheadTimer.Stop()
 	}
 
+	if adaptive {
+		purgeCh = gc.ab.clock.After(gc.nextPurgeDelay())
+	}
+
 	for {
 		select {
-		case <-purgeTimer.C:
+		case <-purgeCh:
 			gc.purgeFunc()
+			gc.purgeCertified()
+			if adaptive {
+				purgeCh = gc.ab.clock.After(gc.nextPurgeDelay())
+			}
 
 		case <-lookaheadCh:
 			// will never trigger if lookahead is disabled (nil Duration).
 			gc.populateLookahead()
+			if adaptive {
+				// the renewed window may hold expiries earlier than the scheduled purge.
+				purgeCh = gc.ab.clock.After(gc.nextPurgeDelay())
+			}
 
 		case <-gc.ctx.Done():
 			return
@@ -127,6 +140,41 @@ func (gc *dsAddrBookGc) background() {
 	}
 }
 
+// nextPurgeDelay returns the time until the earliest visit scheduled in the lookahead window, for address records and
+// signed peer records alike, bounded by Options.GCMinPurgeInterval and Options.GCPurgeInterval. If the window is empty,
+// the upper bound is returned.
+func (gc *dsAddrBookGc) nextPurgeDelay() time.Duration {
+	min, max := gc.ab.opts.GCMinPurgeInterval, gc.ab.opts.GCPurgeInterval
+
+	delay := max
+	for _, q := range []query.Query{purgeLookaheadQuery, purgeCertifiedLookaheadQuery} {
+		q.Limit = 1
+		results, err := gc.ab.ds.Query(q)
+		if err != nil {
+			gc.ab.log.Warningf("failed while fetching the next lookahead entry: %v", err)
+			continue
+		}
+		result, ok := results.NextSync()
+		results.Close()
+		if !ok || result.Error != nil {
+			continue
+		}
+		ts, err := strconv.ParseInt(ds.RawKey(result.Key).Parent().Name(), 10, 64)
+		if err != nil {
+			// unparseable entries are dropped by the next purge; get to it soon.
+			return min
+		}
+		if d := time.Unix(ts, 0).Sub(gc.ab.clock.Now()); d < delay {
+			delay = d
+		}
+	}
+
+	if delay < min {
+		return min
+	}
+	return delay
+}
+
 // purgeCycle runs a single GC purge cycle. It operates within the lookahead window if lookahead is enabled; else it
 // visits all entries in the datastore, deleting the addresses that have expired.
 func (gc *dsAddrBookGc) purgeLookahead() {
@@ -138,11 +186,13 @@ func (gc *dsAddrBookGc) purgeLookahead() {
 		return
 	}
 
+	defer func(start time.Time) { gc.ab.metrics.SweepDuration(time.Since(start)) }(time.Now())
+
 	var id peer.ID
 	record := &addrsRecord{AddrBookRecord: &pb.AddrBookRecord{}} // empty record to reuse and avoid allocs.
-	batch, err := newCyclicBatch(gc.ab.ds, defaultOpsPerCyclicBatch)
+	batch, err := newCyclicBatch(gc.ab.ds, gc.ab.batchSize())
 	if err != nil {
-		log.Warningf("failed while creating batch to purge GC entries: %v", err)
+		gc.ab.log.Warningf("failed while creating batch to purge GC entries: %v", err)
 	}
 
 	// This function drops an unparseable GC entry; this is for safety. It is an escape hatch in case
@@ -150,10 +200,10 @@ func (gc *dsAddrBookGc) purgeLookahead() {
 	// if we don't clean up unparseable entries we'll end up accumulating garbage.
 	dropInError := func(key ds.Key, err error, msg string) {
 		if err != nil {
-			log.Warningf("failed while %s record with GC key: %v, err: %v; deleting", msg, key, err)
+			gc.ab.log.Warningf("failed while %s record with GC key: %v, err: %v; deleting", msg, key, err)
 		}
 		if err = batch.Delete(key); err != nil {
-			log.Warningf("failed to delete corrupt GC lookahead entry: %v, err: %v", key, err)
+			gc.ab.log.Warningf("failed to delete corrupt GC lookahead entry: %v, err: %v", key, err)
 		}
 	}
 
@@ -161,26 +211,26 @@ func (gc *dsAddrBookGc) purgeLookahead() {
 	// if the next earliest expiry falls within the current window again.
 	dropOrReschedule := func(key ds.Key, ar *addrsRecord) {
 		if err := batch.Delete(key); err != nil {
-			log.Warningf("failed to delete lookahead entry: %v, err: %v", key, err)
+			gc.ab.log.Warningf("failed to delete lookahead entry: %v, err: %v", key, err)
 		}
 
 		// re-add the record if it needs to be visited again in this window.
-		if len(ar.Addrs) != 0 && ar.Addrs[0].Expiry <= gc.currWindowEnd {
-			gcKey := gcLookaheadBase.ChildString(fmt.Sprintf("%d/%s", ar.Addrs[0].Expiry, key.Name()))
+		if len(ar.Addrs) != 0 && gc.ab.purgeAt(ar.Addrs[0]) <= gc.currWindowEnd {
+			gcKey := gcLookaheadBase.ChildString(fmt.Sprintf("%d/%s", gc.ab.purgeAt(ar.Addrs[0]), key.Name()))
 			if err := batch.Put(gcKey, []byte{}); err != nil {
-				log.Warningf("failed to add new GC key: %v, err: %v", gcKey, err)
+				gc.ab.log.Warningf("failed to add new GC key: %v, err: %v", gcKey, err)
 			}
 		}
 	}
 
 	results, err := gc.ab.ds.Query(purgeLookaheadQuery)
 	if err != nil {
-		log.Warningf("failed while fetching entries to purge: %v", err)
+		gc.ab.log.Warningf("failed while fetching entries to purge: %v", err)
 		return
 	}
 	defer results.Close()
 
-	now := time.Now().Unix()
+	now := gc.ab.clock.Now().Unix()
 
 	// keys: 	/peers/gc/addrs/<unix timestamp of next visit>/<peer ID b32>
 	// values: 	nil
@@ -189,24 +239,17 @@ func (gc *dsAddrBookGc) purgeLookahead() {
 		ts, err := strconv.ParseInt(gcKey.Parent().Name(), 10, 64)
 		if err != nil {
 			dropInError(gcKey, err, "parsing timestamp")
-			log.Warningf("failed while parsing timestamp from key: %v, err: %v", result.Key, err)
+			gc.ab.log.Warningf("failed while parsing timestamp from key: %v, err: %v", result.Key, err)
 			continue
 		} else if ts > now {
 			// this is an ordered cursor; when we hit an entry with a timestamp beyond now, we can break.
 			break
 		}
 
-		idb32, err := b32.RawStdEncoding.DecodeString(gcKey.Name())
-		if err != nil {
-			dropInError(gcKey, err, "parsing peer ID")
-			log.Warningf("failed while parsing b32 peer ID from key: %v, err: %v", result.Key, err)
-			continue
-		}
-
-		id, err = peer.IDFromBytes(idb32)
+		id, err = gc.ab.keys.decode(gcKey.Name())
 		if err != nil {
 			dropInError(gcKey, err, "decoding peer ID")
-			log.Warningf("failed while decoding peer ID from key: %v, err: %v", result.Key, err)
+			gc.ab.log.Warningf("failed while decoding peer ID from key: %v, err: %v", result.Key, err)
 			continue
 		}
 
@@ -214,9 +257,9 @@ func (gc *dsAddrBookGc) purgeLookahead() {
 		if e, ok := gc.ab.cache.Peek(id); ok {
 			cached := e.(*addrsRecord)
 			cached.Lock()
-			if cached.clean() {
-				if err = cached.flush(batch); err != nil {
-					log.Warningf("failed to flush entry modified by GC for peer: &v, err: %v", id.Pretty(), err)
+			if gc.ab.clean(cached) {
+				if err = gc.ab.flushRecord(batch, cached); err != nil {
+					gc.ab.log.Warningf("failed to flush entry modified by GC for peer: %v, err: %v", id.Pretty(), err)
 				}
 			}
 			dropOrReschedule(gcKey, cached)
@@ -234,22 +277,22 @@ func (gc *dsAddrBookGc) purgeLookahead() {
 			dropInError(gcKey, err, "fetching entry")
 			continue
 		}
-		err = record.Unmarshal(val)
+		err = gc.ab.codec.Unmarshal(val, record.AddrBookRecord)
 		if err != nil {
 			dropInError(gcKey, err, "unmarshalling entry")
 			continue
 		}
-		if record.clean() {
-			err = record.flush(batch)
+		if gc.ab.clean(record) {
+			err = gc.ab.flushRecord(batch, record)
 			if err != nil {
-				log.Warningf("failed to flush entry modified by GC for peer: &v, err: %v", id.Pretty(), err)
+				gc.ab.log.Warningf("failed to flush entry modified by GC for peer: %v, err: %v", id.Pretty(), err)
 			}
 		}
 		dropOrReschedule(gcKey, record)
 	}
 
 	if err = batch.Commit(); err != nil {
-		log.Warningf("failed to commit GC purge batch: %v", err)
+		gc.ab.log.Warningf("failed to commit GC purge batch: %v", err)
 	}
 }
 
@@ -262,40 +305,339 @@ func (gc *dsAddrBookGc) purgeStore() {
 		return
 	}
 
+	if err := gc.sweepStore(); err != nil {
+		gc.ab.log.Warningf("failed while purging store: %v", err)
+	}
+}
+
+// flush runs a full purge of the store synchronously, waiting for any GC cycle in progress to finish first.
+func (gc *dsAddrBookGc) flush() error {
+	gc.running <- struct{}{}
+	defer func() { <-gc.running }()
+
+	if err := gc.sweepStore(); err != nil {
+		return err
+	}
+	return gc.sweepCertified()
+}
+
+// purgeCertified deletes the signed peer records that have expired. Records stored with native TTLs are left for the
+// datastore to expire; otherwise, those scheduled in the lookahead window are visited if lookahead is enabled, else all
+// records are swept.
+func (gc *dsAddrBookGc) purgeCertified() {
+	var err error
+	switch {
+	case gc.ab.nativeTTL:
+		return
+	case gc.lookaheadEnabled:
+		err = gc.purgeCertifiedLookahead()
+	default:
+		err = gc.sweepCertified()
+	}
+	if err != nil {
+		gc.ab.log.Warningf("failed while purging peer records: %v", err)
+	}
+}
+
+// purgeCertifiedLookahead visits the signed peer records whose expiry is due in the lookahead window, deleting those
+// that have expired. Records renewed in the meantime are rescheduled if their new expiry falls within the window.
+func (gc *dsAddrBookGc) purgeCertifiedLookahead() error {
+	batch, err := newCyclicBatch(gc.ab.ds, gc.ab.batchSize())
+	if err != nil {
+		return fmt.Errorf("failed while creating batch to purge peer record GC entries: %v", err)
+	}
+
+	results, err := gc.ab.ds.Query(purgeCertifiedLookaheadQuery)
+	if err != nil {
+		return fmt.Errorf("failed while fetching peer records to purge: %v", err)
+	}
+	defer results.Close()
+
+	// visit expires the record of an entry, and reschedules it if it was renewed within the window.
+	visit := func(gcKey ds.Key) error {
+		id, err := gc.ab.keys.decode(gcKey.Name())
+		if err != nil {
+			return err
+		}
+		cr, err := gc.ab.expireCertified(id)
+		if err != nil || cr == nil || cr.Expiry > gc.currWindowEnd {
+			return err
+		}
+		return batch.Put(gcCertifiedBase.ChildString(fmt.Sprintf("%d/%s", cr.Expiry, gcKey.Name())), []byte{})
+	}
+
+	now := gc.ab.clock.Now().Unix()
+
+	// keys: 	/peers/gc/certified/<unix timestamp of expiry>/<peer ID b32>
+	// values: 	nil
+	for result := range results.Next() {
+		gcKey := ds.RawKey(result.Key)
+		ts, err := strconv.ParseInt(gcKey.Parent().Name(), 10, 64)
+		if err == nil && ts > now {
+			// this is an ordered cursor; when we hit an entry with a timestamp beyond now, we can break.
+			break
+		}
+		if err == nil {
+			err = visit(gcKey)
+		}
+		// entries are dropped once visited, and so are unparseable ones.
+		if err != nil {
+			gc.ab.log.Warningf("failed while visiting peer record with GC key: %v, err: %v; deleting", gcKey, err)
+		}
+		if err = batch.Delete(gcKey); err != nil {
+			gc.ab.log.Warningf("failed to delete peer record GC entry: %v, err: %v", gcKey, err)
+		}
+	}
+
+	if err = batch.Commit(); err != nil {
+		return fmt.Errorf("failed to commit peer record purge batch: %v", err)
+	}
+	return nil
+}
+
+// sweepCertified visits all signed peer records in the datastore, deleting those that have expired. Records are only
+// locked one at a time as they're deleted, so that ConsumePeerRecord isn't held up by the sweep.
+func (gc *dsAddrBookGc) sweepCertified() error {
+	results, err := gc.ab.scan(purgeCertifiedQuery)
+	if err != nil {
+		return fmt.Errorf("failed while opening iterator: %v", err)
+	}
+	defer results.Close()
+
+	now := gc.ab.clock.Now().Unix()
+
+	// keys: 	/peers/certified/<peer ID b32>
+	cr := new(pb.CertifiedRecord)
+	for result := range results.Next() {
+		if result.Error != nil {
+			return fmt.Errorf("failed while iterating peer records: %v", result.Error)
+		}
+		cr.Reset()
+		if err := cr.Unmarshal(result.Value); err != nil {
+			gc.ab.log.Warningf("failed while decoding peer record with key: %v, err: %v", result.Key, err)
+			continue
+		}
+		if cr.Expiry > now {
+			continue
+		}
+		id, err := gc.ab.keys.decode(ds.RawKey(result.Key).Name())
+		if err != nil {
+			gc.ab.log.Warningf("failed while decoding peer ID from key: %v, err: %v", result.Key, err)
+			continue
+		}
+		// the record is loaded again under the lock, as it may have been replaced since it was read.
+		if _, err = gc.ab.expireCertified(id); err != nil {
+			gc.ab.log.Warningf("failed to delete expired peer record with key: %v, err: %v", result.Key, err)
+		}
+	}
+	return nil
+}
+
+// sweepStore visits all entries in the datastore, deleting the addresses that have expired. Failures to process
+// individual entries are logged; failures to access the datastore are returned. To be called while holding the
+// running semaphore.
+func (gc *dsAddrBookGc) sweepStore() error {
+	defer func(start time.Time) { gc.ab.metrics.SweepDuration(time.Since(start)) }(time.Now())
+
 	record := &addrsRecord{AddrBookRecord: &pb.AddrBookRecord{}} // empty record to reuse and avoid allocs.
-	batch, err := newCyclicBatch(gc.ab.ds, defaultOpsPerCyclicBatch)
+	batch, err := newCyclicBatch(gc.ab.ds, gc.ab.batchSize())
 	if err != nil {
-		log.Warningf("failed while creating batch to purge GC entries: %v", err)
+		return fmt.Errorf("failed while creating batch to purge GC entries: %v", err)
 	}
 
-	results, err := gc.ab.ds.Query(purgeStoreQuery)
+	results, err := gc.ab.scan(purgeStoreQuery)
 	if err != nil {
-		log.Warningf("failed while opening iterator: %v", err)
-		return
+		return fmt.Errorf("failed while opening iterator: %v", err)
 	}
 	defer results.Close()
 
 	// keys: 	/peers/addrs/<peer ID b32>
 	for result := range results.Next() {
 		record.Reset()
-		if err = record.Unmarshal(result.Value); err != nil {
-			// TODO log
+		if err = gc.ab.codec.Unmarshal(result.Value, record.AddrBookRecord); err != nil {
+			gc.ab.metrics.CorruptRecord()
+			gc.ab.log.Warningf("failed while unmarshalling record with key: %v, err: %v", result.Key, err)
+			if gc.ab.opts.DeleteCorruptRecords {
+				if err = batch.Delete(ds.RawKey(result.Key)); err != nil {
+					gc.ab.log.Warningf("failed to delete undecodable record with key: %v, err: %v", result.Key, err)
+				}
+			}
 			continue
 		}
 
 		id := record.Id.ID
-		if !record.clean() {
+
+		// if the record is in cache, we clean that instance instead, so that expirations are only reported once.
+		if e, ok := gc.ab.cache.Peek(id); ok {
+			cached := e.(*addrsRecord)
+			cached.Lock()
+			if gc.ab.clean(cached) {
+				if err := gc.ab.flushRecord(batch, cached); err != nil {
+					gc.ab.log.Warningf("failed to flush entry modified by GC for peer: %v, err: %v", id, err)
+				}
+			}
+			cached.Unlock()
+			continue
+		}
+
+		if !gc.ab.clean(record) {
 			continue
 		}
 
-		if err := record.flush(batch); err != nil {
-			log.Warningf("failed to flush entry modified by GC for peer: &v, err: %v", id, err)
+		if err := gc.ab.flushRecord(batch, record); err != nil {
+			gc.ab.log.Warningf("failed to flush entry modified by GC for peer: %v, err: %v", id, err)
 		}
 		gc.ab.cache.Remove(id)
 	}
 
 	if err = batch.Commit(); err != nil {
-		log.Warningf("failed to commit GC purge batch: %v", err)
+		return fmt.Errorf("failed to commit GC purge batch: %v", err)
+	}
+	return nil
+}
+
+// compact deletes the address records and GC lookahead entries that have been leaked, along with the known peer marks
+// past their retention, and returns their keys. See dsAddrBook.GC. In a dry run, the keys are returned without deleting
+// anything.
+func (gc *dsAddrBookGc) compact(ctx context.Context, dryRun bool) (removed []ds.Key, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	select {
+	case gc.running <- struct{}{}:
+		defer func() { <-gc.running }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	var batch ds.Batch
+	if !dryRun {
+		if batch, err = newCyclicBatch(gc.ab.ds, gc.ab.batchSize()); err != nil {
+			return nil, fmt.Errorf("failed while creating batch to compact store: %v", err)
+		}
+	}
+
+	drop := func(key ds.Key, reason string) {
+		if dryRun {
+			removed = append(removed, key)
+			return
+		}
+		gc.ab.log.Infof("deleting leaked entry with key: %v; %s", key, reason)
+		if err := batch.Delete(key); err != nil {
+			gc.ab.log.Warningf("failed to delete leaked entry with key: %v, err: %v", key, err)
+			return
+		}
+		removed = append(removed, key)
+	}
+
+	// keys: 	/peers/addrs/<peer ID b32>
+	record := &addrsRecord{AddrBookRecord: &pb.AddrBookRecord{}}
+	err = gc.visit(ctx, purgeStoreQuery, func(result query.Result) {
+		key := ds.RawKey(result.Key)
+		record.Reset()
+		if err := gc.ab.codec.Unmarshal(result.Value, record.AddrBookRecord); err != nil {
+			drop(key, "undecodable record")
+			return
+		}
+		// this also catches keys that aren't valid peer key encodings.
+		if record.Id == nil || gc.ab.keys.encode(record.Id.ID) != key.Name() {
+			drop(key, "record belongs to another peer")
+			return
+		}
+		if len(record.Addrs) == 0 {
+			drop(key, "record holds no addresses")
+			if !dryRun {
+				gc.ab.cache.Remove(record.Id.ID)
+			}
+		}
+	})
+	if err != nil {
+		return removed, err
+	}
+
+	// keys: 	/peers/gc/addrs/<unix timestamp of next visit>/<peer ID b32>
+	// 		/peers/gc/certified/<unix timestamp of expiry>/<peer ID b32>
+	stale := gc.ab.clock.Now().Add(-gc.ab.opts.GCLookaheadInterval).Unix()
+	dropStale := func(result query.Result) {
+		gcKey := ds.RawKey(result.Key)
+		if !gc.lookaheadEnabled {
+			drop(gcKey, "lookahead is disabled")
+			return
+		}
+		ts, err := strconv.ParseInt(gcKey.Parent().Name(), 10, 64)
+		if err != nil {
+			drop(gcKey, "unparseable timestamp")
+			return
+		}
+		if _, err = gc.ab.keys.decode(gcKey.Name()); err != nil {
+			drop(gcKey, "unparseable peer ID")
+			return
+		}
+		if ts < stale {
+			drop(gcKey, "entry outlived its lookahead window")
+		}
+	}
+	for _, q := range []query.Query{purgeLookaheadQuery, purgeCertifiedLookaheadQuery} {
+		if err = gc.visit(ctx, q, dropStale); err != nil {
+			return removed, err
+		}
+	}
+
+	// keys: 	/peers/index/addrs/<peer ID b32>
+	if gc.ab.opts.IndexAddrs {
+		err = gc.visit(ctx, purgeIndexQuery, func(result query.Result) {
+			key := ds.RawKey(result.Key)
+			if has, err := gc.ab.ds.Has(addrBookBase.ChildString(key.Name())); err == nil && !has {
+				drop(key, "index entry of a missing record")
+			}
+		})
+		if err != nil {
+			return removed, err
+		}
+	}
+
+	// keys: 	/peers/known/<peer ID b32>
+	if gc.ab.opts.KnownPeersRetention > 0 {
+		now := gc.ab.clock.Now().Unix()
+		err = gc.visit(ctx, purgeKnownQuery, func(result query.Result) {
+			if key := ds.RawKey(result.Key); gc.ab.forgettable(key, result.Value, now) {
+				drop(key, "known peer outlived its retention")
+			}
+		})
+	}
+	if err != nil || dryRun {
+		return removed, err
+	}
+
+	if err = batch.Commit(); err != nil {
+		return removed, fmt.Errorf("failed to commit compaction batch: %v", err)
+	}
+	return removed, nil
+}
+
+// visit runs a query, calling fn for every result, until the results are exhausted or the context is done.
+func (gc *dsAddrBookGc) visit(ctx context.Context, q query.Query, fn func(query.Result)) error {
+	results, err := gc.ab.ds.Query(q)
+	if err != nil {
+		return fmt.Errorf("failed while opening iterator: %v", err)
+	}
+	defer results.Close()
+
+	ch := results.Next()
+	for {
+		select {
+		case result, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if result.Error != nil {
+				return fmt.Errorf("failed while iterating entries: %v", result.Error)
+			}
+			fn(result)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 }
 
@@ -317,45 +659,41 @@ func (gc *dsAddrBookGc) populateLookahead() {
 		return
 	}
 
-	until := time.Now().Add(gc.ab.opts.GCLookaheadInterval).Unix()
+	until := gc.ab.clock.Now().Add(gc.ab.opts.GCLookaheadInterval).Unix()
 
 	var id peer.ID
 	record := &addrsRecord{AddrBookRecord: &pb.AddrBookRecord{}}
 	results, err := gc.ab.ds.Query(populateLookaheadQuery)
 	if err != nil {
-		log.Warningf("failed while querying to populate lookahead GC window: %v", err)
+		gc.ab.log.Warningf("failed while querying to populate lookahead GC window: %v", err)
 		return
 	}
 	defer results.Close()
 
-	batch, err := newCyclicBatch(gc.ab.ds, defaultOpsPerCyclicBatch)
+	batch, err := newCyclicBatch(gc.ab.ds, gc.ab.batchSize())
 	if err != nil {
-		log.Warningf("failed while creating batch to populate lookahead GC window: %v", err)
+		gc.ab.log.Warningf("failed while creating batch to populate lookahead GC window: %v", err)
 		return
 	}
 
 	for result := range results.Next() {
 		idb32 := ds.RawKey(result.Key).Name()
-		k, err := b32.RawStdEncoding.DecodeString(idb32)
-		if err != nil {
-			log.Warningf("failed while decoding peer ID from key: %v, err: %v", result.Key, err)
+		if id, err = gc.ab.keys.decode(idb32); err != nil {
+			gc.ab.log.Warningf("failed while decoding peer ID from key: %v, err: %v", result.Key, err)
 			continue
 		}
-		if id, err = peer.IDFromBytes(k); err != nil {
-			log.Warningf("failed while decoding peer ID from key: %v, err: %v", result.Key, err)
-		}
 
 		// if the record is in cache, use the cached version.
 		if e, ok := gc.ab.cache.Peek(id); ok {
 			cached := e.(*addrsRecord)
 			cached.RLock()
-			if len(cached.Addrs) == 0 || cached.Addrs[0].Expiry > until {
+			if len(cached.Addrs) == 0 || gc.ab.purgeAt(cached.Addrs[0]) > until {
 				cached.RUnlock()
 				continue
 			}
-			gcKey := gcLookaheadBase.ChildString(fmt.Sprintf("%d/%s", cached.Addrs[0].Expiry, idb32))
+			gcKey := gcLookaheadBase.ChildString(fmt.Sprintf("%d/%s", gc.ab.purgeAt(cached.Addrs[0]), idb32))
 			if err = batch.Put(gcKey, []byte{}); err != nil {
-				log.Warningf("failed while inserting GC entry for peer: %v, err: %v", id.Pretty(), err)
+				gc.ab.log.Warningf("failed while inserting GC entry for peer: %v, err: %v", id.Pretty(), err)
 			}
 			cached.RUnlock()
 			continue
@@ -365,24 +703,59 @@ func (gc *dsAddrBookGc) populateLookahead() {
 
 		val, err := gc.ab.ds.Get(ds.RawKey(result.Key))
 		if err != nil {
-			log.Warningf("failed which getting record from store for peer: %v, err: %v", id.Pretty(), err)
+			gc.ab.log.Warningf("failed which getting record from store for peer: %v, err: %v", id.Pretty(), err)
 			continue
 		}
-		if err := record.Unmarshal(val); err != nil {
-			log.Warningf("failed while unmarshalling record from store for peer: %v, err: %v", id.Pretty(), err)
+		if err := gc.ab.codec.Unmarshal(val, record.AddrBookRecord); err != nil {
+			gc.ab.log.Warningf("failed while unmarshalling record from store for peer: %v, err: %v", id.Pretty(), err)
 			continue
 		}
-		if len(record.Addrs) > 0 && record.Addrs[0].Expiry <= until {
-			gcKey := gcLookaheadBase.ChildString(fmt.Sprintf("%d/%s", record.Addrs[0].Expiry, idb32))
+		if len(record.Addrs) > 0 && gc.ab.purgeAt(record.Addrs[0]) <= until {
+			gcKey := gcLookaheadBase.ChildString(fmt.Sprintf("%d/%s", gc.ab.purgeAt(record.Addrs[0]), idb32))
 			if err = batch.Put(gcKey, []byte{}); err != nil {
-				log.Warningf("failed while inserting GC entry for peer: %v, err: %v", id.Pretty(), err)
+				gc.ab.log.Warningf("failed while inserting GC entry for peer: %v, err: %v", id.Pretty(), err)
 			}
 		}
 	}
 
+	if !gc.ab.nativeTTL {
+		gc.populateCertifiedLookahead(batch, until)
+	}
+
 	if err = batch.Commit(); err != nil {
-		log.Warningf("failed to commit GC lookahead batch: %v", err)
+		gc.ab.log.Warningf("failed to commit GC lookahead batch: %v", err)
 	}
 
 	gc.currWindowEnd = until
 }
+
+// populateCertifiedLookahead schedules the signed peer records that expire by until in the lookahead window.
+func (gc *dsAddrBookGc) populateCertifiedLookahead(batch ds.Batch, until int64) {
+	results, err := gc.ab.scan(purgeCertifiedQuery)
+	if err != nil {
+		gc.ab.log.Warningf("failed while querying peer records to populate lookahead GC window: %v", err)
+		return
+	}
+	defer results.Close()
+
+	// keys: 	/peers/certified/<peer ID b32>
+	cr := new(pb.CertifiedRecord)
+	for result := range results.Next() {
+		if result.Error != nil {
+			gc.ab.log.Warningf("failed while iterating peer records to populate lookahead GC window: %v", result.Error)
+			return
+		}
+		cr.Reset()
+		if err := cr.Unmarshal(result.Value); err != nil {
+			gc.ab.log.Warningf("failed while decoding peer record with key: %v, err: %v", result.Key, err)
+			continue
+		}
+		if cr.Expiry > until {
+			continue
+		}
+		gcKey := gcCertifiedBase.ChildString(fmt.Sprintf("%d/%s", cr.Expiry, ds.RawKey(result.Key).Name()))
+		if err = batch.Put(gcKey, []byte{}); err != nil {
+			gc.ab.log.Warningf("failed while inserting GC entry for peer record with key: %v, err: %v", result.Key, err)
+		}
+	}
+}
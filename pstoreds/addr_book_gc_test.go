@@ -1,12 +1,21 @@
 package pstoreds
 
 import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
+	ds "github.com/ipfs/go-datastore"
 	query "github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	peer "github.com/libp2p/go-libp2p-peer"
 	pstore "github.com/libp2p/go-libp2p-peerstore"
+	pb "github.com/libp2p/go-libp2p-peerstore/pb"
 	test "github.com/libp2p/go-libp2p-peerstore/test"
+	b32 "github.com/multiformats/go-base32"
 	ma "github.com/multiformats/go-multiaddr"
 )
 
@@ -147,6 +156,88 @@ func TestGCPurging(t *testing.T) {
 	}
 }
 
+func TestGCPermanentAddrs(t *testing.T) {
+	clock := newMockClock()
+
+	opts := DefaultOpts()
+	opts.GCInitialDelay = 90 * time.Hour
+	opts.GCLookaheadInterval = 10 * time.Second
+	opts.GCPurgeInterval = 1 * time.Second
+	opts.Clock = clock
+
+	factory := addressBookFactory(t, badgerStore, opts)
+	ab, closeFn := factory()
+	gc := ab.(*dsAddrBook).gc
+	defer closeFn()
+
+	tp := &testProbe{t, ab}
+
+	ids := test.GeneratePeerIDs(2)
+	addrs := test.GenerateAddrs(2)
+
+	ab.AddAddr(ids[0], addrs[0], pstore.PermanentAddrTTL)
+	ab.AddAddr(ids[1], addrs[1], time.Second)
+
+	// permanent addresses never fall into a lookahead window, so they cost nothing to lookahead GC.
+	gc.populateLookahead()
+	if i := tp.countLookaheadEntries(); i != 1 {
+		t.Errorf("expected 1 GC lookahead entry, got: %v", i)
+	}
+
+	clock.Advance(10 * 365 * 24 * time.Hour)
+	tp.clearCache()
+	gc.purgeStore()
+
+	test.AssertAddressesEqual(t, addrs[:1], ab.Addrs(ids[0]))
+	test.AssertAddressesEqual(t, nil, ab.Addrs(ids[1]))
+
+	// permanent addresses can still be cleared.
+	ab.ClearAddrs(ids[0])
+	test.AssertAddressesEqual(t, nil, ab.Addrs(ids[0]))
+	if i := len(ab.PeersWithAddrs()); i != 0 {
+		t.Errorf("expected no entries in database, got: %v", i)
+	}
+}
+
+func TestGCAdaptivePurgeDelay(t *testing.T) {
+	clock := newMockClock()
+
+	opts := DefaultOpts()
+	opts.GCInitialDelay = 90 * time.Hour
+	opts.GCLookaheadInterval = time.Hour
+	opts.GCPurgeInterval = 10 * time.Minute
+	opts.GCMinPurgeInterval = 10 * time.Second
+	opts.Clock = clock
+
+	factory := addressBookFactory(t, badgerStore, opts)
+	ab, closeFn := factory()
+	gc := ab.(*dsAddrBook).gc
+	defer closeFn()
+
+	ids := test.GeneratePeerIDs(2)
+	addrs := test.GenerateAddrs(2)
+
+	// with nothing in the window, purges back off to the max interval.
+	gc.populateLookahead()
+	if d := gc.nextPurgeDelay(); d != opts.GCPurgeInterval {
+		t.Errorf("expected delay of %v, got: %v", opts.GCPurgeInterval, d)
+	}
+
+	// the purge is timed to the earliest expiry.
+	ab.AddAddr(ids[0], addrs[0], 2*time.Minute)
+	gc.populateLookahead()
+	if d := gc.nextPurgeDelay(); d != 2*time.Minute {
+		t.Errorf("expected delay of 2m, got: %v", d)
+	}
+
+	// but never sooner than the min interval.
+	ab.AddAddr(ids[1], addrs[1], time.Second)
+	gc.populateLookahead()
+	if d := gc.nextPurgeDelay(); d != opts.GCMinPurgeInterval {
+		t.Errorf("expected delay of %v, got: %v", opts.GCMinPurgeInterval, d)
+	}
+}
+
 func TestGCDelay(t *testing.T) {
 	ids := test.GeneratePeerIDs(10)
 	addrs := test.GenerateAddrs(100)
@@ -163,7 +254,8 @@ func TestGCDelay(t *testing.T) {
 
 	tp := &testProbe{t, ab}
 
-	ab.AddAddrs(ids[0], addrs, 1*time.Second)
+	// the TTL falls within the lookahead window, but outlives the initial delay, as badger expires records natively.
+	ab.AddAddrs(ids[0], addrs, 30*time.Second)
 
 	// immediately after we should be having no lookahead entries.
 	if i := tp.countLookaheadEntries(); i != 0 {
@@ -222,6 +314,96 @@ func TestGCLookaheadDisabled(t *testing.T) {
 	test.AssertAddressesEqual(t, addrs[40:], ab.Addrs(ids[3]))
 }
 
+func assertKeysEqual(t *testing.T, exp, act []ds.Key) {
+	t.Helper()
+
+	sorted := func(keys []ds.Key) []string {
+		strs := make([]string, 0, len(keys))
+		for _, k := range keys {
+			strs = append(strs, k.String())
+		}
+		sort.Strings(strs)
+		return strs
+	}
+	if e, a := sorted(exp), sorted(act); strings.Join(e, ",") != strings.Join(a, ",") {
+		t.Fatalf("expected keys %v, got %v", e, a)
+	}
+}
+
+func TestGCCompact(t *testing.T) {
+	ids := test.GeneratePeerIDs(3)
+	addrs := test.GenerateAddrs(1)
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0 // lookahead stays disabled.
+
+	factory := addressBookFactory(t, badgerStore, opts)
+	ab, closeFn := factory()
+	defer closeFn()
+
+	dsab := ab.(*dsAddrBook)
+	tp := &testProbe{t, ab}
+
+	ab.AddAddrs(ids[0], addrs, time.Hour)
+
+	key := func(id peer.ID) ds.Key {
+		return addrBookBase.ChildString(b32.RawStdEncoding.EncodeToString([]byte(id)))
+	}
+	valid, err := dsab.ds.Get(key(ids[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// leak an undecodable record, a record stored under the wrong peer, and a lookahead entry.
+	leaked := []ds.Key{
+		key(ids[1]),
+		key(ids[2]),
+		gcLookaheadBase.ChildString(fmt.Sprintf("%d/%s", time.Now().Unix(), key(ids[0]).Name())),
+	}
+	for k, v := range map[ds.Key][]byte{leaked[0]: []byte("garbage"), leaked[1]: valid, leaked[2]: {}} {
+		if err := dsab.ds.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a preview lists the leaked entries, and leaves them in place.
+	preview, err := dsab.GCPreview(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertKeysEqual(t, leaked, preview)
+	for _, k := range leaked {
+		if has, _ := dsab.ds.Has(k); !has {
+			t.Fatalf("expected leaked entry to be left in place by the preview: %v", k)
+		}
+	}
+
+	removed, err := dsab.GC(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != len(leaked) {
+		t.Fatalf("expected %d leaked entries to be removed, got: %d", len(leaked), removed)
+	}
+	for _, k := range leaked {
+		if has, _ := dsab.ds.Has(k); has {
+			t.Fatalf("expected leaked entry to be removed: %v", k)
+		}
+	}
+	if i := tp.countLookaheadEntries(); i != 0 {
+		t.Errorf("expected no GC lookahead entries, got: %v", i)
+	}
+
+	tp.clearCache()
+	test.AssertAddressesEqual(t, addrs, ab.Addrs(ids[0]))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := dsab.GC(ctx); err != context.Canceled {
+		t.Fatalf("expected context error, got: %v", err)
+	}
+}
+
 func BenchmarkLookaheadCycle(b *testing.B) {
 	ids := test.GeneratePeerIDs(100)
 	addrs := test.GenerateAddrs(100)
@@ -252,3 +434,80 @@ func BenchmarkLookaheadCycle(b *testing.B) {
 		ab.(*dsAddrBook).gc.populateLookahead()
 	}
 }
+
+func TestPeerRecordsGC(t *testing.T) {
+	ids := test.GeneratePeerIDs(2)
+	addrs := test.GenerateAddrs(2)
+
+	records := map[string]*PeerRecord{
+		"short": {PeerID: ids[0], Seq: 1, Addrs: addrs[:1]},
+		"long":  {PeerID: ids[1], Seq: 1, Addrs: addrs[1:]},
+	}
+
+	for _, lookahead := range []time.Duration{0, time.Hour} {
+		t.Run(fmt.Sprintf("Lookahead=%v", lookahead), func(t *testing.T) {
+			clock := newMockClock()
+			opts := DefaultOpts()
+			opts.GCPurgeInterval = 0
+			opts.GCLookaheadInterval = lookahead
+			opts.Clock = clock
+			opts.PeerRecordUnmarshaler = func(envelope []byte) (*PeerRecord, error) {
+				return records[string(envelope)], nil
+			}
+
+			// map datastores lack native TTLs, so expired records are left for GC to purge.
+			ab, err := NewAddrBook(context.Background(), dssync.MutexWrap(ds.NewMapDatastore()), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ab.Close()
+
+			for envelope, ttl := range map[string]time.Duration{"short": 10 * time.Minute, "long": 2 * time.Hour} {
+				if accepted, err := ab.ConsumePeerRecord([]byte(envelope), ttl); !accepted || err != nil {
+					t.Fatalf("expected record to be accepted, err: %v", err)
+				}
+			}
+
+			// records are stored in protobuf.
+			data, err := ab.ds.Get(ab.certifiedKey(ids[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var cr pb.CertifiedRecord
+			if err = cr.Unmarshal(data); err != nil || string(cr.Envelope) != "short" || cr.Seq != 1 {
+				t.Fatalf("expected a protobuf encoded record, got: %v, err: %v", cr, err)
+			}
+
+			scheduled := func() (n int) {
+				results, err := ab.ds.Query(purgeCertifiedLookaheadQuery)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer results.Close()
+				for range results.Next() {
+					n++
+				}
+				return n
+			}
+
+			// only the record expiring within the window is scheduled.
+			ab.gc.populateLookahead()
+			if lookahead > 0 {
+				if n := scheduled(); n != 1 {
+					t.Fatalf("expected 1 peer record scheduled in the lookahead window, got: %d", n)
+				}
+			}
+
+			clock.Advance(11 * time.Minute)
+			ab.gc.purgeCertified()
+			for i, held := range []bool{false, true} {
+				if has, err := ab.ds.Has(ab.certifiedKey(ids[i])); err != nil || has != held {
+					t.Fatalf("expected peer record %d to be held: %v, got: %v, err: %v", i, held, has, err)
+				}
+			}
+			if n := scheduled(); n != 0 {
+				t.Fatalf("expected visited lookahead entries to be dropped, got: %d", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,2535 @@
+package pstoreds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+
+	lru "github.com/hashicorp/golang-lru"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	b32 "github.com/multiformats/go-base32"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+
+	addr "github.com/libp2p/go-libp2p-peerstore/addr"
+	pstoremem "github.com/libp2p/go-libp2p-peerstore/pstoremem"
+	test "github.com/libp2p/go-libp2p-peerstore/test"
+)
+
+func receiveAddrs(t *testing.T, ch <-chan ma.Multiaddr, n int) []ma.Multiaddr {
+	t.Helper()
+	var addrs []ma.Multiaddr
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < n; i++ {
+		select {
+		case a := <-ch:
+			addrs = append(addrs, a)
+		case <-timeout:
+			t.Fatalf("timed out after receiving %d of %d addresses", len(addrs), n)
+		}
+	}
+	return addrs
+}
+
+func TestAddrBatchStream(t *testing.T) {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+
+	ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn()
+	dsab := ab.(*dsAddrBook)
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(4)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	batches := dsab.AddrBatchStream(ctx, id)
+	single := ab.AddrStream(ctx, id)
+
+	expect := func(want []ma.Multiaddr) {
+		t.Helper()
+		select {
+		case got := <-batches:
+			test.AssertAddressesEqual(t, want, got)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for address batch")
+		}
+	}
+
+	// a bulk insert is published as a single batch, and still address by address on the address stream.
+	ab.AddAddrs(id, addrs[:3], time.Hour)
+	expect(addrs[:3])
+	test.AssertAddressesEqual(t, addrs[:3], receiveAddrs(t, single, 3))
+
+	// only new addresses are published.
+	ab.AddAddrs(id, addrs, time.Hour)
+	expect(addrs[3:])
+	test.AssertAddressesEqual(t, addrs[3:], receiveAddrs(t, single, 1))
+}
+
+func TestAddrExpiryStream(t *testing.T) {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+
+	ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn()
+	dsab := ab.(*dsAddrBook)
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := dsab.AddrExpiryStream(ctx, id)
+
+	ab.AddAddrs(id, addrs, time.Hour)
+
+	// removing two addresses via a negative TTL notifies both of them.
+	ab.SetAddrs(id, addrs[:2], -1)
+	test.AssertAddressesEqual(t, addrs[:2], receiveAddrs(t, ch, 2))
+	test.AssertAddressesEqual(t, addrs[2:], ab.Addrs(id))
+
+	// an address that expires is notified when the record is next cleaned.
+	ab.SetAddr(id, addrs[2], time.Second)
+	time.Sleep(1100 * time.Millisecond)
+	test.AssertAddressesEqual(t, addrs[3:], ab.Addrs(id))
+	test.AssertAddressesEqual(t, addrs[2:3], receiveAddrs(t, ch, 1))
+
+	// clearing notifies all remaining addresses.
+	ab.ClearAddrs(id)
+	test.AssertAddressesEqual(t, addrs[3:], receiveAddrs(t, ch, 2))
+
+	cancel()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("expected no further expiry notifications")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected channel to be closed after context cancellation")
+	}
+}
+
+func TestAddAddrsMany(t *testing.T) {
+	for name, cacheSize := range map[string]uint{"Cacheful": 1024, "Cacheless": 0} {
+		t.Run(name, func(t *testing.T) {
+			opts := DefaultOpts()
+			opts.CacheSize = cacheSize
+
+			ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+			defer closeFn()
+			dsab := ab.(*dsAddrBook)
+
+			ids := test.GeneratePeerIDs(3)
+			addrs := test.GenerateAddrs(9)
+
+			// the first peer already holds one of the addresses we'll add in bulk.
+			ab.AddAddr(ids[0], addrs[0], time.Hour)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ch := ab.AddrStream(ctx, ids[0])
+			test.AssertAddressesEqual(t, addrs[0:1], receiveAddrs(t, ch, 1))
+
+			err := dsab.AddAddrsMany(map[peer.ID][]ma.Multiaddr{
+				ids[0]: addrs[0:3],
+				ids[1]: addrs[3:6],
+				ids[2]: addrs[6:9],
+			}, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			test.AssertAddressesEqual(t, addrs[0:3], ab.Addrs(ids[0]))
+			test.AssertAddressesEqual(t, addrs[3:6], ab.Addrs(ids[1]))
+			test.AssertAddressesEqual(t, addrs[6:9], ab.Addrs(ids[2]))
+
+			// only the two addresses that were new are broadcast.
+			test.AssertAddressesEqual(t, addrs[1:3], receiveAddrs(t, ch, 2))
+		})
+	}
+}
+
+func TestClearAddrsMany(t *testing.T) {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+
+	ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn()
+	dsab := ab.(*dsAddrBook)
+
+	ids := test.GeneratePeerIDs(4)
+	addrs := test.GenerateAddrs(4)
+	for i := 0; i < 3; i++ {
+		ab.AddAddr(ids[i], addrs[i], time.Hour)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := dsab.AddrExpiryStream(ctx, ids[0])
+
+	// the last peer holds no addresses, and must be tolerated.
+	if err := dsab.ClearAddrsMany([]peer.ID{ids[0], ids[1], ids[3]}); err != nil {
+		t.Fatal(err)
+	}
+
+	test.AssertAddressesEqual(t, addrs[0:1], receiveAddrs(t, ch, 1))
+	for _, p := range []peer.ID{ids[0], ids[1], ids[3]} {
+		if len(ab.Addrs(p)) != 0 {
+			t.Fatalf("expected no addrs for peer %s", p.Pretty())
+		}
+	}
+	test.AssertAddressesEqual(t, addrs[2:3], ab.Addrs(ids[2]))
+	if peers := ab.PeersWithAddrs(); len(peers) != 1 || peers[0] != ids[2] {
+		t.Fatalf("expected only peer %s to hold addrs, got %v", ids[2].Pretty(), peers)
+	}
+}
+
+func TestPopulateFrom(t *testing.T) {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+
+	ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn()
+	dsab := ab.(*dsAddrBook)
+
+	ids := test.GeneratePeerIDs(3)
+	addrs := test.GenerateAddrs(6)
+
+	src := pstoremem.NewAddrBook()
+	src.AddAddrs(ids[0], addrs[0:2], time.Hour)
+	src.AddAddrs(ids[1], addrs[2:4], time.Hour)
+
+	// addresses already held are kept.
+	ab.AddAddrs(ids[0], addrs[4:6], time.Hour)
+
+	if err := dsab.PopulateFrom(src, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	test.AssertAddressesEqual(t, append(addrs[0:2:2], addrs[4:6]...), ab.Addrs(ids[0]))
+	test.AssertAddressesEqual(t, addrs[2:4], ab.Addrs(ids[1]))
+	if len(ab.Addrs(ids[2])) != 0 {
+		t.Fatal("expected no addrs for a peer missing from the source")
+	}
+}
+
+func TestNormalizeAddr(t *testing.T) {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	// strip the trailing /p2p component, and drop loopback addresses altogether.
+	opts.NormalizeAddr = func(addr ma.Multiaddr) ma.Multiaddr {
+		if _, err := addr.ValueForProtocol(ma.P_IP4); err == nil && manet.IsIPLoopback(addr) {
+			return nil
+		}
+		base, _ := ma.SplitLast(addr)
+		if _, err := addr.ValueForProtocol(ma.P_P2P); err == nil {
+			return base
+		}
+		return addr
+	}
+
+	ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn()
+
+	id := test.GeneratePeerIDs(1)[0]
+	plain := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	suffixed := plain.Encapsulate(ma.StringCast("/p2p/" + id.Pretty()))
+	loopback := ma.StringCast("/ip4/127.0.0.1/tcp/4001")
+
+	ab.AddAddrs(id, []ma.Multiaddr{plain, suffixed, loopback}, time.Hour)
+	test.AssertAddressesEqual(t, []ma.Multiaddr{plain}, ab.Addrs(id))
+
+	// removals are normalized too.
+	ab.SetAddr(id, suffixed, 0)
+	if addrs := ab.Addrs(id); len(addrs) != 0 {
+		t.Fatalf("expected no addrs, got %v", addrs)
+	}
+}
+
+// commitCountingStore counts the batches committed against a datastore.
+type commitCountingStore struct {
+	ds.Batching
+	commits int32
+}
+
+type commitCountingBatch struct {
+	ds.Batch
+	store *commitCountingStore
+}
+
+func (s *commitCountingStore) Batch() (ds.Batch, error) {
+	b, err := s.Batching.Batch()
+	if err != nil {
+		return nil, err
+	}
+	return &commitCountingBatch{Batch: b, store: s}, nil
+}
+
+func (b *commitCountingBatch) Commit() error {
+	atomic.AddInt32(&b.store.commits, 1)
+	return b.Batch.Commit()
+}
+
+func TestMaxBatchSize(t *testing.T) {
+	for name, tc := range map[string]struct {
+		max, commits int32
+	}{
+		"Unbounded": {0, 1},
+		"Bounded":   {3, 4},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := &commitCountingStore{Batching: dssync.MutexWrap(ds.NewMapDatastore())}
+
+			opts := DefaultOpts()
+			opts.GCPurgeInterval = 0
+			opts.MaxBatchSize = int(tc.max)
+			ab, err := NewAddrBook(context.Background(), store, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ab.Close()
+
+			ids := test.GeneratePeerIDs(10)
+			addrs := test.GenerateAddrs(10)
+			many := make(map[peer.ID][]ma.Multiaddr, len(ids))
+			for i, id := range ids {
+				many[id] = addrs[i : i+1]
+			}
+			if err = ab.AddAddrsMany(many, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+
+			if commits := atomic.LoadInt32(&store.commits); commits != tc.commits {
+				t.Fatalf("expected %d commits, got %d", tc.commits, commits)
+			}
+			for i, id := range ids {
+				test.AssertAddressesEqual(t, addrs[i:i+1], ab.Addrs(id))
+			}
+		})
+	}
+}
+
+func TestCacheIntrospection(t *testing.T) {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+
+	ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn()
+	dsab := ab.(*dsAddrBook)
+
+	ids := test.GeneratePeerIDs(2)
+	addrs := test.GenerateAddrs(2)
+
+	if size, keys := dsab.CacheStats(); size != 0 || len(keys) != 0 {
+		t.Fatalf("expected an empty cache, got %d records", size)
+	}
+
+	ab.AddAddrs(ids[0], addrs, time.Hour)
+	if size, keys := dsab.CacheStats(); size != 1 || keys[0] != ids[0] {
+		t.Fatalf("expected only peer %s to be cached, got %v", ids[0].Pretty(), keys)
+	}
+
+	cached, ok := dsab.CachedAddrs(ids[0])
+	if !ok {
+		t.Fatal("expected the record to be cached")
+	}
+	test.AssertAddressesEqual(t, addrs, cached)
+
+	// peers that aren't cached aren't loaded from the store either.
+	if _, ok := dsab.CachedAddrs(ids[1]); ok {
+		t.Fatal("expected the record not to be cached")
+	}
+	if size, _ := dsab.CacheStats(); size != 1 {
+		t.Fatalf("expected 1 cached record, got %d", size)
+	}
+}
+
+func TestCacheByAddr(t *testing.T) {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.CacheSize = 5
+	opts.CacheSizeMode = CacheByAddr
+
+	ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn()
+	dsab := ab.(*dsAddrBook)
+
+	ids := test.GeneratePeerIDs(3)
+	addrs := test.GenerateAddrs(5)
+
+	ab.AddAddrs(ids[0], addrs[:3], time.Hour)
+	ab.AddAddrs(ids[1], addrs[3:], time.Hour)
+	_, keys := dsab.CacheStats()
+	assertPeersEqual(t, ids[:2], keys)
+
+	// the record growing past the bound evicts the least recently used one.
+	ab.AddAddrs(ids[1], addrs[:1], time.Hour)
+	_, keys = dsab.CacheStats()
+	assertPeersEqual(t, ids[1:2], keys)
+
+	// records holding no addresses count as one.
+	ab.Addrs(ids[2])
+	_, keys = dsab.CacheStats()
+	assertPeersEqual(t, ids[1:], keys)
+
+	// evicted records are read from the datastore again.
+	test.AssertAddressesEqual(t, addrs[:3], ab.Addrs(ids[0]))
+	_, keys = dsab.CacheStats()
+	assertPeersEqual(t, []peer.ID{ids[0], ids[2]}, keys)
+}
+
+func TestSharedSubManager(t *testing.T) {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.SubManager = pstoremem.NewAddrSubManager()
+
+	ab1, closeFn1 := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn1()
+	ab2, closeFn2 := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn2()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := ab1.AddrStream(ctx, id)
+
+	// writes handled by either book reach the subscribers of the other.
+	ab1.AddAddr(id, addrs[0], time.Hour)
+	ab2.AddAddr(id, addrs[1], time.Hour)
+	test.AssertAddressesEqual(t, addrs, receiveAddrs(t, ch, 2))
+}
+
+// slowStore delays returning reads, widening the window in which concurrent cache misses act on the same state.
+type slowStore struct {
+	ds.Batching
+	gets int32
+}
+
+func (s *slowStore) Get(key ds.Key) ([]byte, error) {
+	atomic.AddInt32(&s.gets, 1)
+	value, err := s.Batching.Get(key)
+	time.Sleep(5 * time.Millisecond)
+	return value, err
+}
+
+func TestConcurrentLoads(t *testing.T) {
+	store := &slowStore{Batching: dssync.MutexWrap(ds.NewMapDatastore())}
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(50)
+
+	// writes and reads race on loading the uncached record; none of the writes must be lost.
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(2)
+		go func(addr ma.Multiaddr) {
+			defer wg.Done()
+			ab.AddAddr(id, addr, time.Hour)
+		}(addr)
+		go func() {
+			defer wg.Done()
+			ab.Addrs(id)
+		}()
+	}
+	wg.Wait()
+
+	test.AssertAddressesEqual(t, addrs, ab.Addrs(id))
+
+	fresh, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	test.AssertAddressesEqual(t, addrs, fresh.Addrs(id))
+}
+
+func TestConcurrentMissesShareLoad(t *testing.T) {
+	store := &slowStore{Batching: dssync.MutexWrap(ds.NewMapDatastore())}
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(10)
+
+	populate, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	populate.AddAddrs(id, addrs, time.Hour)
+	populate.Close()
+
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	atomic.StoreInt32(&store.gets, 0)
+
+	const readers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			test.AssertAddressesEqual(t, addrs, ab.Addrs(id))
+		}()
+	}
+	wg.Wait()
+
+	// readers arriving in between the load completing and the record being cached may issue another read, but the
+	// bulk of them must have shared the first one.
+	if gets := atomic.LoadInt32(&store.gets); gets >= readers/10 {
+		t.Fatalf("expected concurrent cache misses to share datastore reads, got %d reads for %d readers", gets, readers)
+	}
+}
+
+func TestAddrFilter(t *testing.T) {
+	store, closeStore := badgerStore(t)
+	defer closeStore()
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+
+	id := test.GeneratePeerIDs(1)[0]
+	public := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	loopback := ma.StringCast("/ip4/127.0.0.1/tcp/4001")
+
+	// the loopback address is stored before the filter is in place.
+	unfiltered, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unfiltered.AddAddr(id, loopback, time.Hour)
+	unfiltered.Close()
+
+	opts.AddrFilter = addr.RejectPrivate
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	ab.AddAddrs(id, []ma.Multiaddr{public, ma.StringCast("/ip4/192.168.0.1/tcp/4001")}, time.Hour)
+	test.AssertAddressesEqual(t, []ma.Multiaddr{public, loopback}, ab.Addrs(id))
+
+	// addresses failing the filter can still be removed.
+	ab.SetAddr(id, loopback, 0)
+	test.AssertAddressesEqual(t, []ma.Multiaddr{public}, ab.Addrs(id))
+}
+
+type countingMetrics struct {
+	hits, misses, sweeps, expired, corrupt int32
+}
+
+func (m *countingMetrics) CacheHit()                   { atomic.AddInt32(&m.hits, 1) }
+func (m *countingMetrics) CacheMiss()                  { atomic.AddInt32(&m.misses, 1) }
+func (m *countingMetrics) SweepDuration(time.Duration) { atomic.AddInt32(&m.sweeps, 1) }
+func (m *countingMetrics) ExpiredCount(n int)          { atomic.AddInt32(&m.expired, int32(n)) }
+func (m *countingMetrics) CorruptRecord()              { atomic.AddInt32(&m.corrupt, 1) }
+
+func TestMetricsCollector(t *testing.T) {
+	m := new(countingMetrics)
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.Metrics = m
+
+	ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(2)
+
+	// the first access misses, and populates the cache.
+	ab.AddAddr(id, addrs[0], time.Hour)
+	ab.AddAddr(id, addrs[1], time.Second)
+	ab.Addrs(id)
+	if m.misses != 1 || m.hits != 2 {
+		t.Fatalf("expected 1 cache miss and 2 hits, got %d and %d", m.misses, m.hits)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	ab.(*dsAddrBook).gc.purgeStore()
+	if m.sweeps != 1 {
+		t.Fatalf("expected 1 sweep, got %d", m.sweeps)
+	}
+	if m.expired != 1 {
+		t.Fatalf("expected 1 expired address, got %d", m.expired)
+	}
+}
+
+func TestCorruptRecords(t *testing.T) {
+	for _, del := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Delete=%v", del), func(t *testing.T) {
+			m := new(countingMetrics)
+
+			opts := DefaultOpts()
+			opts.GCPurgeInterval = 0
+			opts.Metrics = m
+			opts.DeleteCorruptRecords = del
+
+			ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+			defer closeFn()
+			dsab := ab.(*dsAddrBook)
+
+			ids := test.GeneratePeerIDs(2)
+			addrs := test.GenerateAddrs(1)
+
+			for _, id := range ids {
+				key := addrBookBase.ChildString(b32.RawStdEncoding.EncodeToString([]byte(id)))
+				if err := dsab.ds.Put(key, []byte("garbage")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// the first record is found on access, and both of them during GC, unless the first one was deleted.
+			test.AssertAddressesEqual(t, nil, ab.Addrs(ids[0]))
+			dsab.gc.purgeStore()
+			want := int32(3)
+			if del {
+				want = 2
+			}
+			if m.corrupt != want {
+				t.Fatalf("expected %d corrupt records to be found, got %d", want, m.corrupt)
+			}
+
+			for _, id := range ids {
+				key := addrBookBase.ChildString(b32.RawStdEncoding.EncodeToString([]byte(id)))
+				if has, _ := dsab.ds.Has(key); has == del {
+					t.Fatalf("expected corrupt record to be deleted: %v, but it's held: %v", del, has)
+				}
+			}
+
+			// once deleted, a record can be written again.
+			if del {
+				ab.AddAddrs(ids[0], addrs, time.Hour)
+				test.AssertAddressesEqual(t, addrs, ab.Addrs(ids[0]))
+			}
+		})
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	store, closeStore := badgerStore(t)
+	defer closeStore()
+
+	cases := map[string]func(*Options){
+		"negative purge interval":  func(o *Options) { o.GCPurgeInterval = -time.Second },
+		"negative lookahead":       func(o *Options) { o.GCLookaheadInterval = -time.Second },
+		"negative initial delay":   func(o *Options) { o.GCInitialDelay = -time.Second },
+		"negative min purge":       func(o *Options) { o.GCMinPurgeInterval = -time.Second },
+		"min purge over purge":     func(o *Options) { o.GCMinPurgeInterval = 3 * time.Hour },
+		"lookahead under purge":    func(o *Options) { o.GCLookaheadInterval = time.Minute },
+		"negative ttl granularity": func(o *Options) { o.TTLGranularity = -time.Second },
+		"negative close timeout":   func(o *Options) { o.CloseTimeout = -time.Second },
+		"unknown overflow policy":  func(o *Options) { o.AddrStreamOverflow = 42 },
+		"negative ttl jitter":      func(o *Options) { o.TTLJitter = -0.1 },
+		"ttl jitter of 1":          func(o *Options) { o.TTLJitter = 1 },
+		"negative max batch size":  func(o *Options) { o.MaxBatchSize = -1 },
+		"negative scan chunk size": func(o *Options) { o.ScanChunkSize = -1 },
+		"negative addr history":    func(o *Options) { o.AddrHistorySize = -1 },
+		"negative cache ttl":       func(o *Options) { o.CacheTTL = -time.Second },
+		"negative grace period":    func(o *Options) { o.ExpiryGracePeriod = -time.Second },
+		"peer key encoding alone":  func(o *Options) { o.EncodePeerKey = func(peer.ID) string { return "" } },
+		"unknown cache size mode":  func(o *Options) { o.CacheSizeMode = 42 },
+	}
+	for name, modify := range cases {
+		t.Run(name, func(t *testing.T) {
+			opts := DefaultOpts()
+			modify(&opts)
+			if ab, err := NewAddrBook(context.Background(), store, opts); err == nil {
+				ab.Close()
+				t.Fatal("expected invalid options to be rejected")
+			}
+		})
+	}
+}
+
+func TestMaxAddrsPerPeer(t *testing.T) {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.MaxAddrsPerPeer = 3
+
+	ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	expiries := ab.(*dsAddrBook).AddrExpiryStream(ctx, id)
+
+	for i, a := range addrs[:4] {
+		ab.AddAddr(id, a, time.Duration(i+1)*time.Hour)
+	}
+	test.AssertAddressesEqual(t, addrs[1:4], ab.Addrs(id))
+
+	// an address that expires sooner than all others is rejected straight away.
+	ab.AddAddr(id, addrs[4], time.Minute)
+	test.AssertAddressesEqual(t, addrs[1:4], ab.Addrs(id))
+
+	test.AssertAddressesEqual(t, []ma.Multiaddr{addrs[0], addrs[4]}, receiveAddrs(t, expiries, 2))
+}
+
+func TestPeersWithAddrsPage(t *testing.T) {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+
+	ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn()
+	dsab := ab.(*dsAddrBook)
+
+	ids := test.GeneratePeerIDs(10)
+	addrs := test.GenerateAddrs(1)
+	for _, id := range ids {
+		ab.AddAddrs(id, addrs, time.Hour)
+	}
+
+	seen := make(map[peer.ID]struct{})
+	cursor, pages := "", 0
+	for {
+		page, next, err := dsab.PeersWithAddrsPage(cursor, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) > 3 {
+			t.Fatalf("page exceeds limit: %d", len(page))
+		}
+		for _, id := range page {
+			if _, ok := seen[id]; ok {
+				t.Fatalf("peer %s returned twice", id)
+			}
+			seen[id] = struct{}{}
+		}
+		pages++
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+
+	if len(seen) != len(ids) {
+		t.Fatalf("expected %d peers, got %d", len(ids), len(seen))
+	}
+	if pages != 4 {
+		t.Fatalf("expected 4 pages, got %d", pages)
+	}
+
+	if _, _, err := dsab.PeersWithAddrsPage("bogus", 3); err == nil {
+		t.Fatal("expected an error for an invalid cursor")
+	}
+}
+
+func TestNativeTTL(t *testing.T) {
+	for _, ns := range []string{"", "/ns"} {
+		t.Run("Namespace="+ns, func(t *testing.T) {
+			store, closeFn := badgerStore(t)
+			defer closeFn()
+
+			clock := newMockClock()
+			opts := DefaultOpts()
+			opts.GCPurgeInterval = 0
+			opts.Namespace = ds.NewKey(ns)
+			opts.Clock = clock
+			ab, err := NewAddrBook(context.Background(), store, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ab.Close()
+
+			id := test.GeneratePeerIDs(1)[0]
+			addrs := test.GenerateAddrs(3)
+			key := opts.Namespace.Child(addrBookBase.ChildString(b32.RawStdEncoding.EncodeToString([]byte(id))))
+			expiration := func() time.Time {
+				t.Helper()
+				exp, err := store.(ds.TTLDatastore).GetExpiration(key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return exp
+			}
+
+			// the record expires along with its last address.
+			ab.AddAddr(id, addrs[0], time.Hour)
+			ab.AddAddr(id, addrs[1], 2*time.Hour)
+			if exp, want := expiration(), time.Now().Add(2*time.Hour); exp.Before(want.Add(-time.Minute)) || exp.After(want) {
+				t.Fatalf("expected record to expire around %v, got %v", want, exp)
+			}
+
+			// GC rewrites the record in a batch when its first address expires, keeping the TTL of the last one.
+			clock.Advance(90 * time.Minute)
+			ab.gc.purgeStore()
+			if exp, want := expiration(), time.Now().Add(30*time.Minute); exp.Before(want.Add(-time.Minute)) || exp.After(want) {
+				t.Fatalf("expected record to expire around %v after GC, got %v", want, exp)
+			}
+			test.AssertAddressesEqual(t, addrs[1:2], ab.Addrs(id))
+
+			// permanent addresses keep the record alive indefinitely.
+			ab.AddAddr(id, addrs[2], pstore.PermanentAddrTTL)
+			if exp := expiration(); exp.Unix() != 0 {
+				t.Fatalf("expected record not to expire, got %v", exp)
+			}
+		})
+	}
+}
+
+func TestNativeTTLIndexed(t *testing.T) {
+	store, closeFn := badgerStore(t)
+	defer closeFn()
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.IndexAddrs = true
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	// the datastore would otherwise expire records behind the back of the index.
+	id := test.GeneratePeerIDs(1)[0]
+	ab.AddAddr(id, test.GenerateAddrs(1)[0], time.Hour)
+	key := addrBookBase.ChildString(b32.RawStdEncoding.EncodeToString([]byte(id)))
+	exp, err := store.(ds.TTLDatastore).GetExpiration(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp.Unix() != 0 {
+		t.Fatalf("expected the indexed record to be stored without a TTL, got %v", exp)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+
+	newAddrBook := func(ns string) *dsAddrBook {
+		opts := DefaultOpts()
+		opts.GCPurgeInterval = 0
+		opts.Namespace = ds.NewKey(ns)
+
+		ab, err := NewAddrBook(context.Background(), store, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ab
+	}
+
+	ab1, ab2 := newAddrBook("/peerstore/a"), newAddrBook("/peerstore/b")
+	defer ab1.Close()
+	defer ab2.Close()
+
+	ids := test.GeneratePeerIDs(2)
+	addrs := test.GenerateAddrs(2)
+	ab1.AddAddr(ids[0], addrs[0], time.Hour)
+	ab2.AddAddr(ids[1], addrs[1], time.Hour)
+
+	test.AssertAddressesEqual(t, addrs[:1], ab1.Addrs(ids[0]))
+	test.AssertAddressesEqual(t, nil, ab1.Addrs(ids[1]))
+	if peers := ab1.PeersWithAddrs(); len(peers) != 1 || peers[0] != ids[0] {
+		t.Fatalf("expected only peer %s, got: %v", ids[0], peers)
+	}
+	if peers := ab2.PeersWithAddrs(); len(peers) != 1 || peers[0] != ids[1] {
+		t.Fatalf("expected only peer %s, got: %v", ids[1], peers)
+	}
+
+	key := ds.NewKey("/peerstore/a").Child(addrBookBase).ChildString(b32.RawStdEncoding.EncodeToString([]byte(ids[0])))
+	if has, _ := store.Has(key); !has {
+		t.Fatalf("expected record to be stored under the namespace, at key: %s", key)
+	}
+}
+
+func TestAddrBookTxn(t *testing.T) {
+	store, closeStore := badgerStore(t)
+	defer closeStore()
+	txnds := store.(ds.TxnDatastore)
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.Namespace = ds.NewKey("/peerstore")
+
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(4)
+	ab.AddAddrs(id, addrs[:1], time.Hour)
+
+	txn, err := txnds.NewTransaction(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	own := ds.NewKey("/mine")
+	if err = txn.Put(own, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// writes staged for the same peer compose.
+	abtxn := ab.WithTxn(txn)
+	if err = abtxn.SetAddrs(id, addrs[1:2], time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = abtxn.AddAddrs(id, addrs[2:3], time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is visible until the transaction is committed.
+	test.AssertAddressesEqual(t, addrs[:1], ab.Addrs(id))
+	if has, _ := store.Has(own); has {
+		t.Fatal("expected the caller's write not to be visible before commit")
+	}
+
+	if err = abtxn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	test.AssertAddressesEqual(t, addrs[:3], ab.Addrs(id))
+	if has, _ := store.Has(own); !has {
+		t.Fatal("expected the caller's write to be committed")
+	}
+
+	// discarded writes leave no trace.
+	if txn, err = txnds.NewTransaction(false); err != nil {
+		t.Fatal(err)
+	}
+	abtxn = ab.WithTxn(txn)
+	if err = abtxn.SetAddrs(id, addrs[:3], -1); err != nil {
+		t.Fatal(err)
+	}
+	if err = abtxn.AddAddrs(id, addrs[3:], time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	abtxn.Discard()
+	test.AssertAddressesEqual(t, addrs[:3], ab.Addrs(id))
+
+	// invalid peer IDs are rejected, as outside of transactions.
+	if txn, err = txnds.NewTransaction(false); err != nil {
+		t.Fatal(err)
+	}
+	abtxn = ab.WithTxn(txn)
+	if err = abtxn.AddAddrs("", addrs, time.Hour); err == nil {
+		t.Fatal("expected staging addrs for an empty peer ID to fail")
+	}
+	if err = abtxn.SetAddrs("", addrs, time.Hour); err == nil {
+		t.Fatal("expected staging addrs for an empty peer ID to fail")
+	}
+	if err = abtxn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if n := ab.NumPeers(); n != 1 {
+		t.Fatalf("expected no record to be staged for the empty peer ID, got %d peers", n)
+	}
+}
+
+func TestPeerRecords(t *testing.T) {
+	clock := newMockClock()
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(3)
+
+	// envelopes are opaque to the address book; here they simply index a set of records.
+	records := map[string]*PeerRecord{
+		"seq1": {PeerID: id, Seq: 1, Addrs: addrs[:1]},
+		"seq2": {PeerID: id, Seq: 2, Addrs: addrs[1:]},
+	}
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.Clock = clock
+	opts.PeerRecordUnmarshaler = func(envelope []byte) (*PeerRecord, error) {
+		if rec, ok := records[string(envelope)]; ok {
+			return rec, nil
+		}
+		return nil, fmt.Errorf("invalid envelope")
+	}
+
+	ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn()
+	dsab := ab.(*dsAddrBook)
+
+	if _, err := dsab.ConsumePeerRecord([]byte("bogus"), time.Hour); err == nil {
+		t.Fatal("expected an error for an invalid envelope")
+	}
+
+	if accepted, err := dsab.ConsumePeerRecord([]byte("seq2"), time.Hour); !accepted || err != nil {
+		t.Fatalf("expected record to be accepted, err: %v", err)
+	}
+	test.AssertAddressesEqual(t, addrs[1:], ab.Addrs(id))
+
+	// older records are rejected.
+	if accepted, err := dsab.ConsumePeerRecord([]byte("seq1"), time.Hour); accepted || err != nil {
+		t.Fatalf("expected older record to be rejected, err: %v", err)
+	}
+	if rec := dsab.GetPeerRecord(id); string(rec) != "seq2" {
+		t.Fatalf("expected the newest record, got: %s", rec)
+	}
+	test.AssertAddressesEqual(t, addrs[1:], ab.Addrs(id))
+
+	clock.Advance(2 * time.Hour)
+	if rec := dsab.GetPeerRecord(id); rec != nil {
+		t.Fatalf("expected the record to expire, got: %s", rec)
+	}
+
+	// once the newer record expires, an older one is accepted again.
+	if accepted, err := dsab.ConsumePeerRecord([]byte("seq1"), time.Hour); !accepted || err != nil {
+		t.Fatalf("expected record to be accepted, err: %v", err)
+	}
+	ab.ClearAddrs(id)
+	if rec := dsab.GetPeerRecord(id); rec != nil {
+		t.Fatalf("expected ClearAddrs to delete the record, got: %s", rec)
+	}
+}
+
+// prefixFailingStore fails the writes to keys under a prefix while broken.
+type prefixFailingStore struct {
+	ds.Batching
+	prefix ds.Key
+	broken int32
+}
+
+func (s *prefixFailingStore) Put(key ds.Key, value []byte) error {
+	if atomic.LoadInt32(&s.broken) == 1 && s.prefix.IsAncestorOf(key) {
+		return errBrokenStore
+	}
+	return s.Batching.Put(key, value)
+}
+
+func TestPeerRecordsWriteFailure(t *testing.T) {
+	store := &prefixFailingStore{Batching: dssync.MutexWrap(ds.NewMapDatastore()), prefix: addrBookBase}
+	ids := test.GeneratePeerIDs(2)
+	addrs := test.GenerateAddrs(3)
+
+	records := map[string]*PeerRecord{
+		"seq1":  {PeerID: ids[0], Seq: 1, Addrs: addrs[:1]},
+		"seq2":  {PeerID: ids[0], Seq: 2, Addrs: addrs[1:2]},
+		"other": {PeerID: ids[1], Seq: 1, Addrs: addrs[2:]},
+	}
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.PeerRecordUnmarshaler = func(envelope []byte) (*PeerRecord, error) {
+		return records[string(envelope)], nil
+	}
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	if accepted, err := ab.ConsumePeerRecord([]byte("seq1"), time.Hour); !accepted || err != nil {
+		t.Fatalf("expected record to be accepted, err: %v", err)
+	}
+
+	// when the addresses can't be stored, the record is rejected, and the one held before is kept...
+	atomic.StoreInt32(&store.broken, 1)
+	if accepted, err := ab.ConsumePeerRecord([]byte("seq2"), time.Hour); accepted || err == nil {
+		t.Fatalf("expected record to be rejected with an error, accepted: %v", accepted)
+	}
+	if rec := ab.GetPeerRecord(ids[0]); string(rec) != "seq1" {
+		t.Fatalf("expected the previous record to be kept, got: %s", rec)
+	}
+	test.AssertAddressesEqual(t, addrs[:1], ab.Addrs(ids[0]))
+
+	// ... or none, if none was.
+	if accepted, err := ab.ConsumePeerRecord([]byte("other"), time.Hour); accepted || err == nil {
+		t.Fatalf("expected record to be rejected with an error, accepted: %v", accepted)
+	}
+	if rec := ab.GetPeerRecord(ids[1]); rec != nil {
+		t.Fatalf("expected no record to be held, got: %s", rec)
+	}
+}
+
+func TestPeerRecordsNativeTTL(t *testing.T) {
+	store, closeFn := badgerStore(t)
+	defer closeFn()
+
+	id := test.GeneratePeerIDs(1)[0]
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.PeerRecordUnmarshaler = func(envelope []byte) (*PeerRecord, error) {
+		return &PeerRecord{PeerID: id, Seq: 1, Addrs: test.GenerateAddrs(1)}, nil
+	}
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	if accepted, err := ab.ConsumePeerRecord([]byte("seq1"), time.Hour); !accepted || err != nil {
+		t.Fatalf("expected record to be accepted, err: %v", err)
+	}
+	exp, err := store.(ds.TTLDatastore).GetExpiration(ab.certifiedKey(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Now().Add(time.Hour); exp.Before(want.Add(-time.Minute)) || exp.After(want) {
+		t.Fatalf("expected peer record to expire around %v, got %v", want, exp)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	clock := newMockClock()
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.Clock = clock
+
+	src, closeSrc := addressBookFactory(t, badgerStore, opts)()
+	defer closeSrc()
+
+	ids := test.GeneratePeerIDs(5)
+	addrs := test.GenerateAddrs(2)
+	for _, id := range ids {
+		src.AddAddrs(id, addrs[:1], time.Hour)
+		src.AddAddrs(id, addrs[1:], time.Minute)
+	}
+
+	var buf bytes.Buffer
+	if err := src.(*dsAddrBook).Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	exported := buf.Bytes()
+
+	clock.Advance(30 * time.Second)
+
+	dst, err := NewAddrBook(context.Background(), dssync.MutexWrap(ds.NewMapDatastore()), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	// importing twice is idempotent.
+	for i := 0; i < 2; i++ {
+		if err := dst.Import(bytes.NewReader(exported)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if peers := dst.PeersWithAddrs(); len(peers) != len(ids) {
+		t.Fatalf("expected %d peers, got %d", len(ids), len(peers))
+	}
+	for _, id := range ids {
+		test.AssertAddressesEqual(t, addrs, dst.Addrs(id))
+
+		// the remaining lifetime is preserved.
+		ttl, exp, _ := dst.GetTTL(id, addrs[1])
+		if ttl != time.Minute || !exp.Equal(clock.Now().Add(30*time.Second)) {
+			t.Fatalf("unexpected ttl: %v, expiry: %v", ttl, exp)
+		}
+	}
+
+	// expired addresses are not imported.
+	clock.Advance(time.Minute)
+	fresh, err := NewAddrBook(context.Background(), dssync.MutexWrap(ds.NewMapDatastore()), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	if err := fresh.Import(bytes.NewReader(exported)); err != nil {
+		t.Fatal(err)
+	}
+	test.AssertAddressesEqual(t, addrs[:1], fresh.Addrs(ids[0]))
+}
+
+// countingCache is a Cache that counts insertions.
+type countingCache struct {
+	*lru.ARCCache
+	adds int32
+}
+
+func (c *countingCache) Add(key, value interface{}) {
+	atomic.AddInt32(&c.adds, 1)
+	c.ARCCache.Add(key, value)
+}
+
+func TestCustomCache(t *testing.T) {
+	arc, _ := lru.NewARC(16)
+	c := &countingCache{ARCCache: arc}
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.CacheSize = 0
+	opts.Cache = c
+
+	ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(2)
+
+	ab.AddAddrs(id, addrs, time.Hour)
+	test.AssertAddressesEqual(t, addrs, ab.Addrs(id))
+
+	if c.adds != 1 || !c.Contains(id) {
+		t.Fatalf("expected the record to be inserted in the custom cache once, got %d insertions", c.adds)
+	}
+}
+
+func TestAddrsFiltered(t *testing.T) {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+
+	ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn()
+	dsab := ab.(*dsAddrBook)
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := []ma.Multiaddr{
+		ma.StringCast("/ip4/1.2.3.4/tcp/4001"),
+		ma.StringCast("/ip6/::1/tcp/4001"),
+		ma.StringCast("/ip4/1.2.3.4/udp/4001"),
+	}
+	ab.AddAddrs(id, addrs, time.Hour)
+
+	ip6 := func(a ma.Multiaddr) bool {
+		_, err := a.ValueForProtocol(ma.P_IP6)
+		return err == nil
+	}
+	test.AssertAddressesEqual(t, addrs[1:2], dsab.AddrsFiltered(id, ip6))
+	test.AssertAddressesEqual(t, addrs, dsab.AddrsFiltered(id, nil))
+}
+
+func TestNumAddrsAndPeers(t *testing.T) {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+
+	ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn()
+	dsab := ab.(*dsAddrBook)
+
+	ids := test.GeneratePeerIDs(3)
+	addrs := test.GenerateAddrs(3)
+
+	if n := dsab.NumPeers(); n != 0 {
+		t.Fatalf("expected 0 peers, got %d", n)
+	}
+
+	ab.AddAddrs(ids[0], addrs, time.Hour)
+	ab.AddAddrs(ids[1], addrs[:1], time.Hour)
+
+	if n := dsab.NumAddrs(ids[0]); n != 3 {
+		t.Fatalf("expected 3 addrs, got %d", n)
+	}
+	if n := dsab.NumAddrs(ids[2]); n != 0 {
+		t.Fatalf("expected 0 addrs, got %d", n)
+	}
+	if n := dsab.NumPeers(); n != 2 {
+		t.Fatalf("expected 2 peers, got %d", n)
+	}
+
+	ab.ClearAddrs(ids[1])
+	if n := dsab.NumPeers(); n != 1 {
+		t.Fatalf("expected 1 peer, got %d", n)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+
+	ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn()
+	dsab := ab.(*dsAddrBook)
+
+	ids := test.GeneratePeerIDs(3)
+	addrs := test.GenerateAddrs(4)
+
+	ab.AddAddrs(ids[0], addrs[:2], time.Hour)
+	ab.AddAddrs(ids[1], addrs[2:], time.Hour)
+
+	visited := make(map[peer.ID][]ma.Multiaddr)
+	err := dsab.ForEach(context.Background(), func(p peer.ID, as []ma.Multiaddr) error {
+		visited[p] = append([]ma.Multiaddr(nil), as...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visited) != 2 {
+		t.Fatalf("expected 2 peers to be visited, got %d", len(visited))
+	}
+	test.AssertAddressesEqual(t, addrs[:2], visited[ids[0]])
+	test.AssertAddressesEqual(t, addrs[2:], visited[ids[1]])
+
+	// an error returned by the callback stops iteration.
+	stop := errors.New("stop")
+	calls := 0
+	err = dsab.ForEach(context.Background(), func(peer.ID, []ma.Multiaddr) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Fatalf("expected iteration to stop after the first peer, got %d calls, err: %v", calls, err)
+	}
+}
+
+func TestReplaceAddrs(t *testing.T) {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+
+	ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn()
+	dsab := ab.(*dsAddrBook)
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(4)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	added := dsab.AddrStream(ctx, id)
+	expired := dsab.AddrExpiryStream(ctx, id)
+
+	ab.AddAddrs(id, addrs[:2], time.Hour)
+	test.AssertAddressesEqual(t, addrs[:2], receiveAddrs(t, added, 2))
+
+	// addrs[0] is removed, addrs[1] has its ttl overridden, and addrs[2:] are added.
+	if err := dsab.ReplaceAddrs(id, addrs[1:], 2*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	test.AssertAddressesEqual(t, addrs[1:], ab.Addrs(id))
+	test.AssertAddressesEqual(t, addrs[2:], receiveAddrs(t, added, 2))
+	test.AssertAddressesEqual(t, addrs[:1], receiveAddrs(t, expired, 1))
+	if ttl, _, _ := dsab.GetTTL(id, addrs[1]); ttl != 2*time.Hour {
+		t.Fatalf("expected ttl to be overridden, got: %v", ttl)
+	}
+
+	// replacing with an empty set removes all addresses.
+	if err := dsab.ReplaceAddrs(id, nil, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	test.AssertAddressesEqual(t, nil, ab.Addrs(id))
+	test.AssertAddressesEqual(t, addrs[1:], receiveAddrs(t, expired, 3))
+	if i := len(ab.PeersWithAddrs()); i != 0 {
+		t.Fatalf("expected no peers with addrs, got: %d", i)
+	}
+}
+
+// blockingStore blocks writes until released.
+type blockingStore struct {
+	ds.Batching
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Put(key ds.Key, value []byte) error {
+	s.entered <- struct{}{}
+	<-s.release
+	return s.Batching.Put(key, value)
+}
+
+func TestCloseWaitsForWrites(t *testing.T) {
+	for _, timeout := range []bool{false, true} {
+		store := &blockingStore{
+			Batching: dssync.MutexWrap(ds.NewMapDatastore()),
+			entered:  make(chan struct{}, 1),
+			release:  make(chan struct{}),
+		}
+
+		opts := DefaultOpts()
+		opts.GCPurgeInterval = 0
+		opts.CloseTimeout = 0
+		if timeout {
+			opts.CloseTimeout = 50 * time.Millisecond
+		}
+
+		ab, err := NewAddrBook(context.Background(), store, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id := test.GeneratePeerIDs(1)[0]
+		go ab.AddAddrs(id, test.GenerateAddrs(1), time.Hour)
+		<-store.entered
+
+		closed := make(chan error, 1)
+		go func() { closed <- ab.Close() }()
+
+		if timeout {
+			err := <-closed
+			if err == nil {
+				t.Fatal("expected Close to time out")
+			}
+			// later calls return the same result, without waiting again.
+			if again := ab.Close(); again != err {
+				t.Fatalf("expected Close to return %v again, got %v", err, again)
+			}
+			close(store.release)
+			continue
+		}
+
+		select {
+		case err := <-closed:
+			t.Fatalf("expected Close to wait for the write in flight, returned: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(store.release)
+		if err := <-closed; err != nil {
+			t.Fatal(err)
+		}
+		if has, _ := store.Has(addrBookBase.ChildString(b32.RawStdEncoding.EncodeToString([]byte(id)))); !has {
+			t.Fatal("expected the write in flight to be persisted")
+		}
+	}
+}
+
+func TestReadsWithContext(t *testing.T) {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+
+	ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn()
+	dsab := ab.(*dsAddrBook)
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(2)
+	ab.AddAddrs(id, addrs, time.Hour)
+
+	if got, err := dsab.AddrsCtx(context.Background(), id); err != nil {
+		t.Fatal(err)
+	} else {
+		test.AssertAddressesEqual(t, addrs, got)
+	}
+	if peers, err := dsab.PeersWithAddrsCtx(context.Background()); err != nil || len(peers) != 1 {
+		t.Fatalf("expected 1 peer, got: %v, err: %v", peers, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := dsab.AddrsCtx(ctx, id); err != context.Canceled {
+		t.Fatalf("expected context error, got: %v", err)
+	}
+	if _, err := dsab.PeersWithAddrsCtx(ctx); err != context.Canceled {
+		t.Fatalf("expected context error, got: %v", err)
+	}
+}
+
+// blockingReadStore blocks reads until released.
+type blockingReadStore struct {
+	ds.Batching
+	release chan struct{}
+}
+
+func (s *blockingReadStore) Get(key ds.Key) ([]byte, error) {
+	<-s.release
+	return s.Batching.Get(key)
+}
+
+func TestAddrsCtxGivesUpOnSlowLoads(t *testing.T) {
+	store := &blockingReadStore{Batching: dssync.MutexWrap(ds.NewMapDatastore()), release: make(chan struct{})}
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	id := test.GeneratePeerIDs(1)[0]
+
+	// the context expires while the record is being loaded.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := ab.AddrsCtx(ctx, id)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("expected context error, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected AddrsCtx to give up once the context is done")
+	}
+	close(store.release)
+}
+
+func TestAddrPriorities(t *testing.T) {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+
+	ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn()
+	dsab := ab.(*dsAddrBook)
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(3)
+
+	ab.AddAddr(id, addrs[0], time.Minute)
+	dsab.AddAddrsWithPriority(id, addrs[1:2], time.Hour, 10)
+	dsab.AddAddrsWithPriority(id, addrs[2:], time.Hour, 5)
+
+	expected := []PrioritizedAddr{{addrs[1], 10}, {addrs[2], 5}, {addrs[0], 0}}
+	got := dsab.AddrsWithPriority(id)
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d addrs, got %d", len(expected), len(got))
+	}
+	for i := range expected {
+		if !got[i].Addr.Equal(expected[i].Addr) || got[i].Priority != expected[i].Priority {
+			t.Fatalf("expected %v at position %d, got %v", expected[i], i, got[i])
+		}
+	}
+	for i, a := range ab.Addrs(id) {
+		if !a.Equal(expected[i].Addr) {
+			t.Fatalf("expected Addrs to be sorted by priority, got %s at position %d", a, i)
+		}
+	}
+
+	// re-adding without a priority keeps the existing one; re-adding with one overrides it.
+	ab.AddAddr(id, addrs[1], time.Hour)
+	dsab.AddAddrsWithPriority(id, addrs[2:], time.Hour, 20)
+	ab.(*dsAddrBook).cache.Remove(id)
+	got = dsab.AddrsWithPriority(id)
+	if !got[0].Addr.Equal(addrs[2]) || got[0].Priority != 20 || got[1].Priority != 10 {
+		t.Fatalf("unexpected priorities: %v", got)
+	}
+}
+
+func TestInvalidPeerIDs(t *testing.T) {
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	valid := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(2)
+
+	ab.AddAddrs(valid, addrs, time.Hour)
+	ab.AddAddrs("", addrs, time.Hour)
+	ab.SetAddrs("", addrs, time.Hour)
+
+	if err := ab.AddAddrsMany(map[peer.ID][]ma.Multiaddr{"": addrs}, time.Hour); err == nil {
+		t.Fatal("expected adding addrs for an empty peer ID to fail")
+	}
+	if err := ab.SetDefaultTTL("", time.Hour); err == nil {
+		t.Fatal("expected setting a default TTL for an empty peer ID to fail")
+	}
+
+	// a record planted under a key that doesn't decode to a peer ID is skipped.
+	if err := store.Put(addrBookBase.ChildString("garbage"), []byte{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if peers := ab.PeersWithAddrs(); len(peers) != 1 || peers[0] != valid {
+		t.Fatalf("expected only the valid peer to be listed, got: %v", peers)
+	}
+	if n := ab.NumPeers(); n != 2 {
+		t.Fatalf("expected only the valid and planted records to be stored, got: %d", n)
+	}
+}
+
+// failingStore fails all writes once broken, and as many reads as set in failGets.
+type failingStore struct {
+	ds.Batching
+	broken   int32
+	failGets int32
+}
+
+func (s *failingStore) Get(key ds.Key) ([]byte, error) {
+	if atomic.AddInt32(&s.failGets, -1) >= 0 {
+		return nil, errBrokenStore
+	}
+	return s.Batching.Get(key)
+}
+
+var errBrokenStore = errors.New("broken store")
+
+func (s *failingStore) Put(key ds.Key, value []byte) error {
+	if atomic.LoadInt32(&s.broken) == 1 {
+		return errBrokenStore
+	}
+	return s.Batching.Put(key, value)
+}
+
+func (s *failingStore) Delete(key ds.Key) error {
+	if atomic.LoadInt32(&s.broken) == 1 {
+		return errBrokenStore
+	}
+	return s.Batching.Delete(key)
+}
+
+func TestOnWriteFailure(t *testing.T) {
+	store := &failingStore{Batching: dssync.MutexWrap(ds.NewMapDatastore())}
+
+	var ops []string
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.OnWriteFailure = func(p peer.ID, op string, err error) {
+		if !strings.Contains(err.Error(), errBrokenStore.Error()) {
+			t.Errorf("unexpected error reported for %s: %v", op, err)
+		}
+		ops = append(ops, op)
+	}
+
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(2)
+
+	ab.AddAddrs(id, addrs[:1], time.Hour)
+	if len(ops) != 0 {
+		t.Fatalf("expected no failures to be reported, got: %v", ops)
+	}
+
+	atomic.StoreInt32(&store.broken, 1)
+	ab.AddAddrs(id, addrs[1:], time.Hour)
+	ab.SetAddrs(id, addrs[:1], 0)
+	ab.Touch(id, 2*time.Hour)
+	ab.ClearAddrs(id)
+
+	expected := []string{"AddAddrs", "SetAddrs", "Touch", "ClearAddrs", "ClearAddrs"}
+	if strings.Join(ops, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected failures %v to be reported, got: %v", expected, ops)
+	}
+}
+
+func TestAddrStreamInitialReadErrors(t *testing.T) {
+	store := &failingStore{Batching: dssync.MutexWrap(ds.NewMapDatastore())}
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.CacheSize = 0
+
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(2)
+	ab.AddAddrs(id, addrs, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a transient failure is retried.
+	atomic.StoreInt32(&store.failGets, initialReadAttempts-1)
+	test.AssertAddressesEqual(t, addrs, receiveAddrs(t, ab.AddrStream(ctx, id), 2))
+
+	ch, err := ab.AddrStreamErr(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.AssertAddressesEqual(t, addrs, receiveAddrs(t, ch, 2))
+
+	// a persistent one is surfaced.
+	atomic.StoreInt32(&store.failGets, initialReadAttempts)
+	if _, err = ab.AddrStreamErr(ctx, id); err == nil {
+		t.Fatal("expected the stream to fail to open")
+	}
+}
+
+func TestClearAddrsPreview(t *testing.T) {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+
+	ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn()
+
+	dsab := ab.(*dsAddrBook)
+	ids := test.GeneratePeerIDs(2)
+	addrs := test.GenerateAddrs(1)
+	ab.AddAddrs(ids[0], addrs, time.Hour)
+
+	key := addrBookBase.ChildString(b32.RawStdEncoding.EncodeToString([]byte(ids[0])))
+	preview, err := dsab.ClearAddrsPreview(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertKeysEqual(t, []ds.Key{key}, preview)
+	test.AssertAddressesEqual(t, addrs, ab.Addrs(ids[0]))
+}
+
+func BenchmarkAddrs(b *testing.B) {
+	for name, shared := range map[string]bool{"Copied": false, "Shared": true} {
+		b.Run(name, func(b *testing.B) {
+			opts := DefaultOpts()
+			opts.GCPurgeInterval = 0
+			opts.SharedReads = shared
+
+			ab, closeFn := addressBookFactory(b, badgerStore, opts)()
+			defer closeFn()
+
+			id := test.GeneratePeerIDs(1)[0]
+			ab.AddAddrs(id, test.GenerateAddrs(10), time.Hour)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ab.Addrs(id)
+			}
+		})
+	}
+}
+
+func BenchmarkAddAddr(b *testing.B) {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.Clock = newMockClock()
+
+	ab, closeFn := addressBookFactory(b, badgerStore, opts)()
+	defer closeFn()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(10)
+	ab.AddAddrs(id, addrs, time.Hour)
+
+	// re-adding addresses already held, one at a time, as identify does on every connection.
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ab.AddAddr(id, addrs[i%len(addrs)], time.Hour)
+	}
+}
+
+func TestWarmCache(t *testing.T) {
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := test.GeneratePeerIDs(10)
+	addrs := test.GenerateAddrs(1)
+	for _, p := range ids[:8] {
+		ab.AddAddrs(p, addrs, time.Hour)
+	}
+	ab.Close()
+
+	// a fresh address book starts with a cold cache.
+	ab, err = NewAddrBook(context.Background(), &failingStore{Batching: store, failGets: 1}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	// failures are reported, and the records that failed to load aren't cached.
+	if err = ab.WarmCache(context.Background(), ids[:1], 3); err == nil {
+		t.Fatal("expected the failed read to be reported")
+	}
+	if size, _ := ab.CacheStats(); size != 0 {
+		t.Fatalf("expected an empty cache, got %d records", size)
+	}
+
+	if err = ab.WarmCache(context.Background(), ids, 3); err != nil {
+		t.Fatal(err)
+	}
+	_, cached := ab.CacheStats()
+	assertPeersEqual(t, ids, cached)
+	for _, p := range ids[:8] {
+		if addrs, ok := ab.CachedAddrs(p); !ok || len(addrs) != 1 {
+			t.Fatalf("expected the addrs of peer %s to be cached, got %v", p, addrs)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = ab.WarmCache(ctx, ids, 3); err != context.Canceled {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+}
+
+func TestConcurrentClose(t *testing.T) {
+	m := new(countingMetrics)
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.FlushOnClose = true
+	opts.Metrics = m
+
+	ab, err := NewAddrBook(context.Background(), dssync.MutexWrap(ds.NewMapDatastore()), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ab.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err = ab.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&m.sweeps); n != 1 {
+		t.Fatalf("expected the address book to be flushed once, got %d flushes", n)
+	}
+}
+
+func TestGetTTL(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, nil)
+	defer closeFn()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(2)
+
+	if _, _, found := ab.GetTTL(id, addrs[0]); found {
+		t.Fatal("expected no ttl for an unknown peer")
+	}
+
+	ab.AddAddr(id, addrs[0], time.Hour)
+	ttl, exp, found := ab.GetTTL(id, addrs[0])
+	if !found || ttl != time.Hour || !exp.Equal(clock.Now().Add(time.Hour)) {
+		t.Fatalf("unexpected ttl: %v, expiry: %v, found: %v", ttl, exp, found)
+	}
+
+	// overriding the ttl is reflected.
+	ab.SetAddr(id, addrs[0], time.Minute)
+	if ttl, _, _ := ab.GetTTL(id, addrs[0]); ttl != time.Minute {
+		t.Fatalf("expected ttl to be overridden, got: %v", ttl)
+	}
+
+	if _, _, found := ab.GetTTL(id, addrs[1]); found {
+		t.Fatal("expected no ttl for an unknown address")
+	}
+	if !ab.Has(id, addrs[0]) || ab.Has(id, addrs[1]) {
+		t.Fatal("expected only the added address to be held")
+	}
+
+	clock.Advance(2 * time.Minute)
+	if _, _, found := ab.GetTTL(id, addrs[0]); found {
+		t.Fatal("expected no ttl for an expired address")
+	}
+	if ab.Has(id, addrs[0]) {
+		t.Fatal("expected an expired address not to be held")
+	}
+}
+
+// countingStore counts the reads and writes issued directly against the datastore.
+type countingStore struct {
+	ds.Batching
+	gets int32
+	puts int32
+}
+
+func (s *countingStore) Get(key ds.Key) ([]byte, error) {
+	atomic.AddInt32(&s.gets, 1)
+	return s.Batching.Get(key)
+}
+
+func (s *countingStore) Put(key ds.Key, value []byte) error {
+	atomic.AddInt32(&s.puts, 1)
+	return s.Batching.Put(key, value)
+}
+
+func TestRedundantAddsSkipWrites(t *testing.T) {
+	clock := newMockClock()
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.Clock = clock
+
+	store, closeStore := badgerStore(t)
+	defer closeStore()
+	cs := &countingStore{Batching: store}
+
+	ab, err := NewAddrBook(context.Background(), cs, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(3)
+
+	ab.AddAddrs(id, addrs, time.Hour)
+	if cs.puts != 1 {
+		t.Fatalf("expected 1 write, got %d", cs.puts)
+	}
+
+	// re-adding the same addresses with the same or a shorter ttl changes nothing.
+	ab.AddAddrs(id, addrs, time.Hour)
+	ab.AddAddrs(id, addrs[:1], time.Minute)
+	ab.SetAddrs(id, addrs[1:], time.Hour)
+	if cs.puts != 1 {
+		t.Fatalf("expected redundant inserts not to write, got %d writes", cs.puts)
+	}
+
+	// extending the ttl does write.
+	ab.AddAddrs(id, addrs[:1], 2*time.Hour)
+	if cs.puts != 2 {
+		t.Fatalf("expected 2 writes, got %d", cs.puts)
+	}
+	test.AssertAddressesEqual(t, addrs, ab.Addrs(id))
+}
+
+func TestUnknownPeersAreCached(t *testing.T) {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+
+	store, closeStore := badgerStore(t)
+	defer closeStore()
+	cs := &countingStore{Batching: store}
+
+	ab, err := NewAddrBook(context.Background(), cs, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(2)
+
+	// the empty record of an unknown peer is cached, so repeated lookups only hit the datastore once.
+	for i := 0; i < 3; i++ {
+		test.AssertAddressesEqual(t, nil, ab.Addrs(id))
+	}
+	if cs.gets != 1 {
+		t.Fatalf("expected 1 read, got %d", cs.gets)
+	}
+
+	// inserting addresses updates the cached record in place.
+	ab.AddAddrs(id, addrs, time.Hour)
+	test.AssertAddressesEqual(t, addrs, ab.Addrs(id))
+	if cs.gets != 1 {
+		t.Fatalf("expected 1 read, got %d", cs.gets)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	clock := newMockClock()
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.Clock = clock
+	opts.FlushOnClose = true
+
+	store, closeStore := badgerStore(t)
+	defer closeStore()
+
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := test.GeneratePeerIDs(2)
+	addrs := test.GenerateAddrs(2)
+	key := func(id peer.ID) ds.Key {
+		return addrBookBase.ChildString(b32.RawStdEncoding.EncodeToString([]byte(id)))
+	}
+
+	ab.AddAddr(ids[0], addrs[0], time.Minute)
+	ab.AddAddr(ids[1], addrs[1], time.Hour)
+
+	clock.Advance(2 * time.Minute)
+	if err := ab.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := store.Has(key(ids[0])); has {
+		t.Fatal("expected flush to purge the expired peer from the datastore")
+	}
+	if has, _ := store.Has(key(ids[1])); !has {
+		t.Fatal("expected flush to retain the unexpired peer")
+	}
+
+	// closing the address book runs a final flush.
+	clock.Advance(time.Hour)
+	if err := ab.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := store.Has(key(ids[1])); has {
+		t.Fatal("expected close to purge the expired peer from the datastore")
+	}
+}
+
+func TestTTLGranularity(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, func(o *Options) { o.TTLGranularity = time.Minute })
+	defer closeFn()
+	clock.Advance(time.Minute - time.Duration(clock.Now().Unix()%60)*time.Second + 20*time.Second) // hh:mm:20
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(2)
+
+	ab.AddAddr(id, addrs[0], time.Minute)
+	ab.AddAddr(id, addrs[1], time.Minute+30*time.Second)
+
+	// both expirations fall into the same bucket.
+	_, exp0, _ := ab.GetTTL(id, addrs[0])
+	_, exp1, _ := ab.GetTTL(id, addrs[1])
+	if !exp0.Equal(exp1) || exp0.Unix()%60 != 0 {
+		t.Fatalf("expected expirations to be rounded to the same minute, got: %v, %v", exp0, exp1)
+	}
+	if d := exp1.Sub(clock.Now()); d < time.Minute+30*time.Second || d > 2*time.Minute+30*time.Second {
+		t.Fatalf("expected expiration to be bounded by the granularity, got: %v", d)
+	}
+
+	clock.Advance(exp0.Sub(clock.Now()))
+	test.AssertAddressesEqual(t, nil, ab.Addrs(id))
+}
+
+func TestUpdateAddrsAfterRestart(t *testing.T) {
+	clock := newMockClock()
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.Clock = clock
+
+	store, closeStore := badgerStore(t)
+	defer closeStore()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(2)
+
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ab.AddAddrs(id, addrs[:1], time.Hour)
+	ab.AddAddrs(id, addrs[1:], time.Minute)
+	ab.Close()
+
+	// a new address book over the same datastore starts with a cold cache.
+	ab, err = NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	ab.UpdateAddrs(id, time.Minute, 2*time.Hour)
+	if ttl, _, _ := ab.GetTTL(id, addrs[1]); ttl != 2*time.Hour {
+		t.Fatalf("expected persisted ttl to be updated, got: %v", ttl)
+	}
+
+	clock.Advance(90 * time.Minute)
+	test.AssertAddressesEqual(t, addrs[1:], ab.Addrs(id))
+}
+
+func TestAddrsAddedSince(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, nil)
+	defer closeFn()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(3)
+
+	ab.AddAddrs(id, addrs[:2], time.Hour)
+	clock.Advance(time.Minute)
+	since := clock.Now()
+	ab.AddAddr(id, addrs[2], time.Hour)
+
+	test.AssertAddressesEqual(t, addrs[2:], ab.AddrsAddedSince(id, since))
+
+	// re-adding an address, or setting its TTL, doesn't reset the point in time when it was added.
+	clock.Advance(time.Minute)
+	ab.AddAddr(id, addrs[0], 2*time.Hour)
+	ab.SetAddr(id, addrs[1], 2*time.Hour)
+	test.AssertAddressesEqual(t, addrs[2:], ab.AddrsAddedSince(id, since))
+	test.AssertAddressesEqual(t, addrs, ab.AddrsAddedSince(id, time.Time{}))
+}
+
+func TestMaxTTL(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, func(o *Options) { o.MaxTTL = time.Hour })
+	defer closeFn()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(3)
+
+	ab.AddAddr(id, addrs[0], time.Minute)
+	ab.SetAddr(id, addrs[1], time.Duration(1<<62))
+	ab.AddAddr(id, addrs[2], pstore.PermanentAddrTTL)
+
+	if ttl, _, _ := ab.GetTTL(id, addrs[0]); ttl != time.Minute {
+		t.Fatalf("expected a ttl under the ceiling to be kept, got: %v", ttl)
+	}
+	if ttl, _, _ := ab.GetTTL(id, addrs[1]); ttl != time.Hour {
+		t.Fatalf("expected ttl to be clamped, got: %v", ttl)
+	}
+	if ttl, _, _ := ab.GetTTL(id, addrs[2]); ttl != pstore.PermanentAddrTTL {
+		t.Fatalf("expected a permanent ttl to be exempt, got: %v", ttl)
+	}
+
+	// updating ttls matches the clamped value.
+	ab.UpdateAddrs(id, time.Duration(1<<62), time.Minute)
+	if ttl, _, _ := ab.GetTTL(id, addrs[1]); ttl != time.Minute {
+		t.Fatalf("expected ttl to be updated, got: %v", ttl)
+	}
+
+	clock.Advance(2 * time.Minute)
+	test.AssertAddressesEqual(t, addrs[2:], ab.Addrs(id))
+}
+
+func TestMaxTTLClampsPermanent(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, func(o *Options) {
+		o.MaxTTL = time.Hour
+		o.ClampPermanentTTL = true
+	})
+	defer closeFn()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(1)
+
+	ab.AddAddrs(id, addrs, pstore.PermanentAddrTTL)
+	if ttl, _, _ := ab.GetTTL(id, addrs[0]); ttl != time.Hour {
+		t.Fatalf("expected a permanent ttl to be clamped, got: %v", ttl)
+	}
+
+	clock.Advance(time.Hour)
+	test.AssertAddressesEqual(t, nil, ab.Addrs(id))
+}
+
+func TestDeterministicAddrOrder(t *testing.T) {
+	ab, _, closeFn := newClockedAddrBook(t, nil)
+	defer closeFn()
+
+	ids := test.GeneratePeerIDs(2)
+	addrs := test.GenerateAddrs(10)
+
+	sorted := append([]ma.Multiaddr(nil), addrs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].Bytes(), sorted[j].Bytes()) < 0
+	})
+
+	// addresses expiring at the same time are sorted by their bytes, regardless of insertion order.
+	ab.AddAddrs(ids[0], addrs, time.Hour)
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ab.AddAddr(ids[1], addrs[i], time.Hour)
+	}
+	for _, id := range ids {
+		got := ab.Addrs(id)
+		for i := range sorted {
+			if !got[i].Equal(sorted[i]) {
+				t.Fatalf("expected addrs to be sorted by bytes, got: %v", got)
+			}
+		}
+	}
+}
+
+func TestTTLJitter(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, func(o *Options) { o.TTLJitter = 0.5 })
+	defer closeFn()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(50)
+	ab.AddAddrs(id, addrs, time.Hour)
+	ab.AddAddr(id, addrs[0], pstore.PermanentAddrTTL)
+
+	distinct := make(map[int64]bool)
+	for _, a := range addrs[1:] {
+		ttl, exp, _ := ab.GetTTL(id, a)
+		if ttl != time.Hour {
+			t.Fatalf("expected the original ttl to be kept, got: %v", ttl)
+		}
+		if d := exp.Sub(clock.Now()); d < 30*time.Minute || d > 90*time.Minute {
+			t.Fatalf("expected expiration to be within the jitter bounds, got: %v", d)
+		}
+		distinct[exp.Unix()] = true
+	}
+	if len(distinct) < 2 {
+		t.Fatal("expected expirations to be spread")
+	}
+
+	clock.Advance(90 * time.Minute)
+	test.AssertAddressesEqual(t, addrs[:1], ab.Addrs(id))
+}
+
+func TestAddrInfoStream(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, nil)
+	defer closeFn()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(2)
+
+	ab.AddAddr(id, addrs[0], time.Hour)
+	clock.Advance(10 * time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := ab.AddrInfoStream(ctx, id)
+
+	receive := func() AddrWithTTL {
+		select {
+		case a := <-ch:
+			return a
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for address")
+		}
+		return AddrWithTTL{}
+	}
+
+	// the initial replay carries the remaining lifetime of known addresses.
+	if a := receive(); !a.Addr.Equal(addrs[0]) || a.TTL != 50*time.Minute {
+		t.Fatalf("unexpected address: %v, ttl: %v", a.Addr, a.TTL)
+	}
+
+	ab.AddAddr(id, addrs[1], 2*time.Hour)
+	if a := receive(); !a.Addr.Equal(addrs[1]) || a.TTL != 2*time.Hour {
+		t.Fatalf("unexpected address: %v, ttl: %v", a.Addr, a.TTL)
+	}
+}
+
+func TestPeerRemovedStream(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, nil)
+	defer closeFn()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := ab.PeerRemovedStream(ctx)
+
+	expect := func(want peer.ID) {
+		t.Helper()
+		select {
+		case p := <-ch:
+			if p != want {
+				t.Fatalf("expected peer %s to be removed, got %s", want.Pretty(), p.Pretty())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for peer %s to be removed", want.Pretty())
+		}
+	}
+
+	ids := test.GeneratePeerIDs(3)
+	addrs := test.GenerateAddrs(4)
+
+	// removing addresses only publishes the peer once the last one is gone.
+	ab.AddAddrs(ids[0], addrs[0:2], time.Hour)
+	ab.SetAddr(ids[0], addrs[0], 0)
+	ab.SetAddr(ids[0], addrs[1], 0)
+	expect(ids[0])
+
+	ab.AddAddr(ids[1], addrs[2], time.Hour)
+	ab.ClearAddrs(ids[1])
+	expect(ids[1])
+
+	// clearing a peer without addresses publishes nothing.
+	ab.ClearAddrs(ids[1])
+
+	ab.AddAddr(ids[2], addrs[3], time.Minute)
+	clock.Advance(2 * time.Minute)
+	test.AssertAddressesEqual(t, nil, ab.Addrs(ids[2]))
+	expect(ids[2])
+
+	select {
+	case p := <-ch:
+		t.Fatalf("unexpected removal of peer %s", p.Pretty())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAddrsSortedByExpiry(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, nil)
+	defer closeFn()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(3)
+
+	ab.AddAddr(id, addrs[0], 2*time.Hour)
+	ab.AddAddr(id, addrs[1], time.Hour)
+	ab.AddAddr(id, addrs[2], 3*time.Hour)
+
+	assertOrder := func(want, got []ma.Multiaddr) {
+		t.Helper()
+		if len(want) != len(got) {
+			t.Fatalf("expected %d addrs, got %d", len(want), len(got))
+		}
+		for i := range want {
+			if !want[i].Equal(got[i]) {
+				t.Fatalf("expected %v, got %v", want, got)
+			}
+		}
+	}
+
+	assertOrder([]ma.Multiaddr{addrs[1], addrs[0], addrs[2]}, ab.AddrsSortedByExpiry(id, true))
+	assertOrder([]ma.Multiaddr{addrs[2], addrs[0], addrs[1]}, ab.AddrsSortedByExpiry(id, false))
+
+	clock.Advance(time.Hour + time.Second)
+	assertOrder([]ma.Multiaddr{addrs[0], addrs[2]}, ab.AddrsSortedByExpiry(id, true))
+}
+
+func TestPeersWithAddrsSkipsExpired(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, nil)
+	defer closeFn()
+
+	ids := test.GeneratePeerIDs(2)
+	addrs := test.GenerateAddrs(2)
+
+	ab.AddAddr(ids[0], addrs[0], time.Minute)
+	ab.AddAddr(ids[1], addrs[1], time.Hour)
+
+	// the record of the first peer is still stored, as GC hasn't run.
+	clock.Advance(2 * time.Minute)
+	if peers := ab.PeersWithAddrs(); len(peers) != 1 || peers[0] != ids[1] {
+		t.Fatalf("expected only peer %s to hold addrs, got %v", ids[1].Pretty(), peers)
+	}
+	if n := ab.NumPeers(); n != 2 {
+		t.Fatalf("expected 2 stored records, got %d", n)
+	}
+}
+
+func TestSetAddrTTL(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, nil)
+	defer closeFn()
+
+	ids := test.GeneratePeerIDs(2)
+	addrs := test.GenerateAddrs(3)
+
+	ab.AddAddrs(ids[0], addrs, time.Hour)
+
+	// only the targeted address is affected.
+	ab.SetAddrTTL(ids[0], addrs[0], 3*time.Hour)
+	if ttl, _, _ := ab.GetTTL(ids[0], addrs[0]); ttl != 3*time.Hour {
+		t.Fatalf("expected ttl of 3h, got %v", ttl)
+	}
+	if ttl, _, _ := ab.GetTTL(ids[0], addrs[1]); ttl != time.Hour {
+		t.Fatalf("expected ttl of 1h, got %v", ttl)
+	}
+
+	// unknown addresses are not added.
+	ab.SetAddrTTL(ids[1], addrs[0], time.Hour)
+	test.AssertAddressesEqual(t, nil, ab.Addrs(ids[1]))
+
+	clock.Advance(2 * time.Hour)
+	test.AssertAddressesEqual(t, addrs[:1], ab.Addrs(ids[0]))
+
+	// a zero ttl expires the address.
+	ab.SetAddrTTL(ids[0], addrs[0], 0)
+	test.AssertAddressesEqual(t, nil, ab.Addrs(ids[0]))
+}
+
+func TestSetAddrTTLGracePeriod(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, func(o *Options) {
+		o.ExpiryGracePeriod = time.Hour
+	})
+	defer closeFn()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(2)
+
+	ab.AddAddr(id, addrs[0], time.Minute)
+	ab.AddAddr(id, addrs[1], time.Hour)
+
+	// an address in its grace period is treated as gone, so it isn't revived.
+	clock.Advance(2 * time.Minute)
+	ab.SetAddrTTL(id, addrs[0], time.Hour)
+	test.AssertAddressesEqual(t, addrs[1:], ab.Addrs(id))
+	if ttl, _, _ := ab.GetTTL(id, addrs[0]); ttl != 0 {
+		t.Fatalf("expected the expired addr not to be revived, got ttl %v", ttl)
+	}
+}
+
+func TestTouch(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, nil)
+	defer closeFn()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(3)
+
+	ab.AddAddr(id, addrs[0], time.Minute)
+	ab.AddAddr(id, addrs[1], 30*time.Minute)
+	ab.AddAddr(id, addrs[2], 3*time.Hour)
+
+	ab.Touch(id, time.Hour)
+	for i, want := range []time.Duration{time.Hour, time.Hour, 3 * time.Hour} {
+		if ttl, _, _ := ab.GetTTL(id, addrs[i]); ttl != want {
+			t.Fatalf("expected ttl of %v for addr #%d, got %v", want, i, ttl)
+		}
+	}
+
+	clock.Advance(2 * time.Hour)
+	test.AssertAddressesEqual(t, addrs[2:], ab.Addrs(id))
+}
+
+func TestAddAddrsWithTTLs(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, nil)
+	defer closeFn()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(4)
+
+	if err := ab.AddAddrsWithTTLs(id, addrs, []time.Duration{time.Hour}); err == nil {
+		t.Fatal("expected mismatched slices to be rejected")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	batches := ab.AddrBatchStream(ctx, id)
+
+	ttls := []time.Duration{time.Minute, time.Hour, 0, time.Minute}
+	if err := ab.AddAddrsWithTTLs(id, addrs, ttls); err != nil {
+		t.Fatal(err)
+	}
+
+	// the addresses are published in a single batch, whatever their TTLs.
+	select {
+	case got := <-batches:
+		test.AssertAddressesEqual(t, []ma.Multiaddr{addrs[0], addrs[1], addrs[3]}, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for address batch")
+	}
+	select {
+	case got := <-batches:
+		t.Fatalf("expected a single batch, got another one: %v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+	for i, want := range ttls {
+		ttl, _, found := ab.GetTTL(id, addrs[i])
+		if found != (want > 0) || ttl != want {
+			t.Fatalf("expected addr #%d to have ttl %v, got %v (found: %v)", i, want, ttl, found)
+		}
+	}
+
+	clock.Advance(2 * time.Minute)
+	test.AssertAddressesEqual(t, addrs[1:2], ab.Addrs(id))
+}
+
+func TestSharedReads(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, func(o *Options) { o.SharedReads = true })
+	defer closeFn()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(3)
+
+	ab.AddAddrs(id, addrs[:2], time.Hour)
+	first, second := ab.Addrs(id), ab.Addrs(id)
+	if &first[0] != &second[0] {
+		t.Fatal("expected reads to share the same slice")
+	}
+
+	// changes are reflected right away, whether caused by writes or by expirations.
+	ab.AddAddr(id, addrs[2], time.Minute)
+	test.AssertAddressesEqual(t, addrs, ab.Addrs(id))
+
+	clock.Advance(2 * time.Minute)
+	test.AssertAddressesEqual(t, addrs[:2], ab.Addrs(id))
+}
+
+func TestCacheTTL(t *testing.T) {
+	clock := newMockClock()
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.Clock = clock
+	opts.CacheTTL = time.Minute
+
+	// two address books sharing a datastore, as if run by different processes.
+	reader, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	writer, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(2)
+
+	writer.AddAddrs(id, addrs[:1], time.Hour)
+	test.AssertAddressesEqual(t, addrs[:1], reader.Addrs(id))
+
+	// the reader serves its cached record until it outlives the cache TTL.
+	writer.AddAddrs(id, addrs[1:], time.Hour)
+	clock.Advance(30 * time.Second)
+	test.AssertAddressesEqual(t, addrs[:1], reader.Addrs(id))
+
+	clock.Advance(30 * time.Second)
+	test.AssertAddressesEqual(t, addrs, reader.Addrs(id))
+}
+
+func TestExpiryGracePeriod(t *testing.T) {
+	expired := make(chan []ma.Multiaddr, 10)
+	ab, clock, closeFn := newClockedAddrBook(t, func(o *Options) {
+		o.SharedReads = true
+		o.ExpiryGracePeriod = time.Minute
+		o.OnExpire = func(_ peer.ID, addrs []ma.Multiaddr) { expired <- addrs }
+	})
+	defer closeFn()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(2)
+
+	ab.AddAddrs(id, addrs[:1], time.Minute)
+	ab.AddAddrs(id, addrs[1:], time.Hour)
+	test.AssertAddressesEqual(t, addrs, ab.Addrs(id))
+
+	// expired addresses are hidden, but kept in the record during the grace period.
+	clock.Advance(90 * time.Second)
+	test.AssertAddressesEqual(t, addrs[1:], ab.Addrs(id))
+	if ab.Has(id, addrs[0]) || ab.NumAddrs(id) != 1 {
+		t.Fatalf("expected the expired addr to be hidden")
+	}
+	if cached, _ := ab.CachedAddrs(id); len(cached) != 2 {
+		t.Fatalf("expected the expired addr to be held, got: %v", cached)
+	}
+
+	// adding it again revives it.
+	ab.AddAddrs(id, addrs[:1], time.Minute)
+	test.AssertAddressesEqual(t, addrs, ab.Addrs(id))
+
+	// once it expires again, and its grace period is over, it's dropped for good.
+	clock.Advance(90 * time.Second)
+	if err := ab.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if cached, _ := ab.CachedAddrs(id); len(cached) != 2 {
+		t.Fatalf("expected the expired addr to be held, got: %v", cached)
+	}
+
+	clock.Advance(time.Minute)
+	if err := ab.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	test.AssertAddressesEqual(t, addrs[1:], ab.Addrs(id))
+
+	// the expiration is reported once, when the address is dropped.
+	select {
+	case e := <-expired:
+		test.AssertAddressesEqual(t, addrs[:1], e)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for expired addrs")
+	}
+	select {
+	case e := <-expired:
+		t.Fatalf("unexpected expired addrs: %v", e)
+	default:
+	}
+}
@@ -0,0 +1,147 @@
+package pstoreds
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// CacheSizeMode selects what Options.CacheSize bounds.
+type CacheSizeMode int
+
+const (
+	// CacheByPeer bounds the number of records cached, regardless of how many addresses they hold. Records are evicted
+	// by an ARC policy.
+	CacheByPeer CacheSizeMode = iota
+	// CacheByAddr bounds the total number of addresses held by the records cached, which tracks their memory usage
+	// more closely. Records holding no addresses count as one. Records are evicted least recently used first.
+	CacheByAddr
+)
+
+// addrCache is an LRU cache of address records, bounded by the total number of addresses they hold; see CacheByAddr.
+// The size of a record is taken when it's added, and whenever the address book writes it (see resize).
+type addrCache struct {
+	lk    sync.Mutex
+	max   int
+	total int
+	ll    *list.List // most recently used at the front.
+	items map[interface{}]*list.Element
+}
+
+var _ Cache = (*addrCache)(nil)
+
+type addrCacheEntry struct {
+	key   interface{}
+	value interface{}
+	size  int
+}
+
+func newAddrCache(max int) *addrCache {
+	return &addrCache{max: max, ll: list.New(), items: make(map[interface{}]*list.Element)}
+}
+
+// sizeOf returns the number of addresses a record counts for.
+func sizeOf(value interface{}) int {
+	if pr, ok := value.(*addrsRecord); ok {
+		if n := int(atomic.LoadInt32(&pr.size)); n > 1 {
+			return n
+		}
+	}
+	return 1
+}
+
+func (c *addrCache) Get(key interface{}) (value interface{}, ok bool) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*addrCacheEntry).value, true
+}
+
+func (c *addrCache) Add(key, value interface{}) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		e := el.Value.(*addrCacheEntry)
+		e.value = value
+		c.setSize(e, sizeOf(value))
+		return
+	}
+	e := &addrCacheEntry{key: key, value: value}
+	c.items[key] = c.ll.PushFront(e)
+	c.setSize(e, sizeOf(value))
+}
+
+// resize takes the size of a cached record again, after it changed, evicting records if the cache overflows.
+func (c *addrCache) resize(key interface{}, value interface{}) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		if e := el.Value.(*addrCacheEntry); e.value == value {
+			c.setSize(e, sizeOf(value))
+		}
+	}
+}
+
+// setSize sets the size of an entry, and evicts the least recently used entries while the cache overflows. The lock
+// must be held.
+func (c *addrCache) setSize(e *addrCacheEntry, size int) {
+	c.total += size - e.size
+	e.size = size
+	for c.total > c.max {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *addrCache) Remove(key interface{}) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+// removeElement removes an entry. The lock must be held.
+func (c *addrCache) removeElement(el *list.Element) {
+	e := c.ll.Remove(el).(*addrCacheEntry)
+	delete(c.items, e.key)
+	c.total -= e.size
+}
+
+func (c *addrCache) Contains(key interface{}) bool {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	_, ok := c.items[key]
+	return ok
+}
+
+func (c *addrCache) Peek(key interface{}) (value interface{}, ok bool) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		return el.Value.(*addrCacheEntry).value, true
+	}
+	return nil, false
+}
+
+// Keys returns the keys of the cached records, from the least to the most recently used.
+func (c *addrCache) Keys() []interface{} {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	keys := make([]interface{}, 0, len(c.items))
+	for el := c.ll.Back(); el != nil; el = el.Prev() {
+		keys = append(keys, el.Value.(*addrCacheEntry).key)
+	}
+	return keys
+}
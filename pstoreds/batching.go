@@ -0,0 +1,143 @@
+package pstoreds
+
+import (
+	"fmt"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	namespace "github.com/ipfs/go-datastore/namespace"
+)
+
+// batchingShim adapts a plain ds.Datastore into a ds.Batching. Batches are emulated with ds.NewBasicBatch, which
+// buffers operations in memory and applies them one by one upon Commit, so they are not atomic.
+type batchingShim struct {
+	ds.Datastore
+}
+
+var _ ds.Batching = (*batchingShim)(nil)
+
+func (s *batchingShim) Batch() (ds.Batch, error) {
+	return ds.NewBasicBatch(s.Datastore), nil
+}
+
+func (s *batchingShim) DiskUsage() (uint64, error) {
+	return ds.DiskUsage(s.Datastore)
+}
+
+// asBatching returns the datastore as a ds.Batching, wrapping it in a shim if it does not support batching natively.
+func asBatching(store ds.Datastore, log Logger) ds.Batching {
+	if b, ok := store.(ds.Batching); ok {
+		return b
+	}
+	log.Debugf("datastore of type %T does not support batching; emulating batches", store)
+	return &batchingShim{store}
+}
+
+// namespaced returns the datastore as a ds.Batching, rooting all keys under the provided namespace. Keys in query
+// results are returned relative to the namespace, so callers can keep parsing them as if stored at the root.
+//
+// If the datastore supports native TTLs, so do the returned datastore and its batches.
+func namespaced(store ds.Datastore, ns ds.Key, log Logger) ds.Batching {
+	b := asBatching(store, log)
+	if ns.String() == "" || ns.String() == "/" {
+		ns = ds.NewKey("/")
+	} else {
+		b = namespace.Wrap(b, ns)
+	}
+	if ttl, ok := store.(ds.TTL); ok {
+		return &namespacedTTL{Batching: b, ttl: ttl, prefix: ns}
+	}
+	return b
+}
+
+// namespacedTTL carries the TTL methods of a datastore over to its namespaced wrapper, which doesn't expose them, and
+// to its batches.
+type namespacedTTL struct {
+	ds.Batching
+	ttl    ds.TTL
+	prefix ds.Key
+}
+
+var _ ds.TTLDatastore = (*namespacedTTL)(nil)
+
+func (s *namespacedTTL) PutWithTTL(key ds.Key, value []byte, ttl time.Duration) error {
+	return s.ttl.PutWithTTL(s.prefix.Child(key), value, ttl)
+}
+
+func (s *namespacedTTL) SetTTL(key ds.Key, ttl time.Duration) error {
+	return s.ttl.SetTTL(s.prefix.Child(key), ttl)
+}
+
+func (s *namespacedTTL) DiskUsage() (uint64, error) {
+	return ds.DiskUsage(s.Batching)
+}
+
+func (s *namespacedTTL) GetExpiration(key ds.Key) (time.Time, error) {
+	return s.ttl.GetExpiration(s.prefix.Child(key))
+}
+
+// Batch returns a batch supporting PutWithTTL: the datastore's own if it does, e.g. Badger's, or one that sets the
+// TTLs once committed otherwise.
+func (s *namespacedTTL) Batch() (ds.Batch, error) {
+	batch, err := s.Batching.Batch()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := batch.(ttlPutter); ok {
+		return batch, nil
+	}
+	return &ttlBatch{Batch: batch, store: s, ttls: make(map[ds.Key]time.Duration)}, nil
+}
+
+// ttlPutter is implemented by the writes able to store values with a native TTL.
+type ttlPutter interface {
+	PutWithTTL(key ds.Key, value []byte, ttl time.Duration) error
+}
+
+// putWithTTL stores a value through the write with a native TTL if it supports them, and without one otherwise.
+func putWithTTL(write ds.Write, key ds.Key, value []byte, ttl time.Duration) error {
+	if t, ok := write.(ttlPutter); ok {
+		return t.PutWithTTL(key, value, ttl)
+	}
+	return write.Put(key, value)
+}
+
+// ttlBatch adds PutWithTTL to a batch that lacks it: values are put as usual, and their TTLs are set on the datastore
+// after the batch is committed. Should that fail, the values are left without a TTL, and it's up to GC to purge them.
+type ttlBatch struct {
+	ds.Batch
+	store ds.TTL
+	ttls  map[ds.Key]time.Duration
+}
+
+func (b *ttlBatch) Put(key ds.Key, value []byte) error {
+	delete(b.ttls, key)
+	return b.Batch.Put(key, value)
+}
+
+func (b *ttlBatch) PutWithTTL(key ds.Key, value []byte, ttl time.Duration) error {
+	if err := b.Batch.Put(key, value); err != nil {
+		return err
+	}
+	b.ttls[key] = ttl
+	return nil
+}
+
+func (b *ttlBatch) Delete(key ds.Key) error {
+	delete(b.ttls, key)
+	return b.Batch.Delete(key)
+}
+
+func (b *ttlBatch) Commit() error {
+	if err := b.Batch.Commit(); err != nil {
+		return err
+	}
+	ttls := b.ttls
+	b.ttls = make(map[ds.Key]time.Duration)
+	for key, ttl := range ttls {
+		if err := b.store.SetTTL(key, ttl); err != nil {
+			return fmt.Errorf("failed to set TTL of committed key: %v, err: %v", key, err)
+		}
+	}
+	return nil
+}
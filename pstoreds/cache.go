@@ -1,8 +1,11 @@
 package pstoreds
 
-// cache abstracts all methods we access from ARCCache, to enable alternate
-// implementations such as a no-op one.
-type cache interface {
+// Cache abstracts all methods we access from ARCCache, to enable alternate
+// implementations such as a no-op one, or user-supplied ones via Options.Cache.
+//
+// Keys are peer IDs, and values are opaque records owned by the address book.
+// Implementations must be safe for concurrent use.
+type Cache interface {
 	Get(key interface{}) (value interface{}, ok bool)
 	Add(key, value interface{})
 	Remove(key interface{})
@@ -15,7 +18,7 @@ type cache interface {
 type noopCache struct {
 }
 
-var _ cache = (*noopCache)(nil)
+var _ Cache = (*noopCache)(nil)
 
 func (*noopCache) Get(key interface{}) (value interface{}, ok bool) {
 	return nil, false
@@ -0,0 +1,191 @@
+package pstoreds
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	query "github.com/ipfs/go-datastore/query"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pb "github.com/libp2p/go-libp2p-peerstore/pb"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+var (
+	// Signed peer records are stored under the following db key pattern:
+	// /peers/certified/<b32 peer id no padding>
+	certifiedBase = ds.NewKey("/peers/certified")
+
+	purgeCertifiedQuery = query.Query{
+		Prefix:   certifiedBase.String(),
+		Orders:   []query.Order{query.OrderByKey{}},
+		KeysOnly: false,
+	}
+
+	// ErrNoPeerRecordUnmarshaler is returned by ConsumePeerRecord when Options.PeerRecordUnmarshaler is not set.
+	ErrNoPeerRecordUnmarshaler = errors.New("no peer record unmarshaler configured")
+)
+
+// PeerRecord holds the contents of a signed peer record, as extracted from its envelope.
+type PeerRecord struct {
+	// The peer the record was issued by.
+	PeerID peer.ID
+
+	// The sequence number of the record. Records with higher sequence numbers supersede those with lower ones.
+	Seq uint64
+
+	// The addresses the peer is reachable at.
+	Addrs []ma.Multiaddr
+}
+
+// PeerRecordUnmarshaler verifies the signature of a signed envelope and returns the peer record it carries. It must
+// return an error if the envelope is malformed or its signature is invalid.
+type PeerRecordUnmarshaler func(envelope []byte) (*PeerRecord, error)
+
+func (ab *dsAddrBook) certifiedKey(p peer.ID) ds.Key {
+	return ab.keys.child(certifiedBase, p)
+}
+
+// ConsumePeerRecord stores a signed envelope holding a peer record, and adds the addresses it carries to the address
+// book with the provided TTL. The envelope is verified and decoded with Options.PeerRecordUnmarshaler.
+//
+// A record is only accepted if no unexpired record with a higher sequence number is held for the peer; an accepted
+// record replaces the stored one. The return value indicates whether the record was accepted. If its addresses can't
+// be stored, the record is rejected with an error, and the previously held one is restored.
+func (ab *dsAddrBook) ConsumePeerRecord(envelope []byte, ttl time.Duration) (accepted bool, err error) {
+	ab.beginWrite()
+	defer ab.endWrite()
+
+	if ab.opts.PeerRecordUnmarshaler == nil {
+		return false, ErrNoPeerRecordUnmarshaler
+	}
+	rec, err := ab.opts.PeerRecordUnmarshaler(envelope)
+	if err != nil {
+		return false, fmt.Errorf("failed to unmarshal peer record, err: %v", err)
+	}
+	if ttl <= 0 {
+		return false, nil
+	}
+
+	ab.certifiedLk.Lock()
+	defer ab.certifiedLk.Unlock()
+
+	existing, err := ab.loadCertified(rec.PeerID)
+	if err != nil {
+		return false, err
+	}
+	if existing != nil && existing.Seq > rec.Seq {
+		return false, nil
+	}
+
+	cr := &pb.CertifiedRecord{
+		Seq:      rec.Seq,
+		Expiry:   ab.expiry(ab.clampTTL(ttl)),
+		Envelope: envelope,
+	}
+	if err = ab.storeCertified(rec.PeerID, cr); err != nil {
+		return false, err
+	}
+
+	if err = ab.setAddrs(ab.ds, rec.PeerID, ab.cleanAddrs(rec.Addrs), ttl, ttlExtend, nil); err != nil {
+		// the addresses merged in the cached record are discarded, and the peer record is rolled back, so that the one
+		// held keeps matching the addresses stored.
+		ab.cache.Remove(rec.PeerID)
+		var rollbackErr error
+		if existing != nil {
+			rollbackErr = ab.storeCertified(rec.PeerID, existing)
+		} else if rollbackErr = ab.ds.Delete(ab.certifiedKey(rec.PeerID)); rollbackErr == ds.ErrNotFound {
+			rollbackErr = nil
+		}
+		if rollbackErr != nil {
+			ab.log.Warningf("failed to roll back peer record for peer %v, err: %v", rec.PeerID, rollbackErr)
+		}
+		return false, fmt.Errorf("failed to add addrs of peer record for peer %v, err: %v", rec.PeerID, err)
+	}
+	return true, nil
+}
+
+// storeCertified encodes and stores the peer record of a peer. If the datastore supports native TTLs, the record is
+// stored with one, and left for the datastore to expire; see dsAddrBookGc.purgeCertified.
+func (ab *dsAddrBook) storeCertified(p peer.ID, cr *pb.CertifiedRecord) error {
+	data, err := cr.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to encode peer record for peer %v, err: %v", p, err)
+	}
+	key := ab.certifiedKey(p)
+	if ab.nativeTTL {
+		err = putWithTTL(ab.ds, key, data, time.Unix(cr.Expiry, 0).Sub(ab.clock.Now()))
+	} else {
+		err = ab.ds.Put(key, data)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store peer record for peer %v, err: %v", p, err)
+	}
+	return nil
+}
+
+// GetPeerRecord returns the signed envelope holding the latest peer record accepted for a peer, or nil if none is
+// held or it has expired.
+func (ab *dsAddrBook) GetPeerRecord(p peer.ID) []byte {
+	ab.certifiedLk.Lock()
+	defer ab.certifiedLk.Unlock()
+
+	cr, err := ab.loadCertified(p)
+	if err != nil {
+		ab.log.Warningf("failed to load peer record for peer %v, err: %v", p, err)
+		return nil
+	}
+	if cr == nil {
+		return nil
+	}
+	return cr.Envelope
+}
+
+// loadCertified fetches the stored peer record for a peer, returning nil if none is held. Expired records are deleted
+// and reported as absent. To be called while holding certifiedLk.
+func (ab *dsAddrBook) loadCertified(p peer.ID) (*pb.CertifiedRecord, error) {
+	key := ab.certifiedKey(p)
+	data, err := ab.ds.Get(key)
+	switch err {
+	case nil:
+	case ds.ErrNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("failed to fetch peer record for peer %v, err: %v", p, err)
+	}
+
+	cr := new(pb.CertifiedRecord)
+	if err = cr.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("failed to decode peer record for peer %v, err: %v", p, err)
+	}
+	if cr.Expiry <= ab.clock.Now().Unix() {
+		if err = ab.ds.Delete(key); err != nil {
+			ab.log.Warningf("failed to delete expired peer record for peer %v, err: %v", p, err)
+		}
+		return nil, nil
+	}
+	return cr, nil
+}
+
+// expireCertified deletes the stored peer record for a peer if it has expired, returning the record still held
+// otherwise, if any.
+func (ab *dsAddrBook) expireCertified(p peer.ID) (*pb.CertifiedRecord, error) {
+	ab.certifiedLk.Lock()
+	defer ab.certifiedLk.Unlock()
+
+	return ab.loadCertified(p)
+}
+
+// deleteCertified removes the stored peer record for a peer, if any.
+func (ab *dsAddrBook) deleteCertified(p peer.ID) error {
+	ab.certifiedLk.Lock()
+	defer ab.certifiedLk.Unlock()
+
+	if err := ab.ds.Delete(ab.certifiedKey(p)); err != nil && err != ds.ErrNotFound {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package pstoreds
+
+import "time"
+
+// Clock abstracts the source of time used by the address book to compute and evaluate address expirations, and to
+// schedule GC. It exists so that tests can inject a mock clock and advance it manually, rather than sleeping.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After waits for the duration to elapse and then sends the current time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+
+	// NewTicker returns a new Ticker that ticks with the period specified by the duration argument.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker abstracts a time.Ticker, so that it can be driven by a Clock.
+type Ticker interface {
+	// Chan returns the channel on which the ticks are delivered.
+	Chan() <-chan time.Time
+
+	// Stop turns off the ticker.
+	Stop()
+}
+
+// realClock is the default Clock implementation, backed by the time package.
+type realClock struct{}
+
+var _ Clock = (*realClock)(nil)
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t *realTicker) Chan() <-chan time.Time {
+	return t.C
+}
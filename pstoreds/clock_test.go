@@ -0,0 +1,130 @@
+package pstoreds
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	test "github.com/libp2p/go-libp2p-peerstore/test"
+)
+
+// mockClock is a Clock whose time only moves forward when Advance is called.
+type mockClock struct {
+	sync.Mutex
+	now     time.Time
+	timers  []*mockTimer
+	tickers []*mockTicker
+}
+
+type mockTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+type mockTicker struct {
+	next   time.Time
+	period time.Duration
+	ch     chan time.Time
+}
+
+var _ Clock = (*mockClock)(nil)
+
+func newMockClock() *mockClock {
+	return &mockClock{now: time.Unix(1000000, 0)}
+}
+
+func (c *mockClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *mockClock) After(d time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+	t := &mockTimer{at: c.now.Add(d), ch: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	return t.ch
+}
+
+func (c *mockClock) NewTicker(d time.Duration) Ticker {
+	c.Lock()
+	defer c.Unlock()
+	t := &mockTicker{next: c.now.Add(d), period: d, ch: make(chan time.Time, 1)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward, firing any timers and tickers that became due.
+func (c *mockClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.ch <- c.now
+	}
+	c.timers = pending
+
+	for _, t := range c.tickers {
+		if t.next.After(c.now) {
+			continue
+		}
+		select {
+		case t.ch <- c.now:
+		default:
+		}
+		for !t.next.After(c.now) {
+			t.next = t.next.Add(t.period)
+		}
+	}
+}
+
+func (t *mockTicker) Chan() <-chan time.Time {
+	return t.ch
+}
+
+func (t *mockTicker) Stop() {}
+
+// newClockedAddrBook returns an address book backed by badger, with GC disabled and time driven by a mock clock. If
+// modify is non-nil, it adjusts the options before the address book is created.
+func newClockedAddrBook(t *testing.T, modify func(*Options)) (*dsAddrBook, *mockClock, func()) {
+	clock := newMockClock()
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.Clock = clock
+	if modify != nil {
+		modify(&opts)
+	}
+
+	ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+	return ab.(*dsAddrBook), clock, closeFn
+}
+
+func TestMockClockExpiry(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, nil)
+	defer closeFn()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(3)
+
+	ab.AddAddrs(id, addrs[:1], time.Hour)
+	ab.AddAddrs(id, addrs[1:], time.Minute)
+	test.AssertAddressesEqual(t, addrs, ab.Addrs(id))
+
+	clock.Advance(time.Minute + time.Second)
+	test.AssertAddressesEqual(t, addrs[:1], ab.Addrs(id))
+
+	clock.Advance(time.Hour)
+	ab.gc.purgeStore()
+	test.AssertAddressesEqual(t, nil, ab.Addrs(id))
+	if peers := ab.PeersWithAddrs(); len(peers) != 0 {
+		t.Fatalf("expected GC to purge the peer, got: %v", peers)
+	}
+}
@@ -0,0 +1,29 @@
+package pstoreds
+
+import (
+	pb "github.com/libp2p/go-libp2p-peerstore/pb"
+)
+
+// Codec serializes the per-peer records of the address book for storage, e.g. to store them in a format that other
+// tooling can read straight from the datastore. A datastore must always be accessed with the codec its records were
+// written with; records the codec fails to decode are treated as corrupt.
+type Codec interface {
+	// Marshal encodes a record.
+	Marshal(*pb.AddrBookRecord) ([]byte, error)
+
+	// Unmarshal decodes data into an empty record.
+	Unmarshal(data []byte, record *pb.AddrBookRecord) error
+}
+
+// ProtobufCodec is the default Codec. It encodes records in protobuf, as defined in pb/pstore.proto.
+var ProtobufCodec Codec = protobufCodec{}
+
+type protobufCodec struct{}
+
+func (protobufCodec) Marshal(record *pb.AddrBookRecord) ([]byte, error) {
+	return record.Marshal()
+}
+
+func (protobufCodec) Unmarshal(data []byte, record *pb.AddrBookRecord) error {
+	return record.Unmarshal(data)
+}
@@ -0,0 +1,92 @@
+package pstoreds
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+
+	pb "github.com/libp2p/go-libp2p-peerstore/pb"
+	test "github.com/libp2p/go-libp2p-peerstore/test"
+
+	b32 "github.com/multiformats/go-base32"
+)
+
+var codecMagic = []byte("test")
+
+// prefixedCodec tags protobuf-encoded records with a magic prefix, so they can be told apart in the datastore.
+type prefixedCodec struct{}
+
+func (prefixedCodec) Marshal(record *pb.AddrBookRecord) ([]byte, error) {
+	data, err := record.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, codecMagic...), data...), nil
+}
+
+func (prefixedCodec) Unmarshal(data []byte, record *pb.AddrBookRecord) error {
+	if !bytes.HasPrefix(data, codecMagic) {
+		return fmt.Errorf("missing magic prefix")
+	}
+	return record.Unmarshal(data[len(codecMagic):])
+}
+
+func TestCodec(t *testing.T) {
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.Codec = prefixedCodec{}
+
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	ids := test.GeneratePeerIDs(2)
+	addrs := test.GenerateAddrs(2)
+	for _, id := range ids {
+		ab.AddAddrs(id, addrs, time.Hour)
+	}
+
+	key := addrBookBase.ChildString(b32.RawStdEncoding.EncodeToString([]byte(ids[0])))
+	value, err := store.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(value, codecMagic) {
+		t.Fatal("expected the record to be stored with the configured codec")
+	}
+
+	// records are read back through the codec, bypassing the cache.
+	fresh, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	test.AssertAddressesEqual(t, addrs, fresh.Addrs(ids[0]))
+	if n := len(fresh.PeersWithAddrs()); n != 2 {
+		t.Fatalf("expected 2 peers, got %d", n)
+	}
+
+	// exports are codec-agnostic.
+	var buf bytes.Buffer
+	if err = ab.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := NewAddrBook(context.Background(), dssync.MutexWrap(ds.NewMapDatastore()), DefaultOpts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if err = plain.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+	test.AssertAddressesEqual(t, addrs, plain.Addrs(ids[1]))
+}
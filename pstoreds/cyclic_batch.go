@@ -1,6 +1,8 @@
 package pstoreds
 
 import (
+	"time"
+
 	"github.com/pkg/errors"
 
 	ds "github.com/ipfs/go-datastore"
@@ -9,8 +11,8 @@ import (
 // how many operations are queued in a cyclic batch before we flush it.
 var defaultOpsPerCyclicBatch = 20
 
-// cyclicBatch buffers ds write operations and automatically flushes them after defaultOpsPerCyclicBatch (20) have been
-// queued. An explicit `Commit()` closes this cyclic batch, erroring all further operations.
+// cyclicBatch buffers ds write operations and automatically flushes them after a threshold of operations have been
+// queued; see dsAddrBook.batchSize. An explicit `Commit()` closes this cyclic batch, erroring all further operations.
 //
 // It is similar to go-ds autobatch, but it's driven by an actual Batch facility offered by the
 // ds.
@@ -26,7 +28,7 @@ func newCyclicBatch(ds ds.Batching, threshold int) (ds.Batch, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &cyclicBatch{Batch: batch, ds: ds}, nil
+	return &cyclicBatch{Batch: batch, ds: ds, threshold: threshold}, nil
 }
 
 func (cb *cyclicBatch) cycle() (err error) {
@@ -44,6 +46,7 @@ func (cb *cyclicBatch) cycle() (err error) {
 	if cb.Batch, err = cb.ds.Batch(); err != nil {
 		return errors.Wrap(err, "failed while renewing cyclic batch")
 	}
+	cb.pending = 0
 	return nil
 }
 
@@ -55,6 +58,14 @@ func (cb *cyclicBatch) Put(key ds.Key, val []byte) error {
 	return cb.Batch.Put(key, val)
 }
 
+func (cb *cyclicBatch) PutWithTTL(key ds.Key, val []byte, ttl time.Duration) error {
+	if err := cb.cycle(); err != nil {
+		return err
+	}
+	cb.pending++
+	return putWithTTL(cb.Batch, key, val, ttl)
+}
+
 func (cb *cyclicBatch) Delete(key ds.Key) error {
 	if err := cb.cycle(); err != nil {
 		return err
@@ -0,0 +1,83 @@
+package pstoreds
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+)
+
+// UseDefaultTTL is a sentinel TTL that, when passed to the methods of the AddrBook that add or set addresses, stands
+// for the default TTL registered for the peer via SetDefaultTTL, or peerstore.AddressTTL if none was registered.
+const UseDefaultTTL = pstore.ConnectedAddrTTL - 1
+
+// Default TTLs are stored as varints, under the following db key pattern:
+// /peers/ttls/<b32 peer id no padding>
+var defaultTTLBase = ds.NewKey("/peers/ttls")
+
+// SetDefaultTTL registers the TTL that addresses of a peer are added with when UseDefaultTTL is passed, e.g. to keep
+// the addresses of bootstrap nodes or relays longer than those of transient peers. It persists until cleared with
+// ClearDefaultTTL, and doesn't affect the addresses already held.
+func (ab *dsAddrBook) SetDefaultTTL(p peer.ID, ttl time.Duration) error {
+	if ttl <= 0 || ttl == UseDefaultTTL {
+		return fmt.Errorf("invalid default TTL provided for peer %v: %s", p, ttl)
+	}
+	if err := p.Validate(); err != nil {
+		return fmt.Errorf("refusing to set default TTL, err: %v", err)
+	}
+
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(buf, int64(ttl))
+	if err := ab.ds.Put(ab.defaultTTLKey(p), buf[:n]); err != nil {
+		return fmt.Errorf("failed to store default TTL for peer %v, err: %v", p, err)
+	}
+	return nil
+}
+
+// ClearDefaultTTL unregisters the default TTL of a peer, if any.
+func (ab *dsAddrBook) ClearDefaultTTL(p peer.ID) error {
+	err := ab.ds.Delete(ab.defaultTTLKey(p))
+	if err != nil && err != ds.ErrNotFound {
+		return fmt.Errorf("failed to clear default TTL for peer %v, err: %v", p, err)
+	}
+	return nil
+}
+
+// DefaultTTL returns the default TTL registered for a peer. The second return value is false if none was registered.
+func (ab *dsAddrBook) DefaultTTL(p peer.ID) (time.Duration, bool) {
+	value, err := ab.ds.Get(ab.defaultTTLKey(p))
+	switch err {
+	case nil:
+	case ds.ErrNotFound:
+		return 0, false
+	default:
+		ab.log.Warningf("failed to load default TTL for peer %v, err: %v", p, err)
+		return 0, false
+	}
+
+	v, n := binary.Varint(value)
+	if n <= 0 {
+		ab.log.Warningf("malformed default TTL value for peer %v", p)
+		return 0, false
+	}
+	return time.Duration(v), true
+}
+
+// resolveTTL substitutes the default TTL of the peer for UseDefaultTTL.
+func (ab *dsAddrBook) resolveTTL(p peer.ID, ttl time.Duration) time.Duration {
+	if ttl != UseDefaultTTL {
+		return ttl
+	}
+	if def, ok := ab.DefaultTTL(p); ok {
+		return def
+	}
+	return pstore.AddressTTL
+}
+
+func (ab *dsAddrBook) defaultTTLKey(p peer.ID) ds.Key {
+	return ab.keys.child(defaultTTLBase, p)
+}
@@ -0,0 +1,56 @@
+package pstoreds
+
+import (
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	test "github.com/libp2p/go-libp2p-peerstore/test"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestDefaultTTL(t *testing.T) {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+
+	ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+	defer closeFn()
+	dsab := ab.(*dsAddrBook)
+
+	ids := test.GeneratePeerIDs(2)
+	addrs := test.GenerateAddrs(3)
+
+	if err := dsab.SetDefaultTTL(ids[0], 0); err == nil {
+		t.Fatal("expected a non-positive default TTL to be rejected")
+	}
+	if err := dsab.SetDefaultTTL(ids[0], 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, ok := dsab.DefaultTTL(ids[0]); !ok || ttl != 24*time.Hour {
+		t.Fatalf("expected a default TTL of 24h, got %s", ttl)
+	}
+
+	assertTTL := func(id peer.ID, addr ma.Multiaddr, want time.Duration) {
+		t.Helper()
+		if ttl, _, ok := dsab.GetTTL(id, addr); !ok || ttl != want {
+			t.Fatalf("expected a TTL of %s, got %s", want, ttl)
+		}
+	}
+
+	// peers without a default TTL fall back to peerstore.AddressTTL.
+	ab.AddAddr(ids[0], addrs[0], UseDefaultTTL)
+	ab.SetAddr(ids[1], addrs[1], UseDefaultTTL)
+	assertTTL(ids[0], addrs[0], 24*time.Hour)
+	assertTTL(ids[1], addrs[1], pstore.AddressTTL)
+
+	if err := dsab.ClearDefaultTTL(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dsab.DefaultTTL(ids[0]); ok {
+		t.Fatal("expected the default TTL to be cleared")
+	}
+	ab.AddAddr(ids[0], addrs[2], UseDefaultTTL)
+	assertTTL(ids[0], addrs[2], pstore.AddressTTL)
+}
@@ -0,0 +1,115 @@
+package pstoreds
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pb "github.com/libp2p/go-libp2p-peerstore/pb"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// RecordDialSuccess records that a dial to an address of a peer succeeded, clearing its tally of failed dials. It
+// does nothing if the address is not held for the peer.
+func (ab *dsAddrBook) RecordDialSuccess(p peer.ID, addr ma.Multiaddr) {
+	now := ab.clock.Now().Unix()
+	ab.updateEntry("RecordDialSuccess", p, addr, func(entry *pb.AddrBookRecord_AddrEntry) {
+		entry.LastDialSuccess, entry.DialFailures = now, 0
+	})
+}
+
+// RecordDialFailure records that a dial to an address of a peer failed. It does nothing if the address is not held
+// for the peer.
+func (ab *dsAddrBook) RecordDialFailure(p peer.ID, addr ma.Multiaddr) {
+	ab.updateEntry("RecordDialFailure", p, addr, func(entry *pb.AddrBookRecord_AddrEntry) {
+		entry.DialFailures++
+	})
+}
+
+// DialableAddrs returns the non-expired addresses of a peer, sorted by dial reliability, as recorded with
+// RecordDialSuccess and RecordDialFailure. Addresses that were successfully dialed at some point come first, followed
+// by those that never were. Within each group, addresses that failed fewer dials in a row come first, then the most
+// recently dialed ones, and then those with the highest priority.
+func (ab *dsAddrBook) DialableAddrs(p peer.ID) []ma.Multiaddr {
+	pr, err := ab.loadRecord(p, true, true)
+	if err != nil {
+		ab.log.Warningf("failed to load peerstore entry for peer %v while querying addrs, err: %v", p, err)
+		return nil
+	}
+
+	pr.RLock()
+	defer pr.RUnlock()
+
+	live := pr.live(ab.clock.Now().Unix())
+	entries := make([]*pb.AddrBookRecord_AddrEntry, len(live))
+	copy(entries, live)
+	sort.SliceStable(entries, func(i, j int) bool {
+		ei, ej := entries[i], entries[j]
+		if si, sj := ei.LastDialSuccess > 0, ej.LastDialSuccess > 0; si != sj {
+			return si
+		}
+		if ei.DialFailures != ej.DialFailures {
+			return ei.DialFailures < ej.DialFailures
+		}
+		if ei.LastDialSuccess != ej.LastDialSuccess {
+			return ei.LastDialSuccess > ej.LastDialSuccess
+		}
+		return ei.Priority > ej.Priority
+	})
+
+	addrs := make([]ma.Multiaddr, len(entries))
+	for i, entry := range entries {
+		addrs[i] = entry.Addr
+	}
+	return addrs
+}
+
+// AddrsForExchange returns the non-expired addresses of a peer that are fresh enough to share with other peers, e.g.
+// over a peer exchange protocol: those first added, or successfully dialed, within maxAge. They are sorted by
+// descending priority.
+func (ab *dsAddrBook) AddrsForExchange(p peer.ID, maxAge time.Duration) []ma.Multiaddr {
+	since := ab.clock.Now().Add(-maxAge).Unix()
+	addrs, err := ab.addrs(context.Background(), p, func(e *pb.AddrBookRecord_AddrEntry) bool {
+		return e.Added >= since || e.LastDialSuccess >= since
+	})
+	if err != nil {
+		ab.log.Warningf("failed to load peerstore entry for peer %v while querying addrs, err: %v", p, err)
+	}
+	return addrs
+}
+
+// updateEntry applies fn to the entry of an address of a peer, if held, and saves the resulting record. op names the
+// calling method, to report failures.
+func (ab *dsAddrBook) updateEntry(op string, p peer.ID, addr ma.Multiaddr, fn func(*pb.AddrBookRecord_AddrEntry)) {
+	ab.beginWrite()
+	defer ab.endWrite()
+
+	pr, err := ab.loadRecord(p, true, false)
+	if err != nil {
+		ab.log.Errorf("failed to load peerstore entry for peer %s while updating addr: %s\n", p.Pretty(), err)
+		ab.writeFailed(p, op, err)
+		return
+	}
+
+	pr.Lock()
+
+	for _, entry := range pr.live(ab.clock.Now().Unix()) {
+		if entry.Addr.Equal(addr) {
+			fn(entry)
+			pr.dirty = true
+			break
+		}
+	}
+
+	if ab.clean(pr) {
+		err = ab.flushRecord(ab.ds, pr)
+	}
+	pr.Unlock()
+
+	if err != nil {
+		ab.log.Errorf("failed to save peerstore entry for peer %s while updating addr: %s\n", p.Pretty(), err)
+		ab.writeFailed(p, op, err)
+	}
+}
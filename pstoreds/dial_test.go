@@ -0,0 +1,82 @@
+package pstoreds
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	test "github.com/libp2p/go-libp2p-peerstore/test"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestDialableAddrs(t *testing.T) {
+	clock := newMockClock()
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.Clock = clock
+
+	store, closeStore := badgerStore(t)
+	defer closeStore()
+
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(4)
+	ab.AddAddrs(id, addrs, time.Hour)
+
+	ab.RecordDialFailure(id, addrs[0])
+	ab.RecordDialSuccess(id, addrs[1])
+	clock.Advance(time.Second)
+	ab.RecordDialSuccess(id, addrs[2])
+	ab.RecordDialFailure(id, addrs[1])
+
+	want := []ma.Multiaddr{addrs[2], addrs[1], addrs[3], addrs[0]}
+	assertOrder := func(got []ma.Multiaddr) {
+		t.Helper()
+		for i := range want {
+			if !want[i].Equal(got[i]) {
+				t.Fatalf("expected %v, got %v", want, got)
+			}
+		}
+	}
+	assertOrder(ab.DialableAddrs(id))
+
+	// dial outcomes are persisted along with the addresses.
+	fresh, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	assertOrder(fresh.DialableAddrs(id))
+
+	// a success clears the tally of failures.
+	clock.Advance(time.Second)
+	ab.RecordDialSuccess(id, addrs[0])
+	if got := ab.DialableAddrs(id); !got[0].Equal(addrs[0]) {
+		t.Fatalf("expected %v to be dialed first, got %v", addrs[0], got)
+	}
+}
+
+func TestAddrsForExchange(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, nil)
+	defer closeFn()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addrs := test.GenerateAddrs(3)
+
+	ab.AddAddrs(id, addrs[:2], 24*time.Hour)
+	clock.Advance(time.Hour)
+	ab.RecordDialSuccess(id, addrs[1])
+	clock.Advance(time.Hour)
+	ab.AddAddr(id, addrs[2], 24*time.Hour)
+
+	test.AssertAddressesEqual(t, addrs[2:], ab.AddrsForExchange(id, 30*time.Minute))
+	test.AssertAddressesEqual(t, addrs[1:], ab.AddrsForExchange(id, 90*time.Minute))
+	test.AssertAddressesEqual(t, addrs, ab.AddrsForExchange(id, 3*time.Hour))
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
 	badger "github.com/ipfs/go-ds-badger"
 	leveldb "github.com/ipfs/go-ds-leveldb"
 
@@ -32,6 +33,7 @@ func TestDsPeerstore(t *testing.T) {
 
 func TestDsAddrBook(t *testing.T) {
 	for name, dsFactory := range dstores {
+		dsFactory := dsFactory
 		t.Run(name+" Cacheful", func(t *testing.T) {
 			t.Parallel()
 
@@ -42,6 +44,17 @@ func TestDsAddrBook(t *testing.T) {
 			pt.TestAddrBook(t, addressBookFactory(t, dsFactory, opts))
 		})
 
+		t.Run(name+" Cacheful by addr", func(t *testing.T) {
+			t.Parallel()
+
+			opts := DefaultOpts()
+			opts.GCPurgeInterval = 1 * time.Second
+			opts.CacheSize = 64
+			opts.CacheSizeMode = CacheByAddr
+
+			pt.TestAddrBook(t, addressBookFactory(t, dsFactory, opts))
+		})
+
 		t.Run(name+" Cacheless", func(t *testing.T) {
 			t.Parallel()
 
@@ -54,6 +67,21 @@ func TestDsAddrBook(t *testing.T) {
 	}
 }
 
+func TestDsAddrBookNonBatching(t *testing.T) {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 1 * time.Second
+
+	pt.TestAddrBook(t, func() (pstore.AddrBook, func()) {
+		// hide the Batch method of the map datastore.
+		store := struct{ ds.Datastore }{dssync.MutexWrap(ds.NewMapDatastore())}
+		ab, err := NewAddrBook(context.Background(), store, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ab, func() { ab.Close() }
+	})
+}
+
 func TestDsKeyBook(t *testing.T) {
 	for name, dsFactory := range dstores {
 		t.Run(name, func(t *testing.T) {
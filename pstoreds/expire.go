@@ -0,0 +1,102 @@
+package pstoreds
+
+import (
+	"sync"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// expiredAddrs are the addresses of a peer dropped by a single cleanup of its record.
+type expiredAddrs struct {
+	id    peer.ID
+	addrs []ma.Multiaddr
+}
+
+// defaultOnExpireQueueSize is the number of expirations queued for OnExpire if Options.OnExpireQueueSize is not set.
+const defaultOnExpireQueueSize = 1024
+
+// expiryNotifier hands expired addresses to Options.OnExpire. Expirations are detected while records are locked, so
+// they're queued, and the callback is invoked from a dedicated goroutine, in the order they were queued. This lets
+// the callback call back into the address book without deadlocking. The queue is bounded; expirations that don't fit
+// are dropped, as waiting for room would hold the records up behind the callback.
+type expiryNotifier struct {
+	fn  func(peer.ID, []ma.Multiaddr)
+	log Logger
+	max int
+
+	lk      sync.Mutex
+	pending []expiredAddrs
+	dropped int
+	signal  chan struct{}
+}
+
+func newExpiryNotifier(ab *dsAddrBook, fn func(peer.ID, []ma.Multiaddr), max int) *expiryNotifier {
+	if max <= 0 {
+		max = defaultOnExpireQueueSize
+	}
+	n := &expiryNotifier{fn: fn, log: ab.log, max: max, signal: make(chan struct{}, 1)}
+
+	ab.childrenDone.Add(1)
+	go n.background(ab)
+
+	return n
+}
+
+// notify queues the expired addresses of a peer, or drops them if the queue is full. It's a no-op on a nil notifier,
+// i.e. if no callback is set.
+func (n *expiryNotifier) notify(p peer.ID, addrs []ma.Multiaddr) {
+	if n == nil || len(addrs) == 0 {
+		return
+	}
+
+	n.lk.Lock()
+	if len(n.pending) < n.max {
+		n.pending = append(n.pending, expiredAddrs{id: p, addrs: addrs})
+	} else {
+		n.dropped++
+	}
+	n.lk.Unlock()
+
+	select {
+	case n.signal <- struct{}{}:
+	default:
+		// the notifier has already been signalled.
+	}
+}
+
+// background invokes the callback for queued expirations, until the address book is closed. Expirations still queued
+// by then are delivered before returning.
+func (n *expiryNotifier) background(ab *dsAddrBook) {
+	defer ab.childrenDone.Done()
+
+	for {
+		select {
+		case <-n.signal:
+			n.drain()
+		case <-ab.ctx.Done():
+			n.drain()
+			return
+		}
+	}
+}
+
+func (n *expiryNotifier) drain() {
+	for {
+		n.lk.Lock()
+		pending, dropped := n.pending, n.dropped
+		n.pending, n.dropped = nil, 0
+		n.lk.Unlock()
+
+		if dropped > 0 {
+			n.log.Warningf("dropped %d expirations queued behind a slow OnExpire callback", dropped)
+		}
+		if len(pending) == 0 {
+			return
+		}
+		for _, e := range pending {
+			n.fn(e.id, e.addrs)
+		}
+	}
+}
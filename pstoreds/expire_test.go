@@ -0,0 +1,132 @@
+package pstoreds
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	test "github.com/libp2p/go-libp2p-peerstore/test"
+)
+
+func TestOnExpire(t *testing.T) {
+	type expiration struct {
+		id    peer.ID
+		addrs []ma.Multiaddr
+	}
+	expired := make(chan expiration, 10)
+
+	var ab *dsAddrBook
+	ab, clock, closeFn := newClockedAddrBook(t, func(o *Options) {
+		o.OnExpire = func(p peer.ID, addrs []ma.Multiaddr) {
+			// calling back into the address book must not deadlock.
+			ab.Addrs(p)
+			expired <- expiration{p, addrs}
+		}
+	})
+	defer closeFn()
+
+	ids := test.GeneratePeerIDs(2)
+	addrs := test.GenerateAddrs(4)
+
+	ab.AddAddrs(ids[0], addrs[:2], time.Minute)
+	ab.AddAddrs(ids[0], addrs[2:3], time.Hour)
+	ab.AddAddrs(ids[1], addrs[3:], time.Minute)
+
+	receive := func() expiration {
+		select {
+		case e := <-expired:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for expired addrs")
+		}
+		return expiration{}
+	}
+
+	clock.Advance(2 * time.Minute)
+
+	// expirations are noticed when a record is read...
+	test.AssertAddressesEqual(t, addrs[2:3], ab.Addrs(ids[0]))
+	if e := receive(); e.id != ids[0] {
+		t.Fatalf("expected expired addrs of peer %s, got: %s", ids[0], e.id)
+	} else {
+		test.AssertAddressesEqual(t, addrs[:2], e.addrs)
+	}
+
+	// ... and by the GC.
+	if err := ab.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if e := receive(); e.id != ids[1] {
+		t.Fatalf("expected expired addrs of peer %s, got: %s", ids[1], e.id)
+	} else {
+		test.AssertAddressesEqual(t, addrs[3:], e.addrs)
+	}
+
+	select {
+	case e := <-expired:
+		t.Fatalf("unexpected expiration for peer %s: %v", e.id, e.addrs)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestOnExpireQueueSize(t *testing.T) {
+	logger := new(recordingLogger)
+	called := make(chan peer.ID, 10)
+	release := make(chan struct{})
+
+	ab, clock, closeFn := newClockedAddrBook(t, func(o *Options) {
+		o.Logger = logger
+		o.OnExpireQueueSize = 1
+		o.OnExpire = func(p peer.ID, _ []ma.Multiaddr) {
+			called <- p
+			<-release
+		}
+	})
+	defer closeFn()
+
+	ids := test.GeneratePeerIDs(4)
+	for _, id := range ids {
+		ab.AddAddrs(id, test.GenerateAddrs(1), time.Minute)
+	}
+	clock.Advance(2 * time.Minute)
+
+	receive := func() peer.ID {
+		select {
+		case p := <-called:
+			return p
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for expired addrs")
+		}
+		return ""
+	}
+
+	// the callback holds up the first expiration; one more is queued behind it, and the rest are dropped.
+	ab.Addrs(ids[0])
+	if p := receive(); p != ids[0] {
+		t.Fatalf("expected expired addrs of peer %s, got: %s", ids[0], p)
+	}
+	for _, id := range ids[1:] {
+		ab.Addrs(id)
+	}
+	close(release)
+
+	if p := receive(); p != ids[1] {
+		t.Fatalf("expected expired addrs of peer %s, got: %s", ids[1], p)
+	}
+	select {
+	case p := <-called:
+		t.Fatalf("unexpected expiration for peer %s", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	var warned bool
+	for _, msg := range logger.messages() {
+		warned = warned || strings.Contains(msg, "dropped 2 expirations")
+	}
+	if !warned {
+		t.Fatalf("expected the dropped expirations to be logged, got: %q", logger.messages())
+	}
+}
@@ -0,0 +1,166 @@
+package pstoreds
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	query "github.com/ipfs/go-datastore/query"
+
+	pb "github.com/libp2p/go-libp2p-peerstore/pb"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// maxExportRecordSize bounds the size of a single record read by Import, as a protection against corrupt input.
+const maxExportRecordSize = 1 << 22
+
+var exportQuery = query.Query{
+	Prefix:   addrBookBase.String(),
+	Orders:   []query.Order{query.OrderByKey{}},
+	KeysOnly: false,
+}
+
+// Export writes the addresses of all peers to w, along with their TTLs and expiration times, so that they can be
+// loaded into another address book with Import; e.g. to migrate to a different datastore backend.
+//
+// The output is a stream of peer records, each one serialized into protobuf (regardless of Options.Codec) and prefixed
+// by its length as an unsigned varint. Records are streamed straight from a datastore query, so the store is never
+// held in memory at once.
+func (ab *dsAddrBook) Export(w io.Writer) error {
+	results, err := ab.scan(exportQuery)
+	if err != nil {
+		return fmt.Errorf("failed while opening iterator to export addrs, err: %v", err)
+	}
+	defer results.Close()
+
+	bw := bufio.NewWriter(w)
+	lbuf := make([]byte, binary.MaxVarintLen64)
+	for result := range results.Next() {
+		if result.Error != nil {
+			return fmt.Errorf("failed while iterating entries to export addrs, err: %v", result.Error)
+		}
+		value := result.Value
+		if ab.codec != ProtobufCodec {
+			// records stored with a custom codec are exported in protobuf all the same.
+			record := &pb.AddrBookRecord{}
+			if err = ab.codec.Unmarshal(value, record); err != nil {
+				return fmt.Errorf("failed while decoding record with key %v to export addrs, err: %v", result.Key, err)
+			}
+			if value, err = record.Marshal(); err != nil {
+				return err
+			}
+		}
+		n := binary.PutUvarint(lbuf, uint64(len(value)))
+		if _, err = bw.Write(lbuf[:n]); err != nil {
+			return err
+		}
+		if _, err = bw.Write(value); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Import reads peer records written by Export from r, and merges them into the address book. Imported addresses keep
+// their original TTLs and expiration times; addresses that have expired in the meantime are skipped. When an address
+// is already held, the later expiration wins, so running the same import twice is harmless.
+func (ab *dsAddrBook) Import(r io.Reader) error {
+	ab.beginWrite()
+	defer ab.endWrite()
+
+	br := bufio.NewReader(r)
+	var buf []byte
+	for {
+		l, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed while reading record length to import addrs, err: %v", err)
+		}
+		if l > maxExportRecordSize {
+			return fmt.Errorf("record to import exceeds the maximum size: %d", l)
+		}
+
+		if uint64(cap(buf)) < l {
+			buf = make([]byte, l)
+		}
+		buf = buf[:l]
+		if _, err = io.ReadFull(br, buf); err != nil {
+			return fmt.Errorf("failed while reading record to import addrs, err: %v", err)
+		}
+
+		record := &pb.AddrBookRecord{}
+		if err = record.Unmarshal(buf); err != nil {
+			return fmt.Errorf("failed while unmarshalling record to import addrs, err: %v", err)
+		}
+		if record.Id == nil {
+			return fmt.Errorf("record to import has no peer ID")
+		}
+		if err = ab.importRecord(record); err != nil {
+			return err
+		}
+	}
+}
+
+// importRecord merges the entries of an exported record into the record held for the same peer.
+func (ab *dsAddrBook) importRecord(in *pb.AddrBookRecord) error {
+	p := in.Id.ID
+	if err := p.Validate(); err != nil {
+		return fmt.Errorf("refusing to import addrs, err: %v", err)
+	}
+	pr, err := ab.loadRecord(p, true, false)
+	if err != nil {
+		return fmt.Errorf("failed to load peerstore entry for peer %v while importing addrs, err: %v", p, err)
+	}
+
+	pr.Lock()
+	defer pr.Unlock()
+
+	now := ab.clock.Now().Unix()
+	updated := false
+
+	var added []*pb.AddrBookRecord_AddrEntry
+Outer:
+	for _, incoming := range in.Addrs {
+		if incoming.Addr == nil || incoming.Expiry <= now {
+			continue
+		}
+		for _, have := range pr.Addrs {
+			if incoming.Addr.Equal(have.Addr) {
+				if have.Expiry < incoming.Expiry {
+					have.Ttl, have.Expiry, have.Priority = incoming.Ttl, incoming.Expiry, incoming.Priority
+					updated = true
+				}
+				continue Outer
+			}
+		}
+		added = append(added, incoming)
+	}
+
+	if len(added) == 0 && !updated && !pr.dirty {
+		return nil
+	}
+
+	pr.Addrs = append(pr.Addrs, added...)
+	pr.dirty = true
+	ab.clean(pr)
+
+	evicted := ab.enforceAddrLimit(pr)
+
+	broadcast := make([]ma.Multiaddr, 0, len(added))
+Broadcast:
+	for _, entry := range added {
+		for _, e := range evicted {
+			if e == entry {
+				continue Broadcast
+			}
+		}
+		broadcast = append(broadcast, entry.Addr.Multiaddr)
+	}
+	ab.subsManager.BroadcastAddrs(p, broadcast)
+	ab.history.record(p, AddrAdded, broadcast...)
+
+	return ab.flushRecord(ab.ds, pr)
+}
@@ -0,0 +1,111 @@
+package pstoreds
+
+import (
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// AddrChangeKind is the kind of change an AddrChange records.
+type AddrChangeKind int
+
+const (
+	// AddrAdded records that an address was added to a peer that didn't hold it.
+	AddrAdded AddrChangeKind = iota
+	// AddrRemoved records that an address was removed from a peer, cleared, or evicted to honour
+	// Options.MaxAddrsPerPeer.
+	AddrRemoved
+	// AddrExpired records that an address was dropped from a peer as it expired.
+	AddrExpired
+)
+
+// AddrChange is an entry in the history of the addresses of a peer. See AddrHistory.
+type AddrChange struct {
+	Addr ma.Multiaddr
+	Kind AddrChangeKind
+	At   time.Time
+}
+
+// defaultAddrHistoryPeers is the number of peers whose history is kept if Options.AddrHistoryPeers is not set.
+const defaultAddrHistoryPeers = 1024
+
+// addrHistory keeps the recent address changes of the peers changed the most recently, in per-peer ring buffers.
+type addrHistory struct {
+	lk    sync.Mutex
+	size  int
+	peers *lru.Cache
+	clock Clock
+}
+
+// changeRing is a ring buffer of address changes, which overwrites the oldest change once full.
+type changeRing struct {
+	changes []AddrChange
+	next    int
+}
+
+func newAddrHistory(size, peers int, clock Clock) (*addrHistory, error) {
+	if peers <= 0 {
+		peers = defaultAddrHistoryPeers
+	}
+	cache, err := lru.New(peers)
+	if err != nil {
+		return nil, err
+	}
+	return &addrHistory{size: size, peers: cache, clock: clock}, nil
+}
+
+// record appends a change of the given kind for each address. It's a no-op on a nil history, i.e. if history
+// recording is disabled.
+func (h *addrHistory) record(p peer.ID, kind AddrChangeKind, addrs ...ma.Multiaddr) {
+	if h == nil || len(addrs) == 0 {
+		return
+	}
+
+	now := h.clock.Now()
+
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	var ring *changeRing
+	if v, ok := h.peers.Get(p); ok {
+		ring = v.(*changeRing)
+	} else {
+		ring = &changeRing{changes: make([]AddrChange, 0, h.size)}
+		h.peers.Add(p, ring)
+	}
+	for _, addr := range addrs {
+		change := AddrChange{Addr: addr, Kind: kind, At: now}
+		if len(ring.changes) < h.size {
+			ring.changes = append(ring.changes, change)
+			continue
+		}
+		ring.changes[ring.next] = change
+		ring.next = (ring.next + 1) % h.size
+	}
+}
+
+// AddrHistory returns the recent changes to the addresses of a peer, oldest first, if enabled with
+// Options.AddrHistorySize; e.g. to find out why the addresses of a peer flap. Histories are held in memory only.
+func (ab *dsAddrBook) AddrHistory(p peer.ID) []AddrChange {
+	h := ab.history
+	if h == nil {
+		return nil
+	}
+
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	v, ok := h.peers.Peek(p)
+	if !ok {
+		return nil
+	}
+	ring := v.(*changeRing)
+	changes := make([]AddrChange, 0, len(ring.changes))
+	changes = append(changes, ring.changes[ring.next:]...)
+	return append(changes, ring.changes[:ring.next]...)
+}
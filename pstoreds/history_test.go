@@ -0,0 +1,52 @@
+package pstoreds
+
+import (
+	"testing"
+	"time"
+
+	test "github.com/libp2p/go-libp2p-peerstore/test"
+)
+
+func TestAddrHistory(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, func(o *Options) { o.AddrHistorySize = 4 })
+	defer closeFn()
+
+	ids := test.GeneratePeerIDs(2)
+	addrs := test.GenerateAddrs(3)
+
+	if h := ab.AddrHistory(ids[0]); len(h) != 0 {
+		t.Fatalf("expected no history, got %v", h)
+	}
+
+	ab.AddAddrs(ids[0], addrs[:2], time.Minute)
+	clock.Advance(time.Second)
+	ab.SetAddr(ids[0], addrs[0], 0)
+	clock.Advance(time.Minute)
+	ab.Addrs(ids[0])
+
+	type change struct {
+		idx  int
+		kind AddrChangeKind
+	}
+	assertHistory := func(want []change) {
+		t.Helper()
+		got := ab.AddrHistory(ids[0])
+		if len(got) != len(want) {
+			t.Fatalf("expected %d changes, got %d: %v", len(want), len(got), got)
+		}
+		for i, w := range want {
+			if !got[i].Addr.Equal(addrs[w.idx]) || got[i].Kind != w.kind {
+				t.Fatalf("expected change #%d to be %v of %v, got %v of %v", i, w.kind, addrs[w.idx], got[i].Kind, got[i].Addr)
+			}
+		}
+	}
+	assertHistory([]change{{0, AddrAdded}, {1, AddrAdded}, {0, AddrRemoved}, {1, AddrExpired}})
+
+	// the oldest changes are dropped once the buffer is full.
+	ab.AddAddr(ids[0], addrs[2], time.Hour)
+	assertHistory([]change{{1, AddrAdded}, {0, AddrRemoved}, {1, AddrExpired}, {2, AddrAdded}})
+
+	if h := ab.AddrHistory(ids[1]); len(h) != 0 {
+		t.Fatalf("expected no history for an untouched peer, got %v", h)
+	}
+}
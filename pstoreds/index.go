@@ -0,0 +1,271 @@
+package pstoreds
+
+import (
+	"fmt"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	query "github.com/ipfs/go-datastore/query"
+)
+
+var (
+	// Address records are indexed with an empty entry each, named after the key of the record (i.e. the b32 encoded
+	// peer ID), under the following db key pattern:
+	// /peers/index/addrs/<b32 peer id no padding>
+	addrIndexBase = ds.NewKey("/peers/index/addrs")
+
+	purgeIndexQuery = query.Query{
+		Prefix:   addrIndexBase.String(),
+		KeysOnly: true,
+	}
+)
+
+// indexedStore keeps an index of the address records held in a datastore, so that they can be enumerated with a
+// keys-only query over the index entries; see Options.IndexAddrs. Queries for the address records are served from the
+// index, by fetching the records one by one. All other queries, reads and writes are passed through.
+//
+// Records and their index entries are written together in a batch, so the index doesn't need to be loaded, and
+// updating it costs a single write whatever the number of peers.
+type indexedStore struct {
+	ds.Batching
+}
+
+var _ ds.Batching = (*indexedStore)(nil)
+
+func newIndexedStore(store ds.Batching) (*indexedStore, error) {
+	s := &indexedStore{Batching: store}
+	if err := s.migrate(); err != nil {
+		return nil, fmt.Errorf("failed to migrate the index of address records, err: %v", err)
+	}
+	return s, nil
+}
+
+// migrate converts the index persisted whole by earlier versions, as the newline-separated names of the records under
+// the index base key, into one entry per record.
+func (s *indexedStore) migrate() error {
+	data, err := s.Batching.Get(addrIndexBase)
+	switch err {
+	case nil:
+	case ds.ErrNotFound:
+		return nil
+	default:
+		return err
+	}
+
+	batch, err := s.Batching.Batch()
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Split(string(data), "\n") {
+		if name == "" {
+			continue
+		}
+		if err = batch.Put(addrIndexBase.ChildString(name), []byte{}); err != nil {
+			return err
+		}
+	}
+	if err = batch.Delete(addrIndexBase); err != nil {
+		return err
+	}
+	return batch.Commit()
+}
+
+// indexKey returns the key of the index entry of an address record, if the key is that of an address record.
+func indexKey(key ds.Key) (ds.Key, bool) {
+	if !key.Parent().Equal(addrBookBase) {
+		return ds.Key{}, false
+	}
+	return addrIndexBase.ChildString(key.Name()), true
+}
+
+func (s *indexedStore) Put(key ds.Key, value []byte) error {
+	if _, ok := indexKey(key); !ok {
+		return s.Batching.Put(key, value)
+	}
+	batch, err := s.Batch()
+	if err != nil {
+		return err
+	}
+	if err = batch.Put(key, value); err != nil {
+		return err
+	}
+	return batch.Commit()
+}
+
+func (s *indexedStore) Delete(key ds.Key) error {
+	if _, ok := indexKey(key); !ok {
+		return s.Batching.Delete(key)
+	}
+	batch, err := s.Batch()
+	if err != nil {
+		return err
+	}
+	if err = batch.Delete(key); err != nil {
+		return err
+	}
+	return batch.Commit()
+}
+
+func (s *indexedStore) Batch() (ds.Batch, error) {
+	batch, err := s.Batching.Batch()
+	if err != nil {
+		return nil, err
+	}
+	return &indexedBatch{Batch: batch, store: s}, nil
+}
+
+func (s *indexedStore) Query(q query.Query) (query.Results, error) {
+	if q.Prefix != addrBookBase.String() {
+		return s.Batching.Query(q)
+	}
+
+	// the index is visited in key order; scans resuming past a key (see dsAddrBook.scan) resume the index past its
+	// entry.
+	iq := query.Query{Prefix: addrIndexBase.String(), Orders: []query.Order{query.OrderByKey{}}, KeysOnly: true}
+	for _, f := range q.Filters {
+		if f, ok := f.(query.FilterKeyCompare); ok && f.Op == query.GreaterThan {
+			if ik, ok := indexKey(ds.RawKey(f.Key)); ok {
+				iq.Filters = append(iq.Filters, query.FilterKeyCompare{Op: query.GreaterThan, Key: ik.String()})
+			}
+		}
+	}
+	index, err := s.Batching.Query(iq)
+	if err != nil {
+		return nil, err
+	}
+
+	// records are visited in key order; any other order requires sorting them all before skipping and limiting.
+	sorted := true
+	for _, o := range q.Orders {
+		if _, ok := o.(query.OrderByKey); !ok {
+			sorted = false
+		}
+	}
+	offset, limit := q.Offset, q.Limit
+	if !sorted {
+		offset, limit = 0, 0
+	}
+
+	var sent int
+	next := func() (query.Result, bool) {
+		for limit <= 0 || sent < limit {
+			ir, ok := index.NextSync()
+			if !ok {
+				break
+			}
+			if ir.Error != nil {
+				return query.Result{Error: ir.Error}, true
+			}
+			key := addrBookBase.ChildString(ds.RawKey(ir.Key).Name())
+
+			// entries whose record is missing are skipped; GC reclaims them (see dsAddrBook.GC).
+			entry := query.Entry{Key: key.String()}
+			if q.KeysOnly {
+				if has, err := s.Batching.Has(key); err != nil {
+					return query.Result{Error: err}, true
+				} else if !has {
+					continue
+				}
+			} else {
+				value, err := s.Batching.Get(key)
+				if err == ds.ErrNotFound {
+					continue
+				} else if err != nil {
+					return query.Result{Error: err}, true
+				}
+				entry.Value = value
+			}
+
+			if !passes(q.Filters, entry) {
+				continue
+			}
+			if offset > 0 {
+				offset--
+				continue
+			}
+			sent++
+			return query.Result{Entry: entry}, true
+		}
+		return query.Result{}, false
+	}
+
+	results := query.ResultsFromIterator(q, query.Iterator{Next: next, Close: index.Close})
+	if !sorted {
+		results = query.NaiveOrder(results, q.Orders...)
+		results = query.NaiveOffset(results, q.Offset)
+		if q.Limit > 0 {
+			results = query.NaiveLimit(results, q.Limit)
+		}
+	}
+	return results, nil
+}
+
+// passes returns whether the entry passes all filters.
+func passes(filters []query.Filter, entry query.Entry) bool {
+	for _, f := range filters {
+		if !f.Filter(entry) {
+			return false
+		}
+	}
+	return true
+}
+
+// indexedBatch stages the index entries of the address records written along with them.
+type indexedBatch struct {
+	ds.Batch
+	store *indexedStore
+}
+
+func (b *indexedBatch) Put(key ds.Key, value []byte) error {
+	if ik, ok := indexKey(key); ok {
+		// the entry is put first, so that non-atomic batches don't leave records unindexed.
+		if err := b.Batch.Put(ik, []byte{}); err != nil {
+			return err
+		}
+	}
+	return b.Batch.Put(key, value)
+}
+
+func (b *indexedBatch) Delete(key ds.Key) error {
+	if err := b.Batch.Delete(key); err != nil {
+		return err
+	}
+	// batches may not tolerate deleting missing keys, e.g. the entries of records written without the index.
+	if ik, ok := indexKey(key); ok {
+		if has, err := b.store.Batching.Has(ik); err != nil {
+			return err
+		} else if has {
+			return b.Batch.Delete(ik)
+		}
+	}
+	return nil
+}
+
+// indexedTxn stages the index entries of the address records written through a transaction along with them; see
+// dsAddrBook.WithTxn.
+type indexedTxn struct {
+	txnReadWriter
+}
+
+func (t *indexedTxn) Put(key ds.Key, value []byte) error {
+	if ik, ok := indexKey(key); ok {
+		if err := t.txnReadWriter.Put(ik, []byte{}); err != nil {
+			return err
+		}
+	}
+	return t.txnReadWriter.Put(key, value)
+}
+
+func (t *indexedTxn) Delete(key ds.Key) error {
+	if err := t.txnReadWriter.Delete(key); err != nil {
+		return err
+	}
+	if ik, ok := indexKey(key); ok {
+		if _, err := t.txnReadWriter.Get(ik); err == nil {
+			return t.txnReadWriter.Delete(ik)
+		} else if err != ds.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
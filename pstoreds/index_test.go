@@ -0,0 +1,245 @@
+package pstoreds
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	query "github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	test "github.com/libp2p/go-libp2p-peerstore/test"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// noAddrQueryStore is a datastore that fails the queries for address records.
+type noAddrQueryStore struct {
+	ds.Batching
+}
+
+func (s *noAddrQueryStore) Query(q query.Query) (query.Results, error) {
+	if q.Prefix == addrBookBase.String() {
+		return nil, errors.New("queries not supported")
+	}
+	return s.Batching.Query(q)
+}
+
+func assertPeersEqual(t *testing.T, exp, act []peer.ID) {
+	t.Helper()
+
+	if len(exp) != len(act) {
+		t.Fatalf("expected peers %v, got %v", exp, act)
+	}
+	set := make(map[peer.ID]struct{}, len(act))
+	for _, p := range act {
+		set[p] = struct{}{}
+	}
+	for _, p := range exp {
+		if _, ok := set[p]; !ok {
+			t.Fatalf("expected peers %v, got %v", exp, act)
+		}
+	}
+}
+
+func TestIndexAddrs(t *testing.T) {
+	clock := newMockClock()
+	store := &noAddrQueryStore{Batching: dssync.MutexWrap(ds.NewMapDatastore())}
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.Clock = clock
+	opts.IndexAddrs = true
+
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := test.GeneratePeerIDs(4)
+	addrs := test.GenerateAddrs(1)
+
+	ab.AddAddrs(ids[0], addrs, time.Hour)
+	ab.AddAddrs(ids[1], addrs, time.Minute)
+	err = ab.AddAddrsMany(map[peer.ID][]ma.Multiaddr{ids[2]: addrs, ids[3]: addrs}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ab.ClearAddrs(ids[3])
+
+	assertPeers := func(ab *dsAddrBook, expected ...peer.ID) {
+		t.Helper()
+
+		peers, err := ab.PeersWithAddrsCtx(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertPeersEqual(t, expected, peers)
+
+		if n := ab.NumPeers(); n != len(expected) {
+			t.Fatalf("expected %d peers, got %d", len(expected), n)
+		}
+
+		var visited []peer.ID
+		err = ab.ForEach(context.Background(), func(p peer.ID, _ []ma.Multiaddr) error {
+			visited = append(visited, p)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertPeersEqual(t, expected, visited)
+	}
+
+	assertPeers(ab, ids[0], ids[1], ids[2])
+
+	// the record of the expired peer is deleted by the GC, and dropped from the index.
+	clock.Advance(2 * time.Minute)
+	if err = ab.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	assertPeers(ab, ids[0], ids[2])
+
+	// the index is persisted along with the records.
+	if err = ab.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ab, err = NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	assertPeers(ab, ids[0], ids[2])
+}
+
+func TestIndexAddrsTxn(t *testing.T) {
+	store, closeStore := badgerStore(t)
+	defer closeStore()
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.IndexAddrs = true
+
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	ids := test.GeneratePeerIDs(2)
+	addrs := test.GenerateAddrs(1)
+	ab.AddAddrs(ids[0], addrs, time.Hour)
+
+	// records written through a transaction are indexed along with it.
+	txn, err := store.(ds.TxnDatastore).NewTransaction(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	abtxn := ab.WithTxn(txn)
+	if err = abtxn.AddAddrs(ids[1], addrs, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = abtxn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	peers, err := ab.PeersWithAddrsCtx(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPeersEqual(t, ids, peers)
+
+	// as are the deletions.
+	if txn, err = store.(ds.TxnDatastore).NewTransaction(false); err != nil {
+		t.Fatal(err)
+	}
+	abtxn = ab.WithTxn(txn)
+	if err = abtxn.SetAddrs(ids[1], addrs, -1); err != nil {
+		t.Fatal(err)
+	}
+	if err = abtxn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := store.Has(addrIndexBase.ChildString(ab.keys.encode(ids[1]))); has {
+		t.Fatal("expected the index entry to be deleted along with the record")
+	}
+}
+
+func TestIndexAddrsLeakedEntries(t *testing.T) {
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.IndexAddrs = true
+
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	ids := test.GeneratePeerIDs(2)
+	addrs := test.GenerateAddrs(1)
+	for _, id := range ids {
+		ab.AddAddrs(id, addrs, time.Hour)
+	}
+
+	// a record deleted behind the back of the address book leaves its entry behind, which is skipped, and reclaimed
+	// by GC.
+	ab.cache.Remove(ids[1])
+	if err = store.Delete(ab.keys.child(addrBookBase, ids[1])); err != nil {
+		t.Fatal(err)
+	}
+	assertPeersEqual(t, ids[:1], ab.PeersWithAddrs())
+
+	entry := addrIndexBase.ChildString(ab.keys.encode(ids[1]))
+	if keys, err := ab.GCPreview(context.Background()); err != nil || len(keys) != 1 || !keys[0].Equal(entry) {
+		t.Fatalf("expected the leaked index entry to be up for deletion, got: %v, err: %v", keys, err)
+	}
+	if removed, err := ab.GC(context.Background()); err != nil || removed != 1 {
+		t.Fatalf("expected a single entry to be deleted, got: %d, err: %v", removed, err)
+	}
+	if has, _ := store.Has(entry); has {
+		t.Fatal("expected the leaked index entry to be deleted")
+	}
+}
+
+func TestIndexAddrsMigration(t *testing.T) {
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := test.GeneratePeerIDs(2)
+	addrs := test.GenerateAddrs(1)
+	for _, id := range ids {
+		ab.AddAddrs(id, addrs, time.Hour)
+	}
+	if err = ab.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// earlier versions persisted the index whole.
+	legacy := ab.keys.encode(ids[0]) + "\n" + ab.keys.encode(ids[1])
+	if err = store.Put(addrIndexBase, []byte(legacy)); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.IndexAddrs = true
+	if ab, err = NewAddrBook(context.Background(), &noAddrQueryStore{Batching: store}, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	if has, _ := store.Has(addrIndexBase); has {
+		t.Fatal("expected the legacy index to be deleted")
+	}
+	assertPeersEqual(t, ids, ab.PeersWithAddrs())
+}
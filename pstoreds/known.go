@@ -0,0 +1,85 @@
+package pstoreds
+
+import (
+	"encoding/binary"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	query "github.com/ipfs/go-datastore/query"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+var (
+	// Peers that have ever held addresses are marked with the time (in unix seconds, varint encoded) from which they
+	// may no longer hold any, under the following db key pattern:
+	// /peers/known/<b32 peer id no padding>
+	knownBase = ds.NewKey("/peers/known")
+
+	purgeKnownQuery = query.Query{
+		Prefix:   knownBase.String(),
+		KeysOnly: false,
+	}
+)
+
+// AddrsInfo returns the non-expired addresses of a peer, like Addrs, along with whether the peer is known to the
+// address book, i.e. it has held addresses at some point, even if they have all expired or been cleared since. This
+// tells peers that have never been seen apart from those that are known but currently unreachable.
+//
+// A peer is known while its record is held, so peers are only marked as such when their record is deleted, i.e. when
+// their addresses are cleared or expire, or upfront when the record is stored with a native datastore TTL. Marks are
+// written once, and only rewritten if the record outlives them; they're forgotten by GC after
+// Options.KnownPeersRetention, if set.
+func (ab *dsAddrBook) AddrsInfo(p peer.ID) (addrs []ma.Multiaddr, known bool) {
+	if addrs = ab.Addrs(p); len(addrs) > 0 {
+		return addrs, true
+	}
+	known, err := ab.ds.Has(ab.keys.child(addrBookBase, p))
+	if err == nil && !known {
+		known, err = ab.ds.Has(ab.keys.child(knownBase, p))
+	}
+	if err != nil {
+		ab.log.Warningf("failed to check whether peer %v is known, err: %v", p, err)
+	}
+	return addrs, known
+}
+
+// markKnown marks a peer as known through the provided write, until the provided time (in unix seconds) at least. The
+// mark is left alone if it's already held, and covers that time within half of Options.KnownPeersRetention, so that
+// records stored with a native TTL don't rewrite it every time they're flushed.
+func (ab *dsAddrBook) markKnown(write ds.Write, p peer.ID, until int64) error {
+	key := ab.keys.child(knownBase, p)
+	value, err := ab.ds.Get(key)
+	switch err {
+	case nil:
+		// marks written by earlier versions are empty, and cover no time.
+		held, _ := binary.Varint(value)
+		slack := int64(ab.opts.KnownPeersRetention / 2 / time.Second)
+		if ab.opts.KnownPeersRetention == 0 || held >= until-slack {
+			return nil
+		}
+	case ds.ErrNotFound:
+	default:
+		return err
+	}
+
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(buf, until)
+	return write.Put(key, buf[:n])
+}
+
+// forgettable returns whether a known peer mark has outlived Options.KnownPeersRetention, as of now (in unix seconds).
+// Peers whose record is still held are never forgotten.
+func (ab *dsAddrBook) forgettable(key ds.Key, value []byte, now int64) bool {
+	if ab.opts.KnownPeersRetention == 0 {
+		return false
+	}
+	held, _ := binary.Varint(value)
+	if held+int64(ab.opts.KnownPeersRetention/time.Second) > now {
+		return false
+	}
+	has, err := ab.ds.Has(addrBookBase.ChildString(key.Name()))
+	return err == nil && !has
+}
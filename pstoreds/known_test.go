@@ -0,0 +1,136 @@
+package pstoreds
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	test "github.com/libp2p/go-libp2p-peerstore/test"
+)
+
+func TestAddrsInfo(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, nil)
+	defer closeFn()
+
+	ids := test.GeneratePeerIDs(3)
+	addrs := test.GenerateAddrs(2)
+
+	// neither clearing nor reading a peer never seen makes it known; its empty record is cached on the first read, and
+	// flushed on the next ones.
+	ab.ClearAddrs(ids[0])
+	for i := 0; i < 3; i++ {
+		if _, known := ab.AddrsInfo(ids[0]); known {
+			t.Fatal("expected a peer never seen to be unknown")
+		}
+	}
+
+	ab.AddAddr(ids[0], addrs[0], time.Hour)
+	ab.AddAddr(ids[1], addrs[1], time.Minute)
+	ab.AddAddr(ids[2], addrs[1], time.Hour)
+
+	got, known := ab.AddrsInfo(ids[0])
+	if !known {
+		t.Fatal("expected a peer with addresses to be known")
+	}
+	test.AssertAddressesEqual(t, addrs[:1], got)
+
+	// peers stay known after their addresses expire or are cleared.
+	clock.Advance(2 * time.Minute)
+	ab.ClearAddrs(ids[2])
+	for _, id := range ids[1:] {
+		if got, known := ab.AddrsInfo(id); !known || len(got) != 0 {
+			t.Fatalf("expected a known peer without addresses, got known: %v, addrs: %v", known, got)
+		}
+	}
+}
+
+func TestKnownMarkWrittenOnce(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, func(opts *Options) {
+		opts.KnownPeersRetention = 4 * time.Hour
+	})
+	defer closeFn()
+
+	id := test.GeneratePeerIDs(1)[0]
+	addr := test.GenerateAddrs(1)[0]
+	mark := func() int64 {
+		t.Helper()
+		value, err := ab.ds.Get(ab.keys.child(knownBase, id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		until, _ := binary.Varint(value)
+		return until
+	}
+
+	// badger supports native TTLs, so the peer is marked upfront, until its record expires.
+	start := clock.Now()
+	ab.AddAddr(id, addr, time.Hour)
+	if until := mark(); until != start.Add(time.Hour).Unix() {
+		t.Fatalf("expected the peer to be marked until %d, got %d", start.Add(time.Hour).Unix(), until)
+	}
+
+	// refreshing the address doesn't rewrite the mark while it's within half the retention of the record's expiry...
+	clock.Advance(time.Hour)
+	ab.AddAddr(id, addr, time.Hour)
+	if until := mark(); until != start.Add(time.Hour).Unix() {
+		t.Fatalf("expected the mark to be left alone, got %d", until)
+	}
+
+	// ... but does once the record outlives it by more than that.
+	clock.Advance(2 * time.Hour)
+	ab.AddAddr(id, addr, time.Hour)
+	if until := mark(); until != start.Add(4*time.Hour).Unix() {
+		t.Fatalf("expected the peer to be marked until %d, got %d", start.Add(4*time.Hour).Unix(), until)
+	}
+}
+
+func TestKnownPeersRetention(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, func(opts *Options) {
+		opts.KnownPeersRetention = time.Hour
+	})
+	defer closeFn()
+
+	ids := test.GeneratePeerIDs(3)
+	addrs := test.GenerateAddrs(3)
+	for i, id := range ids {
+		ab.AddAddr(id, addrs[i], pstore.PermanentAddrTTL)
+	}
+	ab.ClearAddrs(ids[0])
+	clock.Advance(30 * time.Minute)
+	ab.ClearAddrs(ids[1])
+	clock.Advance(45 * time.Minute)
+
+	known := func(id peer.ID) bool {
+		_, known := ab.AddrsInfo(id)
+		return known
+	}
+
+	// the first peer went away more than an hour ago; the second one didn't, and the third still holds addresses.
+	keys, err := ab.GCPreview(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !keys[0].Equal(ab.keys.child(knownBase, ids[0])) {
+		t.Fatalf("expected the mark of the first peer to be up for deletion, got: %v", keys)
+	}
+	if removed, err := ab.GC(context.Background()); err != nil || removed != 1 {
+		t.Fatalf("expected a single mark to be deleted, got: %d, err: %v", removed, err)
+	}
+	if known(ids[0]) || !known(ids[1]) || !known(ids[2]) {
+		t.Fatalf("expected only the first peer to be forgotten, got: %v, %v, %v", known(ids[0]), known(ids[1]),
+			known(ids[2]))
+	}
+
+	// peers are remembered for the lifetime of the datastore without a retention.
+	ab.opts.KnownPeersRetention = 0
+	clock.Advance(24 * time.Hour)
+	if removed, err := ab.GC(context.Background()); err != nil || removed != 0 {
+		t.Fatalf("expected no mark to be deleted, got: %d, err: %v", removed, err)
+	}
+	if !known(ids[1]) {
+		t.Fatal("expected the second peer to be remembered")
+	}
+}
@@ -0,0 +1,97 @@
+package pstoreds
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+)
+
+// Latency averages are stored as varints, under the following db key pattern:
+// /peers/latency/<b32 peer id no padding>
+var latencyBase = ds.NewKey("/peers/latency")
+
+type dsMetrics struct {
+	ds   ds.Datastore
+	keys peerKeys
+	log  Logger
+
+	// serializes read-modify-write cycles over the latency averages.
+	lk sync.Mutex
+}
+
+var _ pstore.Metrics = (*dsMetrics)(nil)
+
+// NewMetrics creates a latency tracker backed by a persistent datastore, so that the recorded latency averages
+// survive restarts. Every measurement is written through to the datastore.
+func NewMetrics(_ context.Context, store ds.Datastore, opts Options) (pstore.Metrics, error) {
+	logger := newLogger(opts)
+	return &dsMetrics{ds: namespaced(store, opts.Namespace, logger), keys: newPeerKeys(opts), log: logger}, nil
+}
+
+// RecordLatency records a new latency measurement, folding it into the exponentially-weighted moving average of the
+// peer's latency as governed by peerstore.LatencyEWMASmoothing.
+func (m *dsMetrics) RecordLatency(p peer.ID, next time.Duration) {
+	s := pstore.LatencyEWMASmoothing
+	if s > 1 || s < 0 {
+		s = 0.1
+	}
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	ewma, found, err := m.load(p)
+	if err != nil {
+		m.log.Warningf("failed to load latency for peer %v, err: %v", p, err)
+	}
+	if found {
+		next = time.Duration(((1.0 - s) * float64(ewma)) + (s * float64(next)))
+	}
+
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(buf, int64(next))
+	if err = m.ds.Put(m.latencyKey(p), buf[:n]); err != nil {
+		m.log.Warningf("failed to store latency for peer %v, err: %v", p, err)
+	}
+}
+
+// LatencyEWMA returns the exponentially-weighted moving average of all latency measurements recorded for a peer, or
+// 0 if none have been recorded.
+func (m *dsMetrics) LatencyEWMA(p peer.ID) time.Duration {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	ewma, _, err := m.load(p)
+	if err != nil {
+		m.log.Warningf("failed to load latency for peer %v, err: %v", p, err)
+	}
+	return ewma
+}
+
+// load fetches the latency average of a peer. To be called within a lock.
+func (m *dsMetrics) load(p peer.ID) (ewma time.Duration, found bool, err error) {
+	value, err := m.ds.Get(m.latencyKey(p))
+	switch err {
+	case nil:
+	case ds.ErrNotFound:
+		return 0, false, nil
+	default:
+		return 0, false, err
+	}
+
+	v, n := binary.Varint(value)
+	if n <= 0 {
+		return 0, false, fmt.Errorf("malformed latency value for peer %v", p)
+	}
+	return time.Duration(v), true, nil
+}
+
+func (m *dsMetrics) latencyKey(p peer.ID) ds.Key {
+	return m.keys.child(latencyBase, p)
+}
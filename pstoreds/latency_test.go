@@ -0,0 +1,43 @@
+package pstoreds
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+
+	pt "github.com/libp2p/go-libp2p-peerstore/test"
+)
+
+func TestDsMetrics(t *testing.T) {
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+	m, err := NewMetrics(context.Background(), store, DefaultOpts())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := pt.GeneratePeerIDs(1)[0]
+
+	if lat := m.LatencyEWMA(id); lat != 0 {
+		t.Fatalf("expected no latency for an unknown peer, got: %v", lat)
+	}
+
+	// the first measurement is taken as the mean.
+	m.RecordLatency(id, 100*time.Millisecond)
+	if lat := m.LatencyEWMA(id); lat != 100*time.Millisecond {
+		t.Fatalf("expected latency of 100ms, got: %v", lat)
+	}
+
+	m.RecordLatency(id, 200*time.Millisecond)
+	if lat := m.LatencyEWMA(id); lat != 110*time.Millisecond {
+		t.Fatalf("expected latency of 110ms, got: %v", lat)
+	}
+
+	// latencies are persisted in the datastore.
+	m, _ = NewMetrics(context.Background(), store, DefaultOpts())
+	if lat := m.LatencyEWMA(id); lat != 110*time.Millisecond {
+		t.Fatalf("expected latency to be persisted, got: %v", lat)
+	}
+}
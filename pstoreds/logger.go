@@ -0,0 +1,31 @@
+package pstoreds
+
+// Logger is the subset of the go-log logger interface the books log through; see Options.Logger.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Error(args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+var _ Logger = log
+
+// NopLogger is a Logger that discards everything logged to it.
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{})   {}
+func (nopLogger) Infof(string, ...interface{})    {}
+func (nopLogger) Warningf(string, ...interface{}) {}
+func (nopLogger) Error(...interface{})            {}
+func (nopLogger) Errorf(string, ...interface{})   {}
+
+// newLogger returns the logger set in the options, defaulting to the package logger.
+func newLogger(opts Options) Logger {
+	if opts.Logger == nil {
+		return log
+	}
+	return opts.Logger
+}
@@ -0,0 +1,116 @@
+package pstoreds
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pt "github.com/libp2p/go-libp2p-peer/test"
+	test "github.com/libp2p/go-libp2p-peerstore/test"
+)
+
+// recordingLogger is a Logger that records the messages logged to it.
+type recordingLogger struct {
+	lk   sync.Mutex
+	msgs []string
+}
+
+func (l *recordingLogger) record(level, msg string) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	l.msgs = append(l.msgs, level+": "+msg)
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.record("debug", fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.record("info", fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Warningf(format string, args ...interface{}) {
+	l.record("warning", fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Error(args ...interface{}) {
+	l.record("error", fmt.Sprint(args...))
+}
+
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.record("error", fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) messages() []string {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	return append([]string(nil), l.msgs...)
+}
+
+func TestLogger(t *testing.T) {
+	store := &failingStore{Batching: dssync.MutexWrap(ds.NewMapDatastore())}
+	logger := new(recordingLogger)
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.Logger = logger
+
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	kb, err := NewKeyBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, pub, err := pt.RandTestKeyPair(512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.broken = 1
+	ab.AddAddrs(id, test.GenerateAddrs(1), time.Hour)
+	if kb.AddPubKey(id, pub) == nil {
+		t.Fatal("expected adding the key to fail")
+	}
+
+	msgs := logger.messages()
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages logged, got: %q", msgs)
+	}
+	if !strings.HasPrefix(msgs[0], "error: failed to add addrs for peer") {
+		t.Errorf("unexpected message logged by the address book: %q", msgs[0])
+	}
+	if !strings.HasPrefix(msgs[1], "error: error while updating pubkey") {
+		t.Errorf("unexpected message logged by the key book: %q", msgs[1])
+	}
+
+	// so do the books wrapping a datastore that doesn't support batching.
+	logger = new(recordingLogger)
+	opts.Logger = logger
+	if _, err := NewProtoBook(context.Background(), struct{ ds.Datastore }{store}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := logger.messages(); len(msgs) != 1 || !strings.HasPrefix(msgs[0], "debug: datastore of type") {
+		t.Fatalf("expected the batching shim to be logged, got: %q", msgs)
+	}
+
+	// the default logger is the package one.
+	if l := newLogger(DefaultOpts()); l != log {
+		t.Fatalf("expected the package logger by default, got: %T", l)
+	}
+}
@@ -5,13 +5,13 @@ import (
 	"context"
 	"encoding/gob"
 
-	base32 "github.com/multiformats/go-base32"
-
 	ds "github.com/ipfs/go-datastore"
 
 	pool "github.com/libp2p/go-buffer-pool"
 	peer "github.com/libp2p/go-libp2p-peer"
 	pstore "github.com/libp2p/go-libp2p-peerstore"
+
+	"github.com/pkg/errors"
 )
 
 // Metadata is stored under the following db key pattern:
@@ -19,7 +19,8 @@ import (
 var pmBase = ds.NewKey("/peers/metadata")
 
 type dsPeerMetadata struct {
-	ds ds.Datastore
+	ds   ds.Datastore
+	keys peerKeys
 }
 
 var _ pstore.PeerMetadata = (*dsPeerMetadata)(nil)
@@ -35,13 +36,17 @@ func init() {
 //
 // See `init()` to learn which types are registered by default. Modules wishing to store
 // values of other types will need to `gob.Register()` them explicitly, or else callers
-// will receive runtime errors.
-func NewPeerMetadata(_ context.Context, store ds.Datastore, _ Options) (pstore.PeerMetadata, error) {
-	return &dsPeerMetadata{store}, nil
+// will receive an error from Put.
+//
+// Each value is stored under its own datastore key, and every Put is a single datastore write. Concurrent Puts
+// to the same key are therefore atomic with respect to one another: the last write wins and readers never
+// observe a partially written value.
+func NewPeerMetadata(_ context.Context, store ds.Datastore, opts Options) (pstore.PeerMetadata, error) {
+	return &dsPeerMetadata{namespaced(store, opts.Namespace, newLogger(opts)), newPeerKeys(opts)}, nil
 }
 
 func (pm *dsPeerMetadata) Get(p peer.ID, key string) (interface{}, error) {
-	k := pmBase.ChildString(base32.RawStdEncoding.EncodeToString([]byte(p))).ChildString(key)
+	k := pm.keys.child(pmBase, p).ChildString(key)
 	value, err := pm.ds.Get(k)
 	if err != nil {
 		if err == ds.ErrNotFound {
@@ -52,16 +57,17 @@ func (pm *dsPeerMetadata) Get(p peer.ID, key string) (interface{}, error) {
 
 	var res interface{}
 	if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&res); err != nil {
-		return nil, err
+		return nil, errors.Wrapf(err, "failed to decode metadata value for key %q (is its type registered with gob?)", key)
 	}
 	return res, nil
 }
 
 func (pm *dsPeerMetadata) Put(p peer.ID, key string, val interface{}) error {
-	k := pmBase.ChildString(base32.RawStdEncoding.EncodeToString([]byte(p))).ChildString(key)
+	k := pm.keys.child(pmBase, p).ChildString(key)
 	var buf pool.Buffer
 	if err := gob.NewEncoder(&buf).Encode(&val); err != nil {
-		return err
+		return errors.Wrapf(err, "failed to encode metadata value of type %T for key %q; "+
+			"types other than the gob defaults must be registered via gob.Register()", val, key)
 	}
 	return pm.ds.Put(k, buf.Bytes())
 }
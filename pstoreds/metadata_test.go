@@ -0,0 +1,55 @@
+package pstoreds
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	pt "github.com/libp2p/go-libp2p-peerstore/test"
+)
+
+type unregisteredType struct {
+	Field string
+}
+
+func TestDsPeerMetadata(t *testing.T) {
+	pm, err := NewPeerMetadata(context.Background(), dssync.MutexWrap(ds.NewMapDatastore()), DefaultOpts())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := pt.GeneratePeerIDs(1)[0]
+
+	t.Run("roundtrip", func(t *testing.T) {
+		if err := pm.Put(id, "AgentVersion", "go-libp2p/0.1"); err != nil {
+			t.Fatal(err)
+		}
+		v, err := pm.Get(id, "AgentVersion")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.(string) != "go-libp2p/0.1" {
+			t.Fatalf("unexpected value: %v", v)
+		}
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		if _, err := pm.Get(id, "missing"); err != pstore.ErrNotFound {
+			t.Fatalf("expected ErrNotFound, got: %v", err)
+		}
+	})
+
+	t.Run("unregistered type", func(t *testing.T) {
+		err := pm.Put(id, "custom", unregisteredType{"foo"})
+		if err == nil {
+			t.Fatal("expected an error when storing an unregistered type")
+		}
+		if !strings.Contains(err.Error(), "gob.Register") {
+			t.Fatalf("expected error to mention gob.Register, got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,40 @@
+package pstoreds
+
+import "time"
+
+// MetricsCollector receives instrumentation events from the datastore-backed address book, allowing operators to
+// track the effectiveness of the cache and the cost of GC. Implementations must be safe for concurrent use.
+//
+// See the prommetrics subpackage for a Prometheus-backed implementation.
+type MetricsCollector interface {
+	// CacheHit is called when a peer record is served from the cache.
+	CacheHit()
+
+	// CacheMiss is called when a peer record is not cached and has to be fetched from the datastore.
+	CacheMiss()
+
+	// SweepDuration is called with the time taken by every GC purge cycle.
+	SweepDuration(time.Duration)
+
+	// ExpiredCount is called with the number of addresses that were dropped because they expired, whether they were
+	// found on access or during GC.
+	ExpiredCount(int)
+
+	// CorruptRecord is called when a stored peer record can't be decoded, whether on access or during GC.
+	CorruptRecord()
+}
+
+// noopMetrics is a dummy implementation that's used when no metrics collector is configured.
+type noopMetrics struct{}
+
+var _ MetricsCollector = (*noopMetrics)(nil)
+
+func (*noopMetrics) CacheHit() {}
+
+func (*noopMetrics) CacheMiss() {}
+
+func (*noopMetrics) SweepDuration(time.Duration) {}
+
+func (*noopMetrics) ExpiredCount(int) {}
+
+func (*noopMetrics) CorruptRecord() {}
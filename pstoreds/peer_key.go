@@ -0,0 +1,41 @@
+package pstoreds
+
+import (
+	ds "github.com/ipfs/go-datastore"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+
+	b32 "github.com/multiformats/go-base32"
+)
+
+// peerKeys encodes peer IDs into the names under which their entries are stored, and decodes them back; see
+// Options.EncodePeerKey.
+type peerKeys struct {
+	encode func(peer.ID) string
+	decode func(string) (peer.ID, error)
+}
+
+// newPeerKeys returns the peer key encoding set in the options, defaulting to base32 without padding.
+func newPeerKeys(opts Options) peerKeys {
+	if opts.EncodePeerKey == nil {
+		return peerKeys{encode: encodePeerKeyB32, decode: decodePeerKeyB32}
+	}
+	return peerKeys{encode: opts.EncodePeerKey, decode: opts.DecodePeerKey}
+}
+
+// child returns the key of the entry of a peer under base.
+func (k peerKeys) child(base ds.Key, p peer.ID) ds.Key {
+	return base.ChildString(k.encode(p))
+}
+
+func encodePeerKeyB32(p peer.ID) string {
+	return b32.RawStdEncoding.EncodeToString([]byte(p))
+}
+
+func decodePeerKeyB32(name string) (peer.ID, error) {
+	b, err := b32.RawStdEncoding.DecodeString(name)
+	if err != nil {
+		return "", err
+	}
+	return peer.IDFromBytes(b)
+}
@@ -0,0 +1,98 @@
+package pstoreds
+
+import (
+	"context"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pt "github.com/libp2p/go-libp2p-peer/test"
+	test "github.com/libp2p/go-libp2p-peerstore/test"
+)
+
+func hexPeerKeyOpts() Options {
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.EncodePeerKey = func(p peer.ID) string { return hex.EncodeToString([]byte(p)) }
+	opts.DecodePeerKey = func(name string) (peer.ID, error) {
+		b, err := hex.DecodeString(name)
+		if err != nil {
+			return "", err
+		}
+		return peer.IDFromBytes(b)
+	}
+	return opts
+}
+
+func TestPeerKeyEncodingSuites(t *testing.T) {
+	opts := hexPeerKeyOpts()
+	test.TestAddrBook(t, addressBookFactory(t, badgerStore, opts))
+	test.TestKeyBook(t, keyBookFactory(t, badgerStore, opts))
+	test.TestPeerstore(t, peerstoreFactory(t, badgerStore, opts))
+}
+
+func TestPeerKeyEncoding(t *testing.T) {
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+	opts := hexPeerKeyOpts()
+
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	id := test.GeneratePeerIDs(1)[0]
+	ab.AddAddrs(id, test.GenerateAddrs(1), time.Hour)
+
+	// entries are stored under the configured encoding...
+	if has, _ := store.Has(addrBookBase.ChildString(hex.EncodeToString([]byte(id)))); !has {
+		t.Fatal("expected the record to be stored under the hex encoded peer ID")
+	}
+
+	// ... which is decoded back when listing peers.
+	peers, err := ab.PeersWithAddrsCtx(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPeersEqual(t, []peer.ID{id}, peers)
+}
+
+func TestPeerKeyUndecodable(t *testing.T) {
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+	logger := new(recordingLogger)
+	opts := hexPeerKeyOpts()
+	opts.Logger = logger
+
+	kb, err := NewKeyBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, pub, err := pt.RandTestKeyPair(512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kb.AddPubKey(id, pub); err != nil {
+		t.Fatal(err)
+	}
+
+	// an entry whose name isn't valid hex is skipped when listing peers.
+	if err := store.Put(kbBase.ChildString("not-hex").Child(pubSuffix), []byte("junk")); err != nil {
+		t.Fatal(err)
+	}
+	assertPeersEqual(t, []peer.ID{id}, kb.PeersWithKeys())
+
+	msgs := logger.messages()
+	if len(msgs) != 1 || !strings.HasPrefix(msgs[0], "warning: failed while decoding peer ID from key: not-hex") {
+		t.Fatalf("expected the undecodable key to be logged, got: %q", msgs)
+	}
+}
@@ -2,22 +2,38 @@ package pstoreds
 
 import (
 	"context"
+	"fmt"
 	"time"
 
-	base32 "github.com/multiformats/go-base32"
+	ma "github.com/multiformats/go-multiaddr"
 
 	ds "github.com/ipfs/go-datastore"
 	query "github.com/ipfs/go-datastore/query"
 
 	peer "github.com/libp2p/go-libp2p-peer"
 	pstore "github.com/libp2p/go-libp2p-peerstore"
+	pstoremem "github.com/libp2p/go-libp2p-peerstore/pstoremem"
 )
 
 // Configuration object for the peerstore.
 type Options struct {
-	// The size of the in-memory cache. A value of 0 or lower disables the cache.
+	// The size of the in-memory cache, in records or addresses depending on CacheSizeMode. A value of 0 or lower
+	// disables the cache.
 	CacheSize uint
 
+	// What CacheSize bounds: the number of records cached (CacheByPeer, the default), or the total number of addresses
+	// they hold (CacheByAddr), for a tighter bound on memory usage when peers hold widely varying numbers of addresses.
+	CacheSizeMode CacheSizeMode
+
+	// Cache to use instead of the default ARC cache, e.g. to control eviction or instrument it. If set, CacheSize and
+	// CacheSizeMode are ignored. As entries are keyed by peer ID, it must not be shared with other address books.
+	Cache Cache
+
+	// How long a record stays valid in the cache once read from the datastore. The first read after that reloads it,
+	// which bounds how stale reads can be when other processes write to the same datastore. Writes through this
+	// address book don't extend it. If zero, cached records stay valid until evicted.
+	CacheTTL time.Duration
+
 	// Sweep interval to purge expired addresses from the datastore. If this is a zero value, GC will not run
 	// automatically, but it'll be available on demand via explicit calls.
 	GCPurgeInterval time.Duration
@@ -26,9 +42,178 @@ type Options struct {
 	// traverse the entire datastore for every purge cycle.
 	GCLookaheadInterval time.Duration
 
+	// Lower bound of the interval between purge cycles when lookahead is enabled. If non-zero, purges are scheduled
+	// adaptively rather than on a fixed tick: after each cycle, the next one is timed to the earliest expiry in the
+	// lookahead window, no sooner than GCMinPurgeInterval and no later than GCPurgeInterval. This purges addresses
+	// punctually when expiries are dense, and avoids idle cycles when they're sparse.
+	GCMinPurgeInterval time.Duration
+
 	// Initial delay before GC processes start. Intended to give the system breathing room to fully boot
 	// before starting GC.
 	GCInitialDelay time.Duration
+
+	// Collector of cache and GC instrumentation events. If nil, instrumentation is disabled.
+	Metrics MetricsCollector
+
+	// Source of time used to compute address expirations and to schedule GC. If nil, the system clock is used.
+	Clock Clock
+
+	// Whether to delete stored peer records that can't be decoded, e.g. because they were corrupted or written by an
+	// incompatible version, when they're accessed or swept by GC. By default, they're skipped and left in place, and
+	// accessing them fails every time. Either way, they're reported to the Metrics collector.
+	DeleteCorruptRecords bool
+
+	// Maximum number of addresses stored per peer, as a protection against address table bloat. When a peer exceeds
+	// it, the addresses expiring the soonest are evicted. A value of 0 or lower disables the limit.
+	MaxAddrsPerPeer int
+
+	// Whether to run a final, full GC purge when the address book is closed, so that expired addresses aren't left
+	// behind in the datastore.
+	FlushOnClose bool
+
+	// Key prefix under which all peerstore entries are stored, e.g. /peerstore, allowing the datastore to be shared
+	// with other components. If this is a zero value, entries are stored at the datastore root.
+	Namespace ds.Key
+
+	// Encoding of peer IDs into the names under which their entries are stored, e.g. /peers/addrs/<name>, and its
+	// inverse, so that datastore keys can match peer identifiers used by other systems. Names must be valid datastore
+	// key segments, i.e. non-empty and free of slashes. Both functions must be set, or neither, in which case peer IDs
+	// are encoded in base32 without padding. The encoding applies to all books, and must not change for an existing
+	// datastore, as entries stored under another encoding can't be found nor decoded.
+	EncodePeerKey func(peer.ID) string
+	DecodePeerKey func(string) (peer.ID, error)
+
+	// Logger the books report failures to, e.g. to route them to the application's logger, or to silence a noisy
+	// instance with NopLogger. If nil, the package logger ("peerstore/ds") is used.
+	Logger Logger
+
+	// Verifies and decodes the signed envelopes passed to ConsumePeerRecord. If nil, signed peer records are not
+	// supported.
+	PeerRecordUnmarshaler PeerRecordUnmarshaler
+
+	// Maximum TTL addresses can be stored with, as a guardrail against callers pinning addresses indefinitely. Longer
+	// TTLs are clamped to it. A value of 0 or lower disables the ceiling.
+	MaxTTL time.Duration
+
+	// Whether MaxTTL also applies to addresses added with peerstore.PermanentAddrTTL. By default, they're exempt.
+	ClampPermanentTTL bool
+
+	// Granularity to which address expirations are rounded up, e.g. 1 minute. Coalescing expirations into buckets
+	// lets GC purge many addresses in the same cycle, and reduces the number of distinct lookahead entries. The
+	// trade-off is that addresses may outlive their TTL by up to this amount. Values under 1 second have no effect.
+	TTLGranularity time.Duration
+
+	// Fraction of the TTL by which address expirations are randomly spread, in either direction, e.g. 0.1 for ±10%.
+	// Spreading the expirations of addresses inserted in bulk with the same TTL smears their purging across GC cycles.
+	// Permanent addresses are never jittered. Must be in the [0, 1) range; 0 disables jitter. Note that with jitter
+	// enabled, re-setting an address with the same TTL always writes its record, as its expiration changes.
+	TTLJitter float64
+
+	// Maximum time Close waits for the writes in flight to complete. If this is a zero value, Close waits
+	// indefinitely.
+	CloseTimeout time.Duration
+
+	// Maximum number of addresses buffered for delivery to each address stream (as returned by AddrStream and
+	// AddrExpiryStream), so that slow consumers can't exhaust memory. A value of 0 or lower leaves buffers unbounded.
+	AddrStreamBufferSize int
+
+	// Which address to drop when an address stream buffer is full. Publishing addresses never blocks on a slow
+	// consumer, regardless of the policy.
+	AddrStreamOverflow pstoremem.OverflowPolicy
+
+	// Manager of address streams to use instead of a new one, e.g. to share it with other address books, so that
+	// subscribers are notified of writes regardless of the book that handled them. If set, AddrStreamBufferSize and
+	// AddrStreamOverflow are ignored.
+	SubManager *pstoremem.AddrSubManager
+
+	// Function applied to addresses before they're stored or removed, e.g. to collapse equivalent forms of the same
+	// address that would otherwise be held as distinct entries. Addresses it maps to nil are dropped. If nil,
+	// addresses are stored as provided.
+	NormalizeAddr func(ma.Multiaddr) ma.Multiaddr
+
+	// Predicate that addresses being added or set must satisfy to be stored, e.g. to keep undialable addresses out.
+	// Addresses failing it are silently dropped. It is applied after NormalizeAddr, but not to addresses being
+	// removed, so that addresses stored before it was set can still be removed. See the addr package for ready-made
+	// filters. If nil, all addresses are stored.
+	AddrFilter func(ma.Multiaddr) bool
+
+	// Number of records read per datastore query by scans of the whole store: ForEach, Export and full GC sweeps. If
+	// this is a zero value, each scan runs a single query; on transactional datastores like Badger, that's a single
+	// read transaction, which sees a consistent snapshot but is held for the whole scan, holding back the datastore's
+	// own compaction. Otherwise, scans run one short query per chunk, each resuming after the last key read, and no
+	// longer see a consistent snapshot: records added in the meantime behind the chunk being read are not visited,
+	// and are caught by the next GC sweep. Datastores that can't seek to a key, like Badger, iterate over the keys
+	// preceding a chunk to resume it; with IndexAddrs, only the empty index entries are iterated over.
+	ScanChunkSize int
+
+	// Number of recent address changes (additions, removals and expirations) kept in memory per peer, and exposed via
+	// AddrHistory, e.g. to debug peers whose addresses flap. If this is a zero value, no history is kept.
+	AddrHistorySize int
+
+	// Number of peers whose address history is kept, if AddrHistorySize is set; the history of the peers changed the
+	// least recently is dropped first. If this is a zero value, the history of 1024 peers is kept.
+	AddrHistoryPeers int
+
+	// Callback invoked with the addresses of a peer whenever they're dropped as they expire, whether by the GC or
+	// when the record of the peer is next read. It's called from a dedicated goroutine, outside of any lock, so it
+	// may call into the address book; calls are made one at a time, in the order the expirations happened. Addresses
+	// removed explicitly (e.g. through ClearAddrs, or with a TTL of 0) are not reported. Records expired natively by
+	// the datastore are only reported if GC visits them first; the addresses they held when they expired aren't
+	// reported otherwise. Disabled if nil.
+	OnExpire func(p peer.ID, addrs []ma.Multiaddr)
+
+	// Maximum number of expirations queued for OnExpire while the callback is busy. Once the queue is full, further
+	// expirations are dropped and a warning is logged, rather than holding up the records they were detected in. If
+	// this is a zero value, 1024 expirations are queued.
+	OnExpireQueueSize int
+
+	// How long expired addresses are kept in their records before they're dropped. Within that period they're hidden
+	// from reads as if they were gone, but adding them again revives them in place, which saves rewriting records
+	// and notifying subscribers for peers whose addresses flap. Expiry notifications (AddrStream expiry events,
+	// OnExpire, the address history) are delivered when addresses are finally dropped. If zero, expired addresses are
+	// dropped right away.
+	ExpiryGracePeriod time.Duration
+
+	// How long peers are remembered as known (see AddrsInfo) once they no longer hold addresses, after which GC
+	// (dsAddrBook.GC) forgets them. Peers whose record was expired by the datastore on its own are remembered for at
+	// least half that period. If zero, peers are remembered for the lifetime of the datastore.
+	KnownPeersRetention time.Duration
+
+	// Callback invoked when a write fails in a method that doesn't return errors, such as AddAddrs, SetAddrs or
+	// ClearAddrs, so that persistent datastore failures can be acted upon; failures are logged regardless. op is the
+	// name of the method. It's called synchronously from the failing method, outside of any record lock, so it should
+	// return promptly. Disabled if nil.
+	OnWriteFailure func(p peer.ID, op string, err error)
+
+	// Whether Addrs returns the same slice to all callers, as long as the addresses of the peer don't change, rather
+	// than a fresh copy every time. This saves allocations on read-heavy workloads, but callers MUST NOT modify the
+	// returned slices, as that would corrupt the results of other callers. Only records held in the cache share reads.
+	SharedReads bool
+
+	// Whether to keep an index of the peers held in the datastore, to enumerate them with a keys-only query over small
+	// index entries rather than queries for the records, for datastores that serve those slowly. The index backs
+	// PeersWithAddrs, NumPeers, ForEach, Export and the full-purge GC; the lookahead GC and the sweep of signed peer
+	// records still query the records. Each record has its own index entry, written along with it, including through
+	// WithTxn. Native datastore TTLs are not used, as records expired by the datastore would leave their entries
+	// behind; entries left behind by records deleted by other means are reclaimed by GC.
+	//
+	// The index must be kept on for as long as the datastore is used, as records written without it aren't indexed.
+	IndexAddrs bool
+
+	// Codec used to serialize the per-peer records for storage. It must not change for an existing datastore. If nil,
+	// records are encoded in protobuf (ProtobufCodec). Signed peer records are always encoded in protobuf.
+	Codec Codec
+
+	// Maximum number of operations staged in a datastore batch before it's committed, to keep commits within the
+	// limits of datastores like Badger. Bulk writes exceeding it are committed in several batches, and are thus no
+	// longer atomic. If this is a zero value, GC, ClearAddrsMany and PopulateFrom commit every 20 operations, and
+	// AddAddrsMany commits once.
+	MaxBatchSize int
+
+	// Whether clearing the addresses of a peer, via ClearAddrs or ClearAddrsMany, also removes the addresses of other
+	// peers that are routed through it as a relay (i.e. /p2p/<relay>/p2p-circuit addresses). As relayed addresses
+	// aren't indexed, every clear visits all records in the datastore.
+	ClearRelayedAddrs bool
 }
 
 // DefaultOpts returns the default options for a persistent peerstore, with the full-purge GC algorithm:
@@ -37,22 +222,102 @@ type Options struct {
 // * GC purge interval: 2 hours.
 // * GC lookahead interval: disabled.
 // * GC initial delay: 60 seconds.
+// * Close timeout: 10 seconds.
 func DefaultOpts() Options {
 	return Options{
 		CacheSize:           1024,
 		GCPurgeInterval:     2 * time.Hour,
 		GCLookaheadInterval: 0,
 		GCInitialDelay:      60 * time.Second,
+		CloseTimeout:        10 * time.Second,
 	}
 }
 
-// NewPeerstore creates a peerstore backed by the provided persistent datastore.
-func NewPeerstore(ctx context.Context, store ds.Batching, opts Options) (pstore.Peerstore, error) {
+// validate checks that the options are consistent, returning a descriptive error otherwise. Zero values are valid,
+// and disable the corresponding features.
+func (opts Options) validate() error {
+	if opts.GCPurgeInterval < 0 {
+		return fmt.Errorf("negative GC purge interval provided: %s", opts.GCPurgeInterval)
+	}
+	if opts.GCLookaheadInterval < 0 {
+		return fmt.Errorf("negative GC lookahead interval provided: %s", opts.GCLookaheadInterval)
+	}
+	if opts.GCMinPurgeInterval < 0 || opts.GCMinPurgeInterval > opts.GCPurgeInterval {
+		return fmt.Errorf("GC min purge interval must be in the [0, %s] range, provided: %s",
+			opts.GCPurgeInterval, opts.GCMinPurgeInterval)
+	}
+	if opts.GCInitialDelay < 0 {
+		return fmt.Errorf("negative GC initial delay provided: %s", opts.GCInitialDelay)
+	}
+	if opts.GCLookaheadInterval > 0 && opts.GCLookaheadInterval < opts.GCPurgeInterval {
+		return fmt.Errorf("lookahead interval must be larger than purge interval, respectively: %s, %s",
+			opts.GCLookaheadInterval, opts.GCPurgeInterval)
+	}
+	if opts.TTLGranularity < 0 {
+		return fmt.Errorf("negative TTL granularity provided: %s", opts.TTLGranularity)
+	}
+	if opts.TTLJitter < 0 || opts.TTLJitter >= 1 {
+		return fmt.Errorf("TTL jitter must be in the [0, 1) range, provided: %v", opts.TTLJitter)
+	}
+	if opts.OnExpireQueueSize < 0 {
+		return fmt.Errorf("negative OnExpire queue size provided: %d", opts.OnExpireQueueSize)
+	}
+	if opts.AddrHistorySize < 0 || opts.AddrHistoryPeers < 0 {
+		return fmt.Errorf("negative addr history size provided: %d size, %d peers", opts.AddrHistorySize,
+			opts.AddrHistoryPeers)
+	}
+	if (opts.EncodePeerKey == nil) != (opts.DecodePeerKey == nil) {
+		return fmt.Errorf("peer key encoding and decoding functions must be provided together")
+	}
+	if opts.ExpiryGracePeriod < 0 {
+		return fmt.Errorf("negative expiry grace period provided: %s", opts.ExpiryGracePeriod)
+	}
+	if opts.KnownPeersRetention < 0 {
+		return fmt.Errorf("negative known peers retention provided: %s", opts.KnownPeersRetention)
+	}
+	if opts.CacheTTL < 0 {
+		return fmt.Errorf("negative cache TTL provided: %s", opts.CacheTTL)
+	}
+	if opts.ScanChunkSize < 0 {
+		return fmt.Errorf("negative scan chunk size provided: %d", opts.ScanChunkSize)
+	}
+	if opts.MaxBatchSize < 0 {
+		return fmt.Errorf("negative max batch size provided: %d", opts.MaxBatchSize)
+	}
+	if opts.CloseTimeout < 0 {
+		return fmt.Errorf("negative close timeout provided: %s", opts.CloseTimeout)
+	}
+	switch opts.CacheSizeMode {
+	case CacheByPeer, CacheByAddr:
+	default:
+		return fmt.Errorf("unknown cache size mode provided: %d", opts.CacheSizeMode)
+	}
+	switch opts.AddrStreamOverflow {
+	case pstoremem.DropNewest, pstoremem.DropOldest:
+	default:
+		return fmt.Errorf("unknown addr stream overflow policy provided: %d", opts.AddrStreamOverflow)
+	}
+	return nil
+}
+
+// NewPeerstore creates a peerstore backed by the provided persistent datastore. Datastores that do not implement
+// ds.Batching are supported, but their batched writes are not atomic.
+//
+// The address, key, metadata and protocol books, along with latency metrics, all share the datastore and options.
+// Closing the peerstore closes them, stopping address book GC.
+func NewPeerstore(ctx context.Context, store ds.Datastore, opts Options) (ps pstore.Peerstore, err error) {
 	addrBook, err := NewAddrBook(ctx, store, opts)
 	if err != nil {
 		return nil, err
 	}
 
+	// the address book runs GC in the background, so we stop it if we fail to construct the remaining books.
+	defer func() {
+		if err != nil {
+			addrBook.Close()
+		}
+	}()
+
 	keyBook, err := NewKeyBook(ctx, store, opts)
 	if err != nil {
 		return nil, err
@@ -63,12 +328,23 @@ func NewPeerstore(ctx context.Context, store ds.Batching, opts Options) (pstore.
 		return nil, err
 	}
 
-	ps := pstore.NewPeerstore(keyBook, addrBook, peerMetadata)
+	protoBook, err := NewProtoBook(ctx, store, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics, err := NewMetrics(ctx, store, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ps = pstore.NewPeerstoreWithMetrics(keyBook, addrBook, peerMetadata, protoBook, metrics)
 	return ps, nil
 }
 
 // uniquePeerIds extracts and returns unique peer IDs from database keys.
-func uniquePeerIds(ds ds.Datastore, prefix ds.Key, extractor func(result query.Result) string) (peer.IDSlice, error) {
+func uniquePeerIds(ds ds.Datastore, prefix ds.Key, keys peerKeys, log Logger,
+	extractor func(result query.Result) string) (peer.IDSlice, error) {
 	var (
 		q       = query.Query{Prefix: prefix.String(), KeysOnly: true}
 		results query.Results
@@ -93,9 +369,12 @@ func uniquePeerIds(ds ds.Datastore, prefix ds.Key, extractor func(result query.R
 	}
 
 	ids := make(peer.IDSlice, 0, len(idset))
-	for id := range idset {
-		pid, _ := base32.RawStdEncoding.DecodeString(id)
-		id, _ := peer.IDFromBytes(pid)
+	for k := range idset {
+		id, err := keys.decode(k)
+		if err != nil {
+			log.Warningf("failed while decoding peer ID from key: %v, err: %v", k, err)
+			continue
+		}
 		ids = append(ids, id)
 	}
 	return ids, nil
@@ -0,0 +1,101 @@
+// Package prommetrics provides a Prometheus-backed implementation of pstoreds.MetricsCollector, exposing the cache
+// hit ratio, GC sweep latency, address expirations and corrupt records of a datastore-backed address book.
+package prommetrics
+
+import (
+	"time"
+
+	prometheus "github.com/prometheus/client_golang/prometheus"
+
+	pstoreds "github.com/libp2p/go-libp2p-peerstore/pstoreds"
+)
+
+const (
+	namespace = "libp2p"
+	subsystem = "peerstore_ds"
+)
+
+// Collector records address book instrumentation events as Prometheus metrics.
+type Collector struct {
+	cacheHits     prometheus.Counter
+	cacheMisses   prometheus.Counter
+	sweepDuration prometheus.Histogram
+	expired       prometheus.Counter
+	corrupt       prometheus.Counter
+}
+
+var _ pstoreds.MetricsCollector = (*Collector)(nil)
+
+// New creates a Collector and registers its metrics with the provided registerer. If the registerer is nil,
+// prometheus.DefaultRegisterer is used.
+func New(reg prometheus.Registerer) (*Collector, error) {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+
+	c := &Collector{
+		cacheHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "cache_hits_total",
+			Help:      "Number of address book lookups served from the cache.",
+		}),
+		cacheMisses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "cache_misses_total",
+			Help:      "Number of address book lookups that fell through to the datastore.",
+		}),
+		sweepDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "gc_sweep_duration_seconds",
+			Help:      "Time taken by address book GC purge cycles.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}),
+		expired: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "expired_addrs_total",
+			Help:      "Number of addresses dropped from the address book because they expired.",
+		}),
+		corrupt: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "corrupt_records_total",
+			Help:      "Number of stored peer records that could not be decoded.",
+		}),
+	}
+
+	for _, m := range []prometheus.Collector{c.cacheHits, c.cacheMisses, c.sweepDuration, c.expired, c.corrupt} {
+		if err := reg.Register(m); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// CacheHit increments libp2p_peerstore_ds_cache_hits_total.
+func (c *Collector) CacheHit() {
+	c.cacheHits.Inc()
+}
+
+// CacheMiss increments libp2p_peerstore_ds_cache_misses_total.
+func (c *Collector) CacheMiss() {
+	c.cacheMisses.Inc()
+}
+
+// SweepDuration observes the duration of a GC purge cycle in libp2p_peerstore_ds_gc_sweep_duration_seconds.
+func (c *Collector) SweepDuration(d time.Duration) {
+	c.sweepDuration.Observe(d.Seconds())
+}
+
+// ExpiredCount adds the number of expired addresses dropped to libp2p_peerstore_ds_expired_addrs_total.
+func (c *Collector) ExpiredCount(n int) {
+	c.expired.Add(float64(n))
+}
+
+// CorruptRecord increments libp2p_peerstore_ds_corrupt_records_total.
+func (c *Collector) CorruptRecord() {
+	c.corrupt.Inc()
+}
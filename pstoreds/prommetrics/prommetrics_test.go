@@ -0,0 +1,98 @@
+package prommetrics
+
+import (
+	"testing"
+	"time"
+
+	prometheus "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gather collects the metrics registered with reg, indexed by name.
+func gather(t *testing.T, reg *prometheus.Registry) map[string]*dto.Metric {
+	t.Helper()
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := make(map[string]*dto.Metric, len(mfs))
+	for _, mf := range mfs {
+		if len(mf.GetMetric()) != 1 {
+			t.Fatalf("expected a single metric in family %s, got: %d", mf.GetName(), len(mf.GetMetric()))
+		}
+		metrics[mf.GetName()] = mf.GetMetric()[0]
+	}
+	return metrics
+}
+
+func TestCollector(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	c, err := New(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		c.CacheHit()
+	}
+	c.CacheMiss()
+	c.SweepDuration(2 * time.Millisecond)
+	c.SweepDuration(500 * time.Millisecond)
+	c.ExpiredCount(5)
+	c.ExpiredCount(2)
+	c.CorruptRecord()
+
+	metrics := gather(t, reg)
+
+	counters := map[string]float64{
+		"libp2p_peerstore_ds_cache_hits_total":      3,
+		"libp2p_peerstore_ds_cache_misses_total":    1,
+		"libp2p_peerstore_ds_expired_addrs_total":   7,
+		"libp2p_peerstore_ds_corrupt_records_total": 1,
+	}
+	for name, expected := range counters {
+		m, ok := metrics[name]
+		if !ok {
+			t.Fatalf("expected metric %s to be registered", name)
+		}
+		if v := m.GetCounter().GetValue(); v != expected {
+			t.Errorf("expected %s to be %v, got: %v", name, expected, v)
+		}
+	}
+
+	m, ok := metrics["libp2p_peerstore_ds_gc_sweep_duration_seconds"]
+	if !ok {
+		t.Fatal("expected the sweep duration histogram to be registered")
+	}
+	h := m.GetHistogram()
+	if h.GetSampleCount() != 2 {
+		t.Fatalf("expected 2 sweeps observed, got: %d", h.GetSampleCount())
+	}
+	if sum := h.GetSampleSum(); sum < 0.501 || sum > 0.503 {
+		t.Fatalf("expected the sweeps to sum up to 0.502s, got: %v", sum)
+	}
+	// the buckets are cumulative: the short sweep falls in the 4ms one, and both in the 1.024s one.
+	for _, b := range h.GetBucket() {
+		var expected uint64
+		switch {
+		case b.GetUpperBound() >= 1.024:
+			expected = 2
+		case b.GetUpperBound() >= 0.004:
+			expected = 1
+		}
+		if b.GetCumulativeCount() != expected {
+			t.Errorf("expected %d sweeps in the %vs bucket, got: %d", expected, b.GetUpperBound(), b.GetCumulativeCount())
+		}
+	}
+}
+
+func TestCollectorDuplicateRegistration(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	if _, err := New(reg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(reg); err == nil {
+		t.Fatal("expected registering the metrics twice to fail")
+	}
+}
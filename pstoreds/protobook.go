@@ -0,0 +1,128 @@
+package pstoreds
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	ds "github.com/ipfs/go-datastore"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+)
+
+// Supported protocols are stored as a sorted set, under the following db key pattern:
+// /peers/protos/<b32 peer id no padding>
+var protoBase = ds.NewKey("/peers/protos")
+
+type dsProtoBook struct {
+	ds   ds.Datastore
+	keys peerKeys
+
+	// serializes read-modify-write cycles over the protocol sets.
+	lk sync.Mutex
+}
+
+var _ pstore.ProtoBook = (*dsProtoBook)(nil)
+
+// NewProtoBook creates a protocol book backed by a persistent datastore. The protocols supported by each peer are
+// stored as a sorted set in a single datastore entry, so that intersecting them with the protocols a caller is
+// interested in is cheap.
+func NewProtoBook(_ context.Context, store ds.Datastore, opts Options) (pstore.ProtoBook, error) {
+	return &dsProtoBook{ds: namespaced(store, opts.Namespace, newLogger(opts)), keys: newPeerKeys(opts)}, nil
+}
+
+func (pb *dsProtoBook) GetProtocols(p peer.ID) ([]string, error) {
+	pb.lk.Lock()
+	defer pb.lk.Unlock()
+
+	return pb.load(p)
+}
+
+func (pb *dsProtoBook) AddProtocols(p peer.ID, protos ...string) error {
+	pb.lk.Lock()
+	defer pb.lk.Unlock()
+
+	existing, err := pb.load(p)
+	if err != nil {
+		return err
+	}
+	return pb.store(p, append(existing, protos...))
+}
+
+func (pb *dsProtoBook) SetProtocols(p peer.ID, protos ...string) error {
+	pb.lk.Lock()
+	defer pb.lk.Unlock()
+
+	return pb.store(p, append([]string(nil), protos...))
+}
+
+func (pb *dsProtoBook) SupportsProtocols(p peer.ID, protos ...string) ([]string, error) {
+	pb.lk.Lock()
+	defer pb.lk.Unlock()
+
+	supported, err := pb.load(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, proto := range protos {
+		if i := sort.SearchStrings(supported, proto); i < len(supported) && supported[i] == proto {
+			out = append(out, proto)
+		}
+	}
+	return out, nil
+}
+
+// load fetches the sorted set of protocols supported by a peer. To be called within a lock.
+func (pb *dsProtoBook) load(p peer.ID) ([]string, error) {
+	value, err := pb.ds.Get(pb.protoKey(p))
+	switch err {
+	case nil:
+	case ds.ErrNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	var protos []string
+	if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&protos); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode protocols for peer %s", p.Pretty())
+	}
+	return protos, nil
+}
+
+// store sorts and deduplicates the protocols in place, and writes them as the set supported by a peer. An empty set
+// deletes the entry. To be called within a lock.
+func (pb *dsProtoBook) store(p peer.ID, protos []string) error {
+	sort.Strings(protos)
+	uniq := protos[:0]
+	for _, proto := range protos {
+		if len(uniq) > 0 && proto == uniq[len(uniq)-1] {
+			continue
+		}
+		uniq = append(uniq, proto)
+	}
+
+	if len(uniq) == 0 {
+		if err := pb.ds.Delete(pb.protoKey(p)); err != nil && err != ds.ErrNotFound {
+			return err
+		}
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(uniq); err != nil {
+		return errors.Wrapf(err, "failed to encode protocols for peer %s", p.Pretty())
+	}
+	return pb.ds.Put(pb.protoKey(p), buf.Bytes())
+}
+
+func (pb *dsProtoBook) protoKey(p peer.ID) ds.Key {
+	return pb.keys.child(protoBase, p)
+}
@@ -0,0 +1,61 @@
+package pstoreds
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+
+	pt "github.com/libp2p/go-libp2p-peerstore/test"
+)
+
+func TestDsProtoBook(t *testing.T) {
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+	pb, err := NewProtoBook(context.Background(), store, DefaultOpts())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := pt.GeneratePeerIDs(1)[0]
+
+	if protos, err := pb.GetProtocols(id); err != nil || len(protos) != 0 {
+		t.Fatalf("expected no protocols for an unknown peer, got: %v, err: %v", protos, err)
+	}
+
+	if err := pb.AddProtocols(id, "/c", "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pb.AddProtocols(id, "/b", "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if protos, err := pb.GetProtocols(id); err != nil || !reflect.DeepEqual(protos, []string{"/a", "/b", "/c"}) {
+		t.Fatalf("expected a sorted set of protocols, got: %v, err: %v", protos, err)
+	}
+
+	supported, err := pb.SupportsProtocols(id, "/q", "/c", "/a", "/y")
+	if err != nil || !reflect.DeepEqual(supported, []string{"/c", "/a"}) {
+		t.Fatalf("unexpected supported protocols: %v, err: %v", supported, err)
+	}
+
+	if err := pb.SetProtocols(id, "/other"); err != nil {
+		t.Fatal(err)
+	}
+	if protos, err := pb.GetProtocols(id); err != nil || !reflect.DeepEqual(protos, []string{"/other"}) {
+		t.Fatalf("expected protocols to be replaced, got: %v, err: %v", protos, err)
+	}
+
+	// protocols are persisted in the datastore.
+	pb, _ = NewProtoBook(context.Background(), store, DefaultOpts())
+	if supported, err := pb.SupportsProtocols(id, "/a", "/other"); err != nil || len(supported) != 1 {
+		t.Fatalf("expected protocols to be persisted, got: %v, err: %v", supported, err)
+	}
+
+	if err := pb.SetProtocols(id); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := store.Has(pb.(*dsProtoBook).protoKey(id)); has {
+		t.Fatal("expected an empty set to delete the entry")
+	}
+}
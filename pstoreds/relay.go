@@ -0,0 +1,103 @@
+package pstoreds
+
+import (
+	"fmt"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pb "github.com/libp2p/go-libp2p-peerstore/pb"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// circuitCode is the code of the p2p-circuit protocol. go-multiaddr doesn't register it; the circuit relay transport
+// does, so relay addresses can only be parsed once it's loaded.
+const circuitCode = 0x0122
+
+// isRelayAddr returns whether an address is routed through a relay, i.e. it holds a p2p-circuit component.
+func isRelayAddr(addr ma.Multiaddr) (relay bool) {
+	ma.ForEach(addr, func(c ma.Component) bool {
+		relay = c.Protocol().Code == circuitCode
+		return !relay
+	})
+	return relay
+}
+
+// relayOf returns the ID of the relay an address is routed through, i.e. the value of the last p2p component preceding
+// its p2p-circuit component. The second return value is false if the address isn't routed through a relay, or the
+// relay isn't specified.
+func relayOf(addr ma.Multiaddr) (peer.ID, bool) {
+	var (
+		relay string
+		found bool
+	)
+	ma.ForEach(addr, func(c ma.Component) bool {
+		switch c.Protocol().Code {
+		case ma.P_P2P:
+			relay = c.Value()
+		case circuitCode:
+			found = true
+			return false
+		}
+		return true
+	})
+	if !found || relay == "" {
+		return "", false
+	}
+	id, err := peer.IDB58Decode(relay)
+	if err != nil {
+		return "", false
+	}
+	return id, true
+}
+
+// RelayAddrs returns the non-expired addresses of a peer that are routed through a relay, sorted by descending
+// priority.
+func (ab *dsAddrBook) RelayAddrs(p peer.ID) []ma.Multiaddr {
+	return ab.AddrsFiltered(p, isRelayAddr)
+}
+
+// clearRelayed removes the addresses of all peers that are routed through any of the given relays. It visits every
+// record in the datastore. To be called within beginWrite and endWrite.
+func (ab *dsAddrBook) clearRelayed(relays map[peer.ID]struct{}) error {
+	results, err := ab.ds.Query(forEachQuery)
+	if err != nil {
+		return fmt.Errorf("failed while querying records to clear relayed addrs, err: %v", err)
+	}
+
+	// addresses are collected first, and removed once the iterator is closed.
+	relayed := make(map[peer.ID][]ma.Multiaddr)
+	record := &pb.AddrBookRecord{}
+	for result := range results.Next() {
+		if result.Error != nil {
+			results.Close()
+			return fmt.Errorf("failed while iterating records to clear relayed addrs, err: %v", result.Error)
+		}
+		record.Reset()
+		if err = ab.codec.Unmarshal(result.Value, record); err != nil || record.Id == nil {
+			continue
+		}
+		if _, ok := relays[record.Id.ID]; ok {
+			// the relays themselves are being cleared.
+			continue
+		}
+		for _, entry := range record.Addrs {
+			if relay, ok := relayOf(entry.Addr.Multiaddr); ok {
+				if _, ok := relays[relay]; ok {
+					relayed[record.Id.ID] = append(relayed[record.Id.ID], entry.Addr.Multiaddr)
+				}
+			}
+		}
+	}
+	results.Close()
+
+	var errs []error
+	for p, addrs := range relayed {
+		if err = ab.deleteAddrs(p, addrs); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed while clearing relayed addrs; err(s): %q", errs)
+	}
+	return nil
+}
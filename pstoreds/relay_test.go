@@ -0,0 +1,69 @@
+package pstoreds
+
+import (
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	test "github.com/libp2p/go-libp2p-peerstore/test"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func init() {
+	// the circuit relay transport usually registers this protocol.
+	if ma.ProtocolWithCode(circuitCode).Code == 0 {
+		err := ma.AddProtocol(ma.Protocol{
+			Name:  "p2p-circuit",
+			Code:  circuitCode,
+			VCode: ma.CodeToVarint(circuitCode),
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestRelayAddrs(t *testing.T) {
+	for name, cascade := range map[string]bool{"Cascading": true, "NonCascading": false} {
+		t.Run(name, func(t *testing.T) {
+			opts := DefaultOpts()
+			opts.GCPurgeInterval = 0
+			opts.ClearRelayedAddrs = cascade
+
+			ab, closeFn := addressBookFactory(t, badgerStore, opts)()
+			defer closeFn()
+			dsab := ab.(*dsAddrBook)
+
+			ids := test.GeneratePeerIDs(4)
+			relay, other, target, bystander := ids[0], ids[1], ids[2], ids[3]
+			relayed := func(via peer.ID) ma.Multiaddr {
+				return ma.StringCast("/ip4/5.6.7.8/tcp/4001/p2p/" + via.Pretty() + "/p2p-circuit")
+			}
+			direct := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+
+			ab.AddAddr(relay, ma.StringCast("/ip4/5.6.7.8/tcp/4001"), time.Hour)
+			ab.AddAddrs(target, []ma.Multiaddr{direct, relayed(relay), relayed(other)}, time.Hour)
+			ab.AddAddr(bystander, relayed(other), time.Hour)
+
+			test.AssertAddressesEqual(t, []ma.Multiaddr{relayed(relay), relayed(other)}, dsab.RelayAddrs(target))
+			test.AssertAddressesEqual(t, nil, dsab.RelayAddrs(relay))
+
+			ab.ClearAddrs(relay)
+			if cascade {
+				test.AssertAddressesEqual(t, []ma.Multiaddr{direct, relayed(other)}, ab.Addrs(target))
+			} else {
+				test.AssertAddressesEqual(t, []ma.Multiaddr{direct, relayed(relay), relayed(other)}, ab.Addrs(target))
+			}
+			test.AssertAddressesEqual(t, []ma.Multiaddr{relayed(other)}, ab.Addrs(bystander))
+
+			if cascade {
+				if err := dsab.ClearAddrsMany([]peer.ID{other}); err != nil {
+					t.Fatal(err)
+				}
+				test.AssertAddressesEqual(t, []ma.Multiaddr{direct}, ab.Addrs(target))
+				test.AssertAddressesEqual(t, nil, ab.Addrs(bystander))
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package pstoreds
+
+import (
+	query "github.com/ipfs/go-datastore/query"
+)
+
+// scan runs a query meant to visit a large part of the store, e.g. to export it or sweep it. The query must order its
+// results by key, and neither skip nor limit them.
+//
+// If Options.ScanChunkSize is set, the query is split into successive queries of that many entries each, which are
+// only opened as the previous one is exhausted; otherwise, the query is run as-is. Each chunk resumes after the last
+// key read from the previous one, so that records added or deleted in the meantime, e.g. by the scan itself, don't
+// shift the chunks.
+func (ab *dsAddrBook) scan(q query.Query) (query.Results, error) {
+	size := ab.opts.ScanChunkSize
+	if size <= 0 {
+		return ab.ds.Query(q)
+	}
+
+	var (
+		cur  query.Results
+		read int    // entries read from the current chunk.
+		last string // key of the last entry read.
+		done bool
+	)
+
+	next := func() (query.Result, bool) {
+		for !done {
+			if cur == nil {
+				// no limit is set, as some datastores apply it before filters; we stop reading at the chunk size
+				// ourselves instead.
+				chunk := q
+				if last != "" {
+					chunk.Filters = append(q.Filters[:len(q.Filters):len(q.Filters)],
+						query.FilterKeyCompare{Op: query.GreaterThan, Key: last})
+				}
+				var err error
+				if cur, err = ab.ds.Query(chunk); err != nil {
+					done = true
+					return query.Result{Error: err}, true
+				}
+				read = 0
+			}
+
+			if read < size {
+				if result, ok := cur.NextSync(); ok {
+					read++
+					// the scan can't resume past an entry that failed to be read, so it ends there.
+					last, done = result.Key, result.Error != nil
+					return result, true
+				}
+			}
+
+			// the chunk is exhausted; a short one means we reached the end.
+			cur.Close()
+			cur = nil
+			done = read < size
+		}
+		return query.Result{}, false
+	}
+
+	closeFn := func() error {
+		done = true
+		if cur == nil {
+			return nil
+		}
+		err := cur.Close()
+		cur = nil
+		return err
+	}
+
+	return query.ResultsFromIterator(q, query.Iterator{Next: next, Close: closeFn}), nil
+}
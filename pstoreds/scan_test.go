@@ -0,0 +1,130 @@
+package pstoreds
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	query "github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pb "github.com/libp2p/go-libp2p-peerstore/pb"
+	test "github.com/libp2p/go-libp2p-peerstore/test"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// queryCountingStore counts the queries run against a datastore.
+type queryCountingStore struct {
+	ds.Batching
+	queries int32
+}
+
+func (s *queryCountingStore) Query(q query.Query) (query.Results, error) {
+	atomic.AddInt32(&s.queries, 1)
+	return s.Batching.Query(q)
+}
+
+func TestScanChunkSize(t *testing.T) {
+	store := &queryCountingStore{Batching: dssync.MutexWrap(ds.NewMapDatastore())}
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.ScanChunkSize = 3
+
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	ids := test.GeneratePeerIDs(10)
+	addrs := test.GenerateAddrs(1)
+	for _, id := range ids {
+		ab.AddAddrs(id, addrs, time.Hour)
+	}
+
+	atomic.StoreInt32(&store.queries, 0)
+	visited := make(map[peer.ID]struct{})
+	err = ab.ForEach(context.Background(), func(p peer.ID, _ []ma.Multiaddr) error {
+		visited[p] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visited) != len(ids) {
+		t.Fatalf("expected %d peers to be visited, got %d", len(ids), len(visited))
+	}
+	// 3 full chunks, and a short one that ends the scan.
+	if queries := atomic.LoadInt32(&store.queries); queries != 4 {
+		t.Fatalf("expected 4 queries, got %d", queries)
+	}
+
+	// stopping early doesn't run further queries.
+	atomic.StoreInt32(&store.queries, 0)
+	err = ab.ForEach(context.Background(), func(peer.ID, []ma.Multiaddr) error {
+		return context.Canceled
+	})
+	if err != context.Canceled {
+		t.Fatalf("expected the error returned by fn, got %v", err)
+	}
+	if queries := atomic.LoadInt32(&store.queries); queries != 1 {
+		t.Fatalf("expected 1 query, got %d", queries)
+	}
+}
+
+func TestScanChunkSizeSweep(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("IndexAddrs=%v", indexed), func(t *testing.T) {
+			ab, clock, closeFn := newClockedAddrBook(t, func(opts *Options) {
+				opts.CacheSize = 0
+				opts.ScanChunkSize = 3
+				// the sweep commits its deletions while scanning.
+				opts.MaxBatchSize = 1
+				opts.IndexAddrs = indexed
+			})
+			defer closeFn()
+
+			ids := test.GeneratePeerIDs(20)
+			addrs := test.GenerateAddrs(2)
+			for i, id := range ids {
+				ab.AddAddr(id, addrs[0], time.Minute)
+				if i%2 == 0 {
+					ab.AddAddr(id, addrs[1], time.Hour)
+				}
+			}
+
+			clock.Advance(2 * time.Minute)
+			if err := ab.gc.sweepStore(); err != nil {
+				t.Fatal(err)
+			}
+
+			// every record was visited: the records without live addresses were deleted, and the others were cleaned.
+			results, err := ab.ds.Query(query.Query{Prefix: addrBookBase.String()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := results.Rest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(ids)/2 {
+				t.Fatalf("expected %d records left, got %d", len(ids)/2, len(entries))
+			}
+			for _, e := range entries {
+				record := &addrsRecord{AddrBookRecord: &pb.AddrBookRecord{}}
+				if err := ab.codec.Unmarshal(e.Value, record.AddrBookRecord); err != nil {
+					t.Fatal(err)
+				}
+				if len(record.Addrs) != 1 || !record.Addrs[0].Addr.Equal(addrs[1]) {
+					t.Fatalf("expected record %s to be cleaned, got: %v", e.Key, record.Addrs)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package pstoreds
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	query "github.com/ipfs/go-datastore/query"
+
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	pb "github.com/libp2p/go-libp2p-peerstore/pb"
+)
+
+// StorageStats describes the footprint of the address book in the datastore.
+type StorageStats struct {
+	// Number of peer records stored, including those whose addresses have all expired but haven't been purged yet.
+	Peers int
+	// Number of address entries stored across all records, including expired ones that haven't been purged yet.
+	Addrs int
+	// Number of expired address entries still stored, awaiting GC.
+	ExpiredAddrs int
+	// Number of GC lookahead entries stored.
+	LookaheadEntries int
+	// Total size of the stored records, in bytes, excluding datastore overhead.
+	RecordBytes uint64
+	// Space used by the whole datastore, as reported by it if it implements ds.PersistentDatastore, or 0 otherwise.
+	// Note that it is not attributable to the address book alone if the datastore is shared.
+	DiskUsage uint64
+}
+
+var lookaheadEntriesQuery = query.Query{Prefix: gcLookaheadBase.String(), KeysOnly: true}
+
+// StorageStats reports the footprint of the address book in the datastore. It traverses all records, so it's meant to
+// be called occasionally, e.g. by operators monitoring growth. It stops with the context's error if the context is
+// done before it completes.
+func (ab *dsAddrBook) StorageStats(ctx context.Context) (stats StorageStats, err error) {
+	now := ab.clock.Now().Unix()
+	record := &pb.AddrBookRecord{}
+	err = ab.visit(ctx, forEachQuery, func(result query.Result) {
+		stats.Peers++
+		stats.RecordBytes += uint64(len(result.Value))
+
+		record.Reset()
+		if err := ab.codec.Unmarshal(result.Value, record); err != nil {
+			ab.metrics.CorruptRecord()
+			ab.log.Warningf("failed while unmarshalling record with key: %v, err: %v", result.Key, err)
+			return
+		}
+		stats.Addrs += len(record.Addrs)
+		for _, entry := range record.Addrs {
+			if entry.Expiry <= now {
+				stats.ExpiredAddrs++
+			}
+		}
+	})
+	if err != nil {
+		return StorageStats{}, err
+	}
+
+	err = ab.visit(ctx, lookaheadEntriesQuery, func(query.Result) { stats.LookaheadEntries++ })
+	if err != nil {
+		return StorageStats{}, err
+	}
+
+	if stats.DiskUsage, err = ds.DiskUsage(ab.ds); err != nil {
+		return StorageStats{}, fmt.Errorf("failed while querying datastore disk usage, err: %v", err)
+	}
+	return stats, nil
+}
+
+// NextExpiry returns the earliest expiry of the addresses stored, which is when the next GC cycle has work to do, once
+// Options.ExpiryGracePeriod is added. It may be in the past, if expired addresses are awaiting GC. Permanent addresses
+// never expire, so they're not considered. The second return value is false if no address is stored, or the datastore
+// can't be read. Like StorageStats, it traverses all records.
+func (ab *dsAddrBook) NextExpiry() (time.Time, bool) {
+	next := int64(math.MaxInt64)
+	record := &pb.AddrBookRecord{}
+	err := ab.visit(context.Background(), forEachQuery, func(result query.Result) {
+		record.Reset()
+		if err := ab.codec.Unmarshal(result.Value, record); err != nil {
+			ab.metrics.CorruptRecord()
+			ab.log.Warningf("failed while unmarshalling record with key: %v, err: %v", result.Key, err)
+			return
+		}
+		for _, entry := range record.Addrs {
+			if entry.Ttl != int64(pstore.PermanentAddrTTL) && entry.Expiry < next {
+				next = entry.Expiry
+			}
+		}
+	})
+	if err != nil {
+		ab.log.Warningf("failed while looking up the next expiry: %v", err)
+		return time.Time{}, false
+	}
+	if next == math.MaxInt64 {
+		return time.Time{}, false
+	}
+	return time.Unix(next, 0), true
+}
+
+// visit calls fn with every result of a query, until all results are visited, or the context is done.
+func (ab *dsAddrBook) visit(ctx context.Context, q query.Query, fn func(query.Result)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	results, err := ab.ds.Query(q)
+	if err != nil {
+		return fmt.Errorf("failed while opening iterator, err: %v", err)
+	}
+	defer results.Close()
+
+	ch := results.Next()
+	for {
+		select {
+		case result, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if result.Error != nil {
+				return fmt.Errorf("failed while iterating entries, err: %v", result.Error)
+			}
+			fn(result)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package pstoreds
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	test "github.com/libp2p/go-libp2p-peerstore/test"
+)
+
+func TestStorageStats(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, nil)
+	defer closeFn()
+
+	ids := test.GeneratePeerIDs(2)
+	addrs := test.GenerateAddrs(3)
+
+	ab.AddAddrs(ids[0], addrs[0:2], time.Hour)
+	ab.AddAddr(ids[1], addrs[2], time.Minute)
+
+	// the expired address is still stored, as GC hasn't run.
+	clock.Advance(2 * time.Minute)
+
+	stats, err := ab.StorageStats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Peers != 2 || stats.Addrs != 3 || stats.ExpiredAddrs != 1 {
+		t.Fatalf("expected 2 peers and 3 addrs, 1 of them expired; got %+v", stats)
+	}
+	if stats.RecordBytes == 0 {
+		t.Fatal("expected records to take up space")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ab.StorageStats(ctx); err != context.Canceled {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+}
+
+func TestNextExpiry(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, nil)
+	defer closeFn()
+
+	if _, ok := ab.NextExpiry(); ok {
+		t.Fatal("expected no expiry on an empty store")
+	}
+
+	ids := test.GeneratePeerIDs(3)
+	addrs := test.GenerateAddrs(3)
+
+	ab.AddAddr(ids[0], addrs[0], pstore.PermanentAddrTTL)
+	if _, ok := ab.NextExpiry(); ok {
+		t.Fatal("expected permanent addrs not to expire")
+	}
+
+	ab.AddAddr(ids[1], addrs[1], time.Hour)
+	ab.AddAddr(ids[2], addrs[2], time.Minute)
+
+	expected := clock.Now().Add(time.Minute).Unix()
+	if next, ok := ab.NextExpiry(); !ok || next.Unix() != expected {
+		t.Fatalf("expected the next expiry at %d, got %d (%v)", expected, next.Unix(), ok)
+	}
+
+	// expired addresses awaiting GC are still reported.
+	clock.Advance(2 * time.Minute)
+	if next, ok := ab.NextExpiry(); !ok || next.Unix() != expected {
+		t.Fatalf("expected the next expiry at %d, got %d (%v)", expected, next.Unix(), ok)
+	}
+}
@@ -0,0 +1,153 @@
+package pstoreds
+
+import (
+	"fmt"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pb "github.com/libp2p/go-libp2p-peerstore/pb"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// AddrBookTxn stages address book writes in a datastore transaction owned by the caller, so that they can be committed
+// atomically along with writes of the caller's own. See dsAddrBook.WithTxn.
+type AddrBookTxn struct {
+	ab  *dsAddrBook
+	txn ds.Txn
+
+	// txn, with keys rooted under Options.Namespace.
+	rw txnReadWriter
+
+	// peers whose records have been staged, to be evicted from the cache upon commit.
+	touched map[peer.ID]struct{}
+}
+
+// txnReadWriter is the subset of a transaction used to read and write peer records.
+type txnReadWriter interface {
+	Get(key ds.Key) ([]byte, error)
+	ds.Write
+}
+
+// WithTxn returns a handle to stage address book writes in the provided transaction, which must have been opened
+// against the datastore the address book was created with. Keys are rooted under Options.Namespace, like all other
+// writes of the address book.
+//
+// Records are read through the transaction, so several writes staged for the same peer compose. Reads served by the
+// address book observe the committed state until the handle's Commit is called, which commits the transaction and
+// evicts the records it touched from the cache. Committing the transaction by other means leaves stale records in the
+// cache. Address streams are notified as writes are staged, whether the transaction is committed or not.
+func (ab *dsAddrBook) WithTxn(txn ds.Txn) *AddrBookTxn {
+	t := &AddrBookTxn{
+		ab:      ab,
+		txn:     txn,
+		rw:      txn,
+		touched: make(map[peer.ID]struct{}),
+	}
+	if ns := ab.opts.Namespace; ns.String() != "" && ns.String() != "/" {
+		t.rw = &namespacedTxn{txnReadWriter: txn, prefix: ns}
+	}
+	if ab.opts.IndexAddrs {
+		t.rw = &indexedTxn{txnReadWriter: t.rw}
+	}
+	return t
+}
+
+// AddAddrs stages the equivalent of dsAddrBook.AddAddrs in the transaction.
+func (t *AddrBookTxn) AddAddrs(p peer.ID, addrs []ma.Multiaddr, ttl time.Duration) error {
+	t.ab.beginWrite()
+	defer t.ab.endWrite()
+
+	if ttl <= 0 {
+		return nil
+	}
+	pr, err := t.loadRecord(p)
+	if err != nil {
+		return err
+	}
+	return t.ab.mergeAddrs(t.rw, pr, t.ab.cleanAddrs(addrs), ttl, ttlExtend, nil)
+}
+
+// SetAddrs stages the equivalent of dsAddrBook.SetAddrs in the transaction.
+func (t *AddrBookTxn) SetAddrs(p peer.ID, addrs []ma.Multiaddr, ttl time.Duration) error {
+	t.ab.beginWrite()
+	defer t.ab.endWrite()
+
+	pr, err := t.loadRecord(p)
+	if err != nil {
+		return err
+	}
+	addrs = t.ab.cleanAddrs(addrs)
+	if ttl <= 0 {
+		return t.ab.removeAddrs(t.rw, pr, addrs)
+	}
+	return t.ab.mergeAddrs(t.rw, pr, addrs, ttl, ttlOverride, nil)
+}
+
+// Commit commits the transaction, and evicts the records it touched from the cache, so that subsequent reads observe
+// them.
+func (t *AddrBookTxn) Commit() error {
+	err := t.txn.Commit()
+	for p := range t.touched {
+		t.ab.cache.Remove(p)
+	}
+	t.touched = make(map[peer.ID]struct{})
+	return err
+}
+
+// Discard discards the transaction.
+func (t *AddrBookTxn) Discard() {
+	t.txn.Discard()
+	t.touched = make(map[peer.ID]struct{})
+}
+
+// loadRecord fetches the record of a peer through the transaction, bypassing the cache. Invalid peer IDs are rejected,
+// as in dsAddrBook.setAddrs.
+func (t *AddrBookTxn) loadRecord(p peer.ID) (*addrsRecord, error) {
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("refusing to stage addrs, err: %v", err)
+	}
+	t.touched[p] = struct{}{}
+
+	pr := &addrsRecord{AddrBookRecord: &pb.AddrBookRecord{}}
+	key := t.ab.keys.child(addrBookBase, p)
+	data, err := t.rw.Get(key)
+
+	switch err {
+	case ds.ErrNotFound:
+		pr.Id = &pb.ProtoPeerID{ID: p}
+	case nil:
+		if err = t.ab.codec.Unmarshal(data, pr.AddrBookRecord); err != nil {
+			t.ab.metrics.CorruptRecord()
+			return nil, fmt.Errorf("failed to decode stored record for peer %v, err: %v", p, err)
+		}
+		t.ab.clean(pr)
+	default:
+		return nil, fmt.Errorf("failed to load peerstore entry for peer %v in transaction, err: %v", p, err)
+	}
+	return pr, nil
+}
+
+// namespacedTxn roots the keys read and written through a transaction under a prefix.
+type namespacedTxn struct {
+	txnReadWriter
+	prefix ds.Key
+}
+
+func (t *namespacedTxn) Get(key ds.Key) ([]byte, error) {
+	return t.txnReadWriter.Get(t.prefix.Child(key))
+}
+
+func (t *namespacedTxn) Put(key ds.Key, value []byte) error {
+	return t.txnReadWriter.Put(t.prefix.Child(key), value)
+}
+
+func (t *namespacedTxn) PutWithTTL(key ds.Key, value []byte, ttl time.Duration) error {
+	return putWithTTL(t.txnReadWriter, t.prefix.Child(key), value, ttl)
+}
+
+func (t *namespacedTxn) Delete(key ds.Key) error {
+	return t.txnReadWriter.Delete(t.prefix.Child(key))
+}
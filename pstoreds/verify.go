@@ -0,0 +1,194 @@
+package pstoreds
+
+import (
+	"context"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+	query "github.com/ipfs/go-datastore/query"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pb "github.com/libp2p/go-libp2p-peerstore/pb"
+)
+
+// VerifyReport describes the discrepancies found by Verify.
+type VerifyReport struct {
+	// Number of address records stored.
+	Records int
+	// Peers whose record holds addresses that are past their expiry (and grace period), which GC should have dropped.
+	Expired []peer.ID
+	// Peers whose cached record disagrees with the datastore on whether the peer has a record at all: the cached one
+	// holds addresses but none is stored, or vice versa. This happens when other processes write to the datastore,
+	// or when the datastore expires records on its own. Peers first written while Verify runs may be reported too;
+	// evicting them is harmless.
+	Dangling []peer.ID
+	// GC lookahead entries scheduling visits to peers that have no stored record.
+	Orphaned []ds.Key
+	// Whether the discrepancies were repaired: expired addresses dropped, dangling records evicted from the cache, and
+	// orphaned GC lookahead entries deleted.
+	Repaired bool
+}
+
+// Verify reconciles the in-memory state of the address book and its GC lookahead entries with the records in the
+// datastore, which can drift apart after crashes or writes by other processes, and reports the discrepancies found.
+// If repair is true, they're repaired as well. Entries GC reclaims, such as undecodable records, are left to it. If a
+// GC cycle is in progress, Verify waits for it to finish first.
+//
+// Repairs are written in batches of Options.MaxBatchSize operations, committed as they fill up, so they're not atomic:
+// if Verify fails, part of the discrepancies may have been repaired already. The report is only marked as Repaired if
+// all of them were. Running Verify again picks up the rest.
+//
+// Verify traverses the entire store, so it's meant to be run occasionally, e.g. as a periodic self-healing job. It
+// stops with the context's error if the context is done before it completes; discrepancies found by then are
+// reported.
+func (ab *dsAddrBook) Verify(ctx context.Context, repair bool) (VerifyReport, error) {
+	return ab.gc.verify(ctx, repair)
+}
+
+// verify implements dsAddrBook.Verify.
+func (gc *dsAddrBookGc) verify(ctx context.Context, repair bool) (report VerifyReport, err error) {
+	if err = ctx.Err(); err != nil {
+		return report, err
+	}
+
+	select {
+	case gc.running <- struct{}{}:
+		defer func() { <-gc.running }()
+	case <-ctx.Done():
+		return report, ctx.Err()
+	}
+
+	batch, err := newCyclicBatch(gc.ab.ds, gc.ab.batchSize())
+	if err != nil {
+		return report, fmt.Errorf("failed while creating batch to repair store: %v", err)
+	}
+
+	// cached records repaired in the batch; they're evicted unless all repairs are committed, as they may no longer
+	// match the store.
+	var repaired []*addrsRecord
+	failed := 0
+	defer func() {
+		if report.Repaired {
+			return
+		}
+		gc.ab.cacheLk.Lock()
+		defer gc.ab.cacheLk.Unlock()
+		for _, pr := range repaired {
+			if e, ok := gc.ab.cache.Peek(pr.Id.ID); ok && e.(*addrsRecord) == pr {
+				gc.ab.cache.Remove(pr.Id.ID)
+			}
+		}
+	}()
+
+	now := gc.ab.clock.Now().Unix()
+	expired := func(pr *addrsRecord) bool {
+		for _, entry := range pr.Addrs {
+			if gc.ab.purgeAt(entry) <= now {
+				return true
+			}
+		}
+		return false
+	}
+
+	// keys: 	/peers/addrs/<peer ID b32>
+	stored := make(map[string]struct{})
+	record := &addrsRecord{AddrBookRecord: &pb.AddrBookRecord{}}
+	err = gc.visit(ctx, purgeStoreQuery, func(result query.Result) {
+		key := ds.RawKey(result.Key)
+		stored[key.Name()] = struct{}{}
+		report.Records++
+
+		record.Reset()
+		if err := gc.ab.codec.Unmarshal(result.Value, record.AddrBookRecord); err != nil || record.Id == nil {
+			return
+		}
+		id := record.Id.ID
+
+		// if the record is in cache, that instance is checked instead, as it's the one being served.
+		pr := record
+		if e, ok := gc.ab.cache.Peek(id); ok {
+			pr = e.(*addrsRecord)
+		}
+		pr.Lock()
+		defer pr.Unlock()
+
+		if !expired(pr) {
+			return
+		}
+		report.Expired = append(report.Expired, id)
+		if repair && gc.ab.clean(pr) {
+			if pr != record {
+				repaired = append(repaired, pr)
+			}
+			if err := gc.ab.flushRecord(batch, pr); err != nil {
+				gc.ab.log.Warningf("failed to flush entry repaired by verify for peer: %v, err: %v", id, err)
+				failed++
+			} else if len(pr.Addrs) == 0 {
+				// the record was deleted.
+				delete(stored, key.Name())
+			}
+		}
+	})
+	if err != nil {
+		return report, err
+	}
+
+	// keys: 	/peers/gc/addrs/<unix timestamp of next visit>/<peer ID b32>
+	err = gc.visit(ctx, purgeLookaheadQuery, func(result query.Result) {
+		gcKey := ds.RawKey(result.Key)
+		if _, ok := stored[gcKey.Name()]; ok {
+			return
+		}
+		report.Orphaned = append(report.Orphaned, gcKey)
+		if repair {
+			if err := batch.Delete(gcKey); err != nil {
+				gc.ab.log.Warningf("failed to delete orphaned GC lookahead entry: %v, err: %v", gcKey, err)
+				failed++
+			}
+		}
+	})
+	if err != nil {
+		return report, err
+	}
+
+	for _, k := range gc.ab.cache.Keys() {
+		id, ok := k.(peer.ID)
+		if !ok {
+			continue
+		}
+		e, ok := gc.ab.cache.Peek(id)
+		if !ok {
+			continue
+		}
+		pr := e.(*addrsRecord)
+		pr.RLock()
+		held := len(pr.Addrs) > 0
+		pr.RUnlock()
+
+		_, ok = stored[gc.ab.keys.encode(id)]
+		if held == ok {
+			continue
+		}
+		report.Dangling = append(report.Dangling, id)
+		if repair {
+			// evict the record, unless a concurrent load has replaced it already.
+			gc.ab.cacheLk.Lock()
+			if e, ok := gc.ab.cache.Peek(id); ok && e.(*addrsRecord) == pr {
+				gc.ab.cache.Remove(id)
+			}
+			gc.ab.cacheLk.Unlock()
+		}
+	}
+
+	if !repair {
+		return report, nil
+	}
+	if err = batch.Commit(); err != nil {
+		return report, fmt.Errorf("failed to commit verify repair batch: %v", err)
+	}
+	if failed > 0 {
+		return report, fmt.Errorf("failed to repair %d discrepancies", failed)
+	}
+	report.Repaired = true
+	return report, nil
+}
@@ -0,0 +1,227 @@
+package pstoreds
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+
+	test "github.com/libp2p/go-libp2p-peerstore/test"
+
+	b32 "github.com/multiformats/go-base32"
+)
+
+func TestVerify(t *testing.T) {
+	ab, clock, closeFn := newClockedAddrBook(t, nil)
+	defer closeFn()
+
+	ids := test.GeneratePeerIDs(4)
+	addrs := test.GenerateAddrs(3)
+
+	ab.AddAddr(ids[0], addrs[0], time.Minute)
+	ab.AddAddr(ids[1], addrs[1], time.Hour)
+	ab.AddAddr(ids[2], addrs[2], time.Hour)
+
+	// the record of a cached peer is deleted behind the address book's back.
+	key := func(p string) string { return b32.RawStdEncoding.EncodeToString([]byte(p)) }
+	if err := ab.ds.Delete(addrBookBase.ChildString(key(string(ids[1])))); err != nil {
+		t.Fatal(err)
+	}
+	// a GC lookahead entry is left behind for a peer with no record.
+	orphan := gcLookaheadBase.ChildString("42/" + key(string(ids[3])))
+	if err := ab.ds.Put(orphan, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Minute)
+
+	assertReport := func(report VerifyReport, records int, discrepancies bool) {
+		t.Helper()
+
+		if report.Records != records {
+			t.Fatalf("expected %d records, got %+v", records, report)
+		}
+		if !discrepancies {
+			if len(report.Expired) != 0 || len(report.Dangling) != 0 || len(report.Orphaned) != 0 {
+				t.Fatalf("expected no discrepancies, got %+v", report)
+			}
+			return
+		}
+		assertPeersEqual(t, ids[:1], report.Expired)
+		assertPeersEqual(t, ids[1:2], report.Dangling)
+		assertKeysEqual(t, []ds.Key{orphan}, report.Orphaned)
+	}
+
+	report, err := ab.Verify(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertReport(report, 2, true)
+	if report.Repaired {
+		t.Fatal("expected nothing to be repaired")
+	}
+
+	// nothing was repaired, so the same discrepancies are found again.
+	report, err = ab.Verify(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertReport(report, 2, true)
+	if !report.Repaired {
+		t.Fatal("expected the discrepancies to be repaired")
+	}
+
+	report, err = ab.Verify(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertReport(report, 1, false)
+	if len(ab.Addrs(ids[1])) != 0 {
+		t.Fatal("expected the dangling record to be evicted")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ab.Verify(ctx, true); err != context.Canceled {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+}
+
+// failingCommitStore fails to commit batches while broken.
+type failingCommitStore struct {
+	ds.Batching
+	broken int32
+}
+
+type failingCommitBatch struct {
+	ds.Batch
+	store *failingCommitStore
+}
+
+func (s *failingCommitStore) Batch() (ds.Batch, error) {
+	b, err := s.Batching.Batch()
+	if err != nil {
+		return nil, err
+	}
+	return &failingCommitBatch{Batch: b, store: s}, nil
+}
+
+func (b *failingCommitBatch) Commit() error {
+	if atomic.LoadInt32(&b.store.broken) == 1 {
+		return errBrokenStore
+	}
+	return b.Batch.Commit()
+}
+
+func TestVerifyFailedRepair(t *testing.T) {
+	store := &failingCommitStore{Batching: dssync.MutexWrap(ds.NewMapDatastore())}
+	clock := newMockClock()
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.Clock = clock
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	id := test.GeneratePeerIDs(1)[0]
+	ab.AddAddrs(id, test.GenerateAddrs(2), time.Minute)
+	clock.Advance(2 * time.Minute)
+
+	// the repair isn't committed, so the cached record it cleaned is evicted...
+	atomic.StoreInt32(&store.broken, 1)
+	report, err := ab.Verify(context.Background(), true)
+	if err == nil || report.Repaired {
+		t.Fatalf("expected the repair to fail, got %+v, err: %v", report, err)
+	}
+	assertPeersEqual(t, []peer.ID{id}, report.Expired)
+	if ab.cache.Contains(id) {
+		t.Fatal("expected the repaired record to be evicted from the cache")
+	}
+
+	// ... and the expired addresses are still found in the store.
+	atomic.StoreInt32(&store.broken, 0)
+	if report, err = ab.Verify(context.Background(), true); err != nil || !report.Repaired {
+		t.Fatalf("expected the repair to succeed, got %+v, err: %v", report, err)
+	}
+	assertPeersEqual(t, []peer.ID{id}, report.Expired)
+}
+
+// limitedBatchStore fails to commit batches holding more than limit operations, like Badger does with transactions
+// that are too big.
+type limitedBatchStore struct {
+	ds.Batching
+	limit int
+}
+
+type limitedBatch struct {
+	ds.Batch
+	limit int
+	ops   int
+}
+
+func (s *limitedBatchStore) Batch() (ds.Batch, error) {
+	b, err := s.Batching.Batch()
+	if err != nil {
+		return nil, err
+	}
+	return &limitedBatch{Batch: b, limit: s.limit}, nil
+}
+
+func (b *limitedBatch) Put(key ds.Key, value []byte) error {
+	b.ops++
+	return b.Batch.Put(key, value)
+}
+
+func (b *limitedBatch) Delete(key ds.Key) error {
+	b.ops++
+	return b.Batch.Delete(key)
+}
+
+func (b *limitedBatch) Commit() error {
+	if b.ops > b.limit {
+		return errors.New("transaction too big")
+	}
+	return b.Batch.Commit()
+}
+
+func TestVerifyMaxBatchSize(t *testing.T) {
+	store := &limitedBatchStore{Batching: dssync.MutexWrap(ds.NewMapDatastore()), limit: 4}
+	clock := newMockClock()
+
+	opts := DefaultOpts()
+	opts.GCPurgeInterval = 0
+	opts.Clock = clock
+	opts.MaxBatchSize = store.limit
+	ab, err := NewAddrBook(context.Background(), store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.Close()
+
+	// the repairs don't fit in a single batch, but are committed in several.
+	ids := test.GeneratePeerIDs(10)
+	addrs := test.GenerateAddrs(2)
+	for _, id := range ids {
+		ab.AddAddr(id, addrs[0], time.Minute)
+		ab.AddAddr(id, addrs[1], time.Hour)
+	}
+	clock.Advance(2 * time.Minute)
+
+	report, err := ab.Verify(context.Background(), true)
+	if err != nil || !report.Repaired {
+		t.Fatalf("expected the repair to succeed, got %+v, err: %v", report, err)
+	}
+	assertPeersEqual(t, ids, report.Expired)
+
+	if report, err = ab.Verify(context.Background(), false); err != nil || len(report.Expired) != 0 {
+		t.Fatalf("expected no expired addresses left, got %+v, err: %v", report, err)
+	}
+}
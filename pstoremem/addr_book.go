@@ -222,6 +222,12 @@ func (mab *memoryAddrBook) AddrStream(ctx context.Context, p peer.ID) <-chan ma.
 	return mab.subManager.AddrStream(ctx, p, initial)
 }
 
+// AddrStreamMany returns a single subscription to the new addresses of a set
+// of peers, which can be changed while it's active.
+func (mab *memoryAddrBook) AddrStreamMany(ctx context.Context, peers []peer.ID) *MultiAddrStream {
+	return mab.subManager.AddrStreamMany(ctx, peers)
+}
+
 type addrSub struct {
 	pubch  chan ma.Multiaddr
 	lk     sync.Mutex
@@ -236,18 +242,66 @@ func (s *addrSub) pubAddr(a ma.Multiaddr) {
 	}
 }
 
+// OverflowPolicy determines which address is dropped when an address is
+// published to a stream whose buffer is full.
+type OverflowPolicy int
+
+const (
+	// DropNewest drops the address being published.
+	DropNewest OverflowPolicy = iota
+	// DropOldest drops the address that has been queued the longest.
+	DropOldest
+)
+
 // An abstracted, pub-sub manager for address streams. Extracted from
 // memoryAddrBook in order to support additional implementations.
 type AddrSubManager struct {
-	mu   sync.RWMutex
-	subs map[peer.ID][]*addrSub
+	mu         sync.RWMutex
+	subs       map[peer.ID][]*addrSub
+	expirySubs map[peer.ID][]*addrSub
+	multiSubs  map[peer.ID]map[*MultiAddrStream]struct{}
+	batchSubs  map[peer.ID][]*batchSub
+	peerSubs   map[*peerSub]struct{}
+
+	bufSize  int
+	overflow OverflowPolicy
 }
 
-// NewAddrSubManager initializes an AddrSubManager.
+// NewAddrSubManager initializes an AddrSubManager. The addresses pending
+// delivery to a stream are buffered without bounds.
 func NewAddrSubManager() *AddrSubManager {
+	return NewAddrSubManagerWithBuffer(0, DropNewest)
+}
+
+// NewAddrSubManagerWithBuffer initializes an AddrSubManager that buffers at
+// most bufSize addresses pending delivery to each stream, resorting to the
+// overflow policy when a stream's buffer is full. Either way, publishers are
+// never blocked by a slow consumer. A bufSize of 0 or lower leaves buffers
+// unbounded.
+func NewAddrSubManagerWithBuffer(bufSize int, overflow OverflowPolicy) *AddrSubManager {
 	return &AddrSubManager{
-		subs: make(map[peer.ID][]*addrSub),
+		subs:       make(map[peer.ID][]*addrSub),
+		expirySubs: make(map[peer.ID][]*addrSub),
+		multiSubs:  make(map[peer.ID]map[*MultiAddrStream]struct{}),
+		batchSubs:  make(map[peer.ID][]*batchSub),
+		peerSubs:   make(map[*peerSub]struct{}),
+		bufSize:    bufSize,
+		overflow:   overflow,
+	}
+}
+
+// enqueue appends an address to a stream buffer, applying the overflow policy
+// if the buffer is full.
+func (mgr *AddrSubManager) enqueue(buffer []ma.Multiaddr, a ma.Multiaddr) []ma.Multiaddr {
+	if mgr.bufSize <= 0 || len(buffer) < mgr.bufSize {
+		return append(buffer, a)
 	}
+	if mgr.overflow == DropOldest {
+		log.Debugf("address stream buffer full; dropping address: %s", buffer[0])
+		return append(buffer[1:], a)
+	}
+	log.Debugf("address stream buffer full; dropping address: %s", a)
+	return buffer
 }
 
 // Used internally by the address stream coroutine to remove a subscription
@@ -256,12 +310,27 @@ func (mgr *AddrSubManager) removeSub(p peer.ID, s *addrSub) {
 	mgr.mu.Lock()
 	defer mgr.mu.Unlock()
 
-	subs := mgr.subs[p]
+	removeSubFrom(mgr.subs, p, s)
+}
+
+// Used internally by the expiry stream coroutine to remove a subscription
+// from the manager.
+func (mgr *AddrSubManager) removeExpirySub(p peer.ID, s *addrSub) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+
+	removeSubFrom(mgr.expirySubs, p, s)
+}
+
+// removeSubFrom removes a subscription from the given subscription map. The
+// caller must hold the manager's write lock.
+func removeSubFrom(all map[peer.ID][]*addrSub, p peer.ID, s *addrSub) {
+	subs := all[p]
 	if len(subs) == 1 {
 		if subs[0] != s {
 			return
 		}
-		delete(mgr.subs, p)
+		delete(all, p)
 		return
 	}
 
@@ -269,7 +338,7 @@ func (mgr *AddrSubManager) removeSub(p peer.ID, s *addrSub) {
 		if v == s {
 			subs[i] = subs[len(subs)-1]
 			subs[len(subs)-1] = nil
-			mgr.subs[p] = subs[:len(subs)-1]
+			all[p] = subs[:len(subs)-1]
 			return
 		}
 	}
@@ -285,11 +354,475 @@ func (mgr *AddrSubManager) BroadcastAddr(p peer.ID, addr ma.Multiaddr) {
 			sub.pubAddr(addr)
 		}
 	}
+	for s := range mgr.multiSubs[p] {
+		s.pub(PeerAddr{Peer: p, Addr: addr})
+	}
+}
+
+// BroadcastAddrs broadcasts a set of new addresses, added to a peer by a
+// single mutation. Address streams receive each address in turn, as with
+// BroadcastAddr, while batch streams receive the whole set as one event.
+func (mgr *AddrSubManager) BroadcastAddrs(p peer.ID, addrs []ma.Multiaddr) {
+	if len(addrs) == 0 {
+		return
+	}
+
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+
+	for _, addr := range addrs {
+		for _, sub := range mgr.subs[p] {
+			sub.pubAddr(addr)
+		}
+		for s := range mgr.multiSubs[p] {
+			s.pub(PeerAddr{Peer: p, Addr: addr})
+		}
+	}
+	for _, sub := range mgr.batchSubs[p] {
+		sub.pub(addrs)
+	}
+}
+
+// BroadcastExpiry notifies all subscribed expiry streams that an address is no
+// longer held for a peer, either because it expired or because it was removed.
+func (mgr *AddrSubManager) BroadcastExpiry(p peer.ID, addr ma.Multiaddr) {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+
+	if subs, ok := mgr.expirySubs[p]; ok {
+		for _, sub := range subs {
+			sub.pubAddr(addr)
+		}
+	}
+}
+
+// AddrExpiryStream creates a new subscription for a given peer ID, on which
+// addresses are published as they expire or are removed. Unlike AddrStream,
+// the same address may be published more than once if it is re-added and
+// removed again. The channel is closed when the context is cancelled.
+func (mgr *AddrSubManager) AddrExpiryStream(ctx context.Context, p peer.ID) <-chan ma.Multiaddr {
+	sub := &addrSub{pubch: make(chan ma.Multiaddr), ctx: ctx}
+	out := make(chan ma.Multiaddr)
+
+	mgr.mu.Lock()
+	mgr.expirySubs[p] = append(mgr.expirySubs[p], sub)
+	mgr.mu.Unlock()
+
+	go func() {
+		defer close(out)
+
+		var (
+			buffer []ma.Multiaddr
+			next   ma.Multiaddr
+			outch  chan ma.Multiaddr
+		)
+
+		for {
+			select {
+			case outch <- next:
+				if len(buffer) > 0 {
+					next = buffer[0]
+					buffer = buffer[1:]
+				} else {
+					outch = nil
+					next = nil
+				}
+			case naddr := <-sub.pubch:
+				if next == nil {
+					next = naddr
+					outch = out
+				} else {
+					buffer = mgr.enqueue(buffer, naddr)
+				}
+			case <-ctx.Done():
+				mgr.removeExpirySub(p, sub)
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+type batchSub struct {
+	pubch chan []ma.Multiaddr
+	ctx   context.Context
+}
+
+func (s *batchSub) pub(addrs []ma.Multiaddr) {
+	select {
+	case s.pubch <- addrs:
+	case <-s.ctx.Done():
+	}
+}
+
+// AddrBatchStream creates a new subscription for a given peer ID, on which
+// the addresses added to the peer are published as one slice per mutation,
+// e.g. for consumers that only care about the address set having changed.
+// Only additions broadcast with BroadcastAddrs are published. The slices
+// must not be modified. The channel is closed when the context is
+// cancelled.
+func (mgr *AddrSubManager) AddrBatchStream(ctx context.Context, p peer.ID) <-chan []ma.Multiaddr {
+	sub := &batchSub{pubch: make(chan []ma.Multiaddr), ctx: ctx}
+	out := make(chan []ma.Multiaddr)
+
+	mgr.mu.Lock()
+	mgr.batchSubs[p] = append(mgr.batchSubs[p], sub)
+	mgr.mu.Unlock()
+
+	go func() {
+		defer close(out)
+
+		var (
+			buffer [][]ma.Multiaddr
+			next   []ma.Multiaddr
+			outch  chan []ma.Multiaddr
+		)
+
+		for {
+			select {
+			case outch <- next:
+				if len(buffer) > 0 {
+					next = buffer[0]
+					buffer = buffer[1:]
+				} else {
+					outch = nil
+					next = nil
+				}
+			case addrs := <-sub.pubch:
+				if outch == nil {
+					next = addrs
+					outch = out
+				} else {
+					buffer = mgr.enqueueBatch(buffer, addrs)
+				}
+			case <-ctx.Done():
+				mgr.removeBatchSub(p, sub)
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// removeBatchSub removes a batch subscription from the manager.
+func (mgr *AddrSubManager) removeBatchSub(p peer.ID, s *batchSub) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+
+	subs := mgr.batchSubs[p]
+	for i, v := range subs {
+		if v == s {
+			subs[i] = subs[len(subs)-1]
+			subs[len(subs)-1] = nil
+			subs = subs[:len(subs)-1]
+			break
+		}
+	}
+	if len(subs) == 0 {
+		delete(mgr.batchSubs, p)
+	} else {
+		mgr.batchSubs[p] = subs
+	}
+}
+
+// enqueueBatch is like enqueue, for batch stream buffers.
+func (mgr *AddrSubManager) enqueueBatch(buffer [][]ma.Multiaddr, addrs []ma.Multiaddr) [][]ma.Multiaddr {
+	if mgr.bufSize <= 0 || len(buffer) < mgr.bufSize {
+		return append(buffer, addrs)
+	}
+	if mgr.overflow == DropOldest {
+		log.Debugf("address batch stream buffer full; dropping batch: %s", buffer[0])
+		return append(buffer[1:], addrs)
+	}
+	log.Debugf("address batch stream buffer full; dropping batch: %s", addrs)
+	return buffer
+}
+
+type peerSub struct {
+	pubch chan peer.ID
+	ctx   context.Context
+}
+
+func (s *peerSub) pub(p peer.ID) {
+	select {
+	case s.pubch <- p:
+	case <-s.ctx.Done():
+	}
+}
+
+// BroadcastPeerRemoved notifies all subscribed peer streams that a peer no
+// longer holds any addresses, as its last one expired or was removed.
+func (mgr *AddrSubManager) BroadcastPeerRemoved(p peer.ID) {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+
+	for s := range mgr.peerSubs {
+		s.pub(p)
+	}
+}
+
+// PeerRemovedStream creates a new subscription on which peers are published
+// as they lose their last address. The channel is closed when the context is
+// cancelled.
+func (mgr *AddrSubManager) PeerRemovedStream(ctx context.Context) <-chan peer.ID {
+	sub := &peerSub{pubch: make(chan peer.ID), ctx: ctx}
+	out := make(chan peer.ID)
+
+	mgr.mu.Lock()
+	mgr.peerSubs[sub] = struct{}{}
+	mgr.mu.Unlock()
+
+	go func() {
+		defer close(out)
+
+		var (
+			buffer []peer.ID
+			next   peer.ID
+			outch  chan peer.ID
+		)
+
+		for {
+			select {
+			case outch <- next:
+				if len(buffer) > 0 {
+					next = buffer[0]
+					buffer = buffer[1:]
+				} else {
+					outch = nil
+					next = ""
+				}
+			case p := <-sub.pubch:
+				if outch == nil {
+					next = p
+					outch = out
+				} else {
+					buffer = mgr.enqueuePeer(buffer, p)
+				}
+			case <-ctx.Done():
+				mgr.mu.Lock()
+				delete(mgr.peerSubs, sub)
+				mgr.mu.Unlock()
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// enqueuePeer is like enqueue, for peer stream buffers.
+func (mgr *AddrSubManager) enqueuePeer(buffer []peer.ID, p peer.ID) []peer.ID {
+	if mgr.bufSize <= 0 || len(buffer) < mgr.bufSize {
+		return append(buffer, p)
+	}
+	if mgr.overflow == DropOldest {
+		log.Debugf("peer stream buffer full; dropping peer: %s", buffer[0])
+		return append(buffer[1:], p)
+	}
+	log.Debugf("peer stream buffer full; dropping peer: %s", p)
+	return buffer
+}
+
+// PeerAddr is an address of a peer, as published on a MultiAddrStream.
+type PeerAddr struct {
+	Peer peer.ID
+	Addr ma.Multiaddr
+}
+
+// MultiAddrStream is a subscription to the new addresses of a set of peers,
+// multiplexed onto a single channel. Peers can be added to and removed from
+// the set while the subscription is active. See AddrSubManager.AddrStreamMany.
+type MultiAddrStream struct {
+	mgr   *AddrSubManager
+	ctx   context.Context
+	pubch chan PeerAddr
+	out   chan PeerAddr
+
+	// the peers in the set, and whether the subscription has been torn down.
+	// guarded by the manager's lock.
+	peers  map[peer.ID]struct{}
+	closed bool
+}
+
+// AddrStreamMany creates a single subscription to the new addresses of all
+// the given peers. Addresses are published as they're broadcast, along with
+// the peer they belong to; unlike AddrStream, the addresses already on file
+// are not published. One goroutine serves the subscription regardless of the
+// number of peers. The channel is closed when the context is cancelled.
+func (mgr *AddrSubManager) AddrStreamMany(ctx context.Context, peers []peer.ID) *MultiAddrStream {
+	s := &MultiAddrStream{
+		mgr:   mgr,
+		ctx:   ctx,
+		pubch: make(chan PeerAddr),
+		out:   make(chan PeerAddr),
+		peers: make(map[peer.ID]struct{}, len(peers)),
+	}
+	s.Add(peers...)
+
+	go func() {
+		defer close(s.out)
+
+		var (
+			buffer []PeerAddr
+			next   PeerAddr
+			outch  chan PeerAddr
+		)
+
+		for {
+			select {
+			case outch <- next:
+				if len(buffer) > 0 {
+					next = buffer[0]
+					buffer = buffer[1:]
+				} else {
+					outch = nil
+					next = PeerAddr{}
+				}
+			case pa := <-s.pubch:
+				if outch == nil {
+					next = pa
+					outch = s.out
+				} else {
+					buffer = mgr.enqueuePeerAddr(buffer, pa)
+				}
+			case <-ctx.Done():
+				mgr.removeMultiSub(s)
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+// Chan returns the channel on which the addresses are published.
+func (s *MultiAddrStream) Chan() <-chan PeerAddr {
+	return s.out
+}
+
+// Add adds peers to the set whose addresses are published. Adding a peer
+// already in the set, or adding peers after the context is cancelled, has no
+// effect.
+func (s *MultiAddrStream) Add(peers ...peer.ID) {
+	s.mgr.mu.Lock()
+	defer s.mgr.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	for _, p := range peers {
+		s.peers[p] = struct{}{}
+		subs, ok := s.mgr.multiSubs[p]
+		if !ok {
+			subs = make(map[*MultiAddrStream]struct{})
+			s.mgr.multiSubs[p] = subs
+		}
+		subs[s] = struct{}{}
+	}
+}
+
+// Remove removes peers from the set whose addresses are published. Addresses
+// of a removed peer that were broadcast before its removal may still be
+// published.
+func (s *MultiAddrStream) Remove(peers ...peer.ID) {
+	s.mgr.mu.Lock()
+	defer s.mgr.mu.Unlock()
+
+	for _, p := range peers {
+		delete(s.peers, p)
+		s.mgr.removeMultiSubFrom(p, s)
+	}
+}
+
+func (s *MultiAddrStream) pub(pa PeerAddr) {
+	select {
+	case s.pubch <- pa:
+	case <-s.ctx.Done():
+	}
+}
+
+// Used internally by the multiplexed stream coroutine to tear down a
+// subscription.
+func (mgr *AddrSubManager) removeMultiSub(s *MultiAddrStream) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+
+	for p := range s.peers {
+		mgr.removeMultiSubFrom(p, s)
+	}
+	s.peers = nil
+	s.closed = true
+}
+
+// removeMultiSubFrom unsubscribes a multiplexed stream from a peer. The caller
+// must hold the manager's write lock.
+func (mgr *AddrSubManager) removeMultiSubFrom(p peer.ID, s *MultiAddrStream) {
+	subs := mgr.multiSubs[p]
+	delete(subs, s)
+	if len(subs) == 0 {
+		delete(mgr.multiSubs, p)
+	}
+}
+
+// enqueuePeerAddr is like enqueue, for multiplexed stream buffers.
+func (mgr *AddrSubManager) enqueuePeerAddr(buffer []PeerAddr, pa PeerAddr) []PeerAddr {
+	if mgr.bufSize <= 0 || len(buffer) < mgr.bufSize {
+		return append(buffer, pa)
+	}
+	if mgr.overflow == DropOldest {
+		log.Debugf("address stream buffer full; dropping address: %s", buffer[0].Addr)
+		return append(buffer[1:], pa)
+	}
+	log.Debugf("address stream buffer full; dropping address: %s", pa.Addr)
+	return buffer
 }
 
 // AddrStream creates a new subscription for a given peer ID, pre-populating the
 // channel with any addresses we might already have on file.
 func (mgr *AddrSubManager) AddrStream(ctx context.Context, p peer.ID, initial []ma.Multiaddr) <-chan ma.Multiaddr {
+	initCh := make(chan []ma.Multiaddr, 1)
+	initCh <- initial
+	return mgr.addrStream(ctx, p, initCh)
+}
+
+// AddrStreamFunc creates a new subscription for a given peer ID, pre-populating
+// the channel with the addresses returned by initialFn. Unlike AddrStream, the
+// subscription is registered before initialFn is called, so addresses broadcast
+// while the initial set is being read are not missed. Every address is published
+// at most once, whether it shows up in the initial set, in the stream, or both.
+func (mgr *AddrSubManager) AddrStreamFunc(ctx context.Context, p peer.ID,
+	initialFn func() []ma.Multiaddr) <-chan ma.Multiaddr {
+	initCh := make(chan []ma.Multiaddr, 1)
+	out := mgr.addrStream(ctx, p, initCh)
+	initCh <- initialFn()
+	return out
+}
+
+// AddrStreamFuncErr is like AddrStreamFunc, but for an initialFn that can fail.
+// If it does, the subscription is dropped, and the error is returned instead of
+// a stream.
+func (mgr *AddrSubManager) AddrStreamFuncErr(ctx context.Context, p peer.ID,
+	initialFn func() ([]ma.Multiaddr, error)) (<-chan ma.Multiaddr, error) {
+	initCh := make(chan []ma.Multiaddr, 1)
+	out := mgr.addrStream(ctx, p, initCh)
+	addrs, err := initialFn()
+	if err != nil {
+		// closing initCh without a set makes the coroutine drop the subscription.
+		close(initCh)
+		return nil, err
+	}
+	initCh <- addrs
+	return out, nil
+}
+
+// addrStream registers a subscription and spawns the coroutine feeding it. The
+// coroutine buffers any addresses broadcast until the initial set is received
+// on initCh, and publishes them after it, skipping those already in the set.
+// If initCh is closed instead, the subscription is dropped.
+func (mgr *AddrSubManager) addrStream(ctx context.Context, p peer.ID,
+	initCh <-chan []ma.Multiaddr) <-chan ma.Multiaddr {
 	sub := &addrSub{pubch: make(chan ma.Multiaddr), ctx: ctx}
 	out := make(chan ma.Multiaddr)
 
@@ -301,17 +834,43 @@ func (mgr *AddrSubManager) AddrStream(ctx context.Context, p peer.ID, initial []
 	}
 	mgr.mu.Unlock()
 
-	sort.Sort(addr.AddrList(initial))
-
-	go func(buffer []ma.Multiaddr) {
+	go func() {
 		defer close(out)
 
-		sent := make(map[string]bool, len(buffer))
+		var buffer, early []ma.Multiaddr
+	Init:
+		for {
+			select {
+			case initial, ok := <-initCh:
+				if !ok {
+					mgr.removeSub(p, sub)
+					return
+				}
+				buffer = initial
+				break Init
+			case naddr := <-sub.pubch:
+				early = append(early, naddr)
+			case <-ctx.Done():
+				mgr.removeSub(p, sub)
+				return
+			}
+		}
+
+		sort.Sort(addr.AddrList(buffer))
+
+		sent := make(map[string]bool, len(buffer)+len(early))
 		var outch chan ma.Multiaddr
 
 		for _, a := range buffer {
 			sent[string(a.Bytes())] = true
 		}
+		for _, a := range early {
+			if sent[string(a.Bytes())] {
+				continue
+			}
+			sent[string(a.Bytes())] = true
+			buffer = append(buffer, a)
+		}
 
 		var next ma.Multiaddr
 		if len(buffer) > 0 {
@@ -340,15 +899,14 @@ func (mgr *AddrSubManager) AddrStream(ctx context.Context, p peer.ID, initial []
 					next = naddr
 					outch = out
 				} else {
-					buffer = append(buffer, naddr)
+					buffer = mgr.enqueue(buffer, naddr)
 				}
 			case <-ctx.Done():
 				mgr.removeSub(p, sub)
 				return
 			}
 		}
-
-	}(initial)
+	}()
 
 	return out
 }
@@ -1,7 +1,11 @@
 package pstoremem
 
 import (
+	"context"
 	"testing"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
 
 	pstore "github.com/libp2p/go-libp2p-peerstore"
 	pt "github.com/libp2p/go-libp2p-peerstore/test"
@@ -36,3 +40,131 @@ func BenchmarkInMemoryKeyBook(b *testing.B) {
 		return NewKeyBook(), nil
 	})
 }
+
+func TestAddrStreamFuncDedup(t *testing.T) {
+	mgr := NewAddrSubManager()
+	id := pt.GeneratePeerIDs(1)[0]
+	addrs := pt.GenerateAddrs(3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// addresses broadcast while the initial set is read are neither lost nor duplicated.
+	ch := mgr.AddrStreamFunc(ctx, id, func() []ma.Multiaddr {
+		mgr.BroadcastAddr(id, addrs[0])
+		mgr.BroadcastAddr(id, addrs[2])
+		return addrs[:2]
+	})
+	mgr.BroadcastAddr(id, addrs[1])
+
+	var got []ma.Multiaddr
+	timeout := time.After(5 * time.Second)
+	for len(got) < len(addrs) {
+		select {
+		case a := <-ch:
+			got = append(got, a)
+		case <-timeout:
+			t.Fatalf("timed out after receiving %d addresses", len(got))
+		}
+	}
+	pt.AssertAddressesEqual(t, addrs, got)
+
+	select {
+	case a := <-ch:
+		t.Fatalf("received duplicate address: %s", a)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAddrStreamOverflow(t *testing.T) {
+	id := pt.GeneratePeerIDs(1)[0]
+	addrs := pt.GenerateAddrs(5)
+
+	for policy, expected := range map[OverflowPolicy][]ma.Multiaddr{
+		DropNewest: addrs[:3],
+		DropOldest: {addrs[0], addrs[3], addrs[4]},
+	} {
+		mgr := NewAddrSubManagerWithBuffer(2, policy)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		// the consumer isn't reading; broadcasting must not block regardless.
+		ch := mgr.AddrStream(ctx, id, nil)
+		for _, a := range addrs {
+			mgr.BroadcastAddr(id, a)
+		}
+
+		var got []ma.Multiaddr
+		for len(got) < len(expected) {
+			select {
+			case a := <-ch:
+				got = append(got, a)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out after receiving %d addresses", len(got))
+			}
+		}
+		pt.AssertAddressesEqual(t, expected, got)
+
+		select {
+		case a := <-ch:
+			t.Fatalf("expected address to be dropped, received: %s", a)
+		case <-time.After(50 * time.Millisecond):
+		}
+		cancel()
+	}
+}
+
+func TestAddrStreamMany(t *testing.T) {
+	ids := pt.GeneratePeerIDs(3)
+	addrs := pt.GenerateAddrs(4)
+
+	mgr := NewAddrSubManager()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := mgr.AddrStreamMany(ctx, ids[:2])
+
+	receive := func() PeerAddr {
+		select {
+		case pa := <-s.Chan():
+			return pa
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for address")
+		}
+		return PeerAddr{}
+	}
+
+	mgr.BroadcastAddr(ids[0], addrs[0])
+	mgr.BroadcastAddr(ids[2], addrs[1]) // not in the set.
+	mgr.BroadcastAddr(ids[1], addrs[2])
+	if pa := receive(); pa.Peer != ids[0] || !pa.Addr.Equal(addrs[0]) {
+		t.Fatalf("unexpected address: %v", pa)
+	}
+	if pa := receive(); pa.Peer != ids[1] || !pa.Addr.Equal(addrs[2]) {
+		t.Fatalf("unexpected address: %v", pa)
+	}
+
+	// the set can be changed without tearing the subscription down.
+	s.Remove(ids[0])
+	s.Add(ids[2])
+	mgr.BroadcastAddr(ids[0], addrs[3])
+	mgr.BroadcastAddr(ids[2], addrs[3])
+	if pa := receive(); pa.Peer != ids[2] || !pa.Addr.Equal(addrs[3]) {
+		t.Fatalf("unexpected address: %v", pa)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-s.Chan():
+		if ok {
+			t.Fatal("expected no more addresses")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the stream to close")
+	}
+
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+	if len(mgr.multiSubs) != 0 {
+		t.Fatalf("expected subscriptions to be removed, got: %d", len(mgr.multiSubs))
+	}
+}